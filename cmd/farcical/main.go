@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"farcical"
+	"farcical/repl"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+)
+
+func main() {
+	filepath := flag.String("file", "", "Path to file to interpret")
+	searchPath := flag.String("path", "", "Directories to search for imported modules, separated by "+string(os.PathListSeparator))
+	engine := flag.String("engine", "eval", "How to run scripts: eval walks the syntax tree, vm compiles to bytecode")
+	flag.Parse()
+
+	if *engine != "eval" && *engine != "vm" {
+		fmt.Fprintf(os.Stderr, "unknown engine %q, want eval or vm\n", *engine)
+		os.Exit(2)
+	}
+
+	if *filepath != "" {
+		code, err := os.ReadFile(*filepath)
+		if err != nil {
+			fmt.Printf("Error reading file: %v\n", err)
+			return
+		}
+
+		var opts []farcical.Option
+		if *engine == "vm" {
+			opts = append(opts, farcical.WithEngine(farcical.EngineVM))
+		}
+		if *searchPath != "" {
+			opts = append(opts, farcical.WithSearchPath(strings.Split(*searchPath, string(os.PathListSeparator))...))
+		}
+
+		evaluated, err := farcical.New(opts...).Eval(*filepath, string(code))
+		if err != nil {
+			var syntaxErr *farcical.SyntaxError
+			var runtimeErr *farcical.RuntimeError
+			switch {
+			case errors.As(err, &syntaxErr):
+				syntaxErr.Render(os.Stderr)
+			case errors.As(err, &runtimeErr):
+				runtimeErr.Render(os.Stderr)
+			default:
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+		if evaluated != nil {
+			io.WriteString(os.Stdout, evaluated.Inspect())
+			io.WriteString(os.Stdout, "\n")
+		}
+		return
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf(` ______ 
+|  ____|
+| |__   
+|  __|  
+| |     
+|_|
+`)
+	fmt.Printf("\nFarcical v0.0.0")
+	fmt.Printf("\nREPL Session: %s\n", user.Username)
+	if *engine == "vm" {
+		repl.StartVM(os.Stdin, os.Stdout)
+	} else {
+		repl.Start(os.Stdin, os.Stdout)
+	}
+}
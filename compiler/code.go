@@ -0,0 +1,263 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Instructions is a sequence of encoded instructions: an opcode byte followed by its
+// operands, each a big-endian unsigned integer of the width its Definition gives
+type Instructions []byte
+
+type Opcode byte
+
+const (
+	OpConstant Opcode = iota // push constant [index]
+	OpNull                   // push null
+	OpNil                    // push nothing, the value of statements like let
+	OpTrue
+	OpFalse
+	OpPop
+	OpDup2 // push the top two values again, for compound assignments to an index
+
+	// binary operators, popping two values and pushing the result
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpEqual
+	OpNotEqual
+	OpLess
+	OpGreater
+	OpLessEqual
+	OpGreaterEqual
+	OpRange
+
+	OpMinus
+	OpBang
+
+	OpJump        // jump to [target]
+	OpJumpIfFalse // pop a value and jump to [target] unless it is truthy
+	OpAnd         // jump to [target] keeping the value on top if it is falsy, otherwise pop it
+	OpOr          // jump to [target] keeping the value on top if it is truthy, otherwise pop it
+
+	// variables. [chain] indexes CompiledFunction.Chains, the places further out a read
+	// falls back to, in order, while the variable in [slot] hasn't been set yet
+	OpGetGlobal    // push the global or builtin [name]
+	OpDefineGlobal // pop a value into the global [name]
+	OpGetLocal     // push the local in [slot], falling back to [chain]
+	OpGetCell      // push the captured local in [slot], falling back to [chain]
+	OpGetFree      // push free variable [index], falling back to [chain]
+	OpSetLocal     // pop a value into the local in [slot]
+	OpSetCell      // pop a value into the captured local in [slot]
+	OpAssign       // assign the value on top to the first variable of [chain] that is set
+	OpAssignLocal  // assign the value on top to [slot], or as OpAssign [chain] if it isn't set
+	OpAssignCell   // assign the value on top to the captured [slot], or as OpAssign [chain] if it isn't set
+	OpNameFunction // name the function on top [name] if it is anonymous
+	OpEnterScope   // clear the locals of scope [index] and create cells for its captured ones
+
+	OpLoadCell // push the cell of the captured local in [slot], to make a closure
+	OpLoadFree // push the cell of free variable [index], to make a closure
+	OpClosure  // pop [count] cells and push a closure of function constant [index] over them
+
+	OpArray   // pop [count] elements and push an array of them
+	OpHash    // pop [count] keys and values and push a hash of them
+	OpHashKey // raise an error if the value on top can't be a hash key
+	OpIndex
+	OpSetIndex // pop a value, an index and a collection, assign, and push the value
+	OpMember   // pop a namespace and push its member [name]
+
+	OpCall        // call the function below [count] arguments
+	OpReturnValue // return the value on top from the current function
+	OpArgGiven    // jump to [target] if argument [index] was passed, to skip its default
+
+	OpCheckContext // raise an error if the run's context is done, at the top of each loop
+	OpIterInit     // pop an array, hash, string or range and keep an iterator over it in [slot]
+	OpIterNext     // push the next value of the iterator in [slot], or jump to [target] when it's done
+
+	OpSetupTry // handle errors raised from here on by jumping to [target] with the error on top
+	OpPopTry   // stop handling errors with the innermost handler
+	OpCatch    // turn the error on top into the hash a catch block sees
+	OpRethrow  // pop an error and raise it again unchanged
+	OpThrow    // pop a value and raise it as an error
+
+	OpImport      // push the namespace exported by the module at path [path]
+	OpImportAlias // bind the namespace on top to the global [name]
+	OpImportName  // bind member [name] of the namespace on top, imported from [path], to a global
+	OpExport      // record global [name] as exported by the module being run
+)
+
+// Definition describes an opcode for encoding and disassembly
+type Definition struct {
+	Name          string
+	OperandWidths []int // bytes in each operand
+}
+
+var definitions = map[Opcode]*Definition{
+	OpConstant: {"OpConstant", []int{2}},
+	OpNull:     {"OpNull", []int{}},
+	OpNil:      {"OpNil", []int{}},
+	OpTrue:     {"OpTrue", []int{}},
+	OpFalse:    {"OpFalse", []int{}},
+	OpPop:      {"OpPop", []int{}},
+	OpDup2:     {"OpDup2", []int{}},
+
+	OpAdd:          {"OpAdd", []int{}},
+	OpSub:          {"OpSub", []int{}},
+	OpMul:          {"OpMul", []int{}},
+	OpDiv:          {"OpDiv", []int{}},
+	OpMod:          {"OpMod", []int{}},
+	OpEqual:        {"OpEqual", []int{}},
+	OpNotEqual:     {"OpNotEqual", []int{}},
+	OpLess:         {"OpLess", []int{}},
+	OpGreater:      {"OpGreater", []int{}},
+	OpLessEqual:    {"OpLessEqual", []int{}},
+	OpGreaterEqual: {"OpGreaterEqual", []int{}},
+	OpRange:        {"OpRange", []int{}},
+
+	OpMinus: {"OpMinus", []int{}},
+	OpBang:  {"OpBang", []int{}},
+
+	OpJump:        {"OpJump", []int{4}},
+	OpJumpIfFalse: {"OpJumpIfFalse", []int{4}},
+	OpAnd:         {"OpAnd", []int{4}},
+	OpOr:          {"OpOr", []int{4}},
+
+	OpGetGlobal:    {"OpGetGlobal", []int{2}},
+	OpDefineGlobal: {"OpDefineGlobal", []int{2}},
+	OpGetLocal:     {"OpGetLocal", []int{2, 2}},
+	OpGetCell:      {"OpGetCell", []int{2, 2}},
+	OpGetFree:      {"OpGetFree", []int{2, 2}},
+	OpSetLocal:     {"OpSetLocal", []int{2}},
+	OpSetCell:      {"OpSetCell", []int{2}},
+	OpAssign:       {"OpAssign", []int{2}},
+	OpAssignLocal:  {"OpAssignLocal", []int{2, 2}},
+	OpAssignCell:   {"OpAssignCell", []int{2, 2}},
+	OpNameFunction: {"OpNameFunction", []int{2}},
+	OpEnterScope:   {"OpEnterScope", []int{2}},
+
+	OpLoadCell: {"OpLoadCell", []int{2}},
+	OpLoadFree: {"OpLoadFree", []int{2}},
+	OpClosure:  {"OpClosure", []int{2, 2}},
+
+	OpArray:    {"OpArray", []int{4}},
+	OpHash:     {"OpHash", []int{4}},
+	OpHashKey:  {"OpHashKey", []int{}},
+	OpIndex:    {"OpIndex", []int{}},
+	OpSetIndex: {"OpSetIndex", []int{}},
+	OpMember:   {"OpMember", []int{2}},
+
+	OpCall:        {"OpCall", []int{2}},
+	OpReturnValue: {"OpReturnValue", []int{}},
+	OpArgGiven:    {"OpArgGiven", []int{2, 4}},
+
+	OpCheckContext: {"OpCheckContext", []int{}},
+	OpIterInit:     {"OpIterInit", []int{2}},
+	OpIterNext:     {"OpIterNext", []int{2, 4}},
+
+	OpSetupTry: {"OpSetupTry", []int{4}},
+	OpPopTry:   {"OpPopTry", []int{}},
+	OpCatch:    {"OpCatch", []int{}},
+	OpRethrow:  {"OpRethrow", []int{}},
+	OpThrow:    {"OpThrow", []int{}},
+
+	OpImport:      {"OpImport", []int{2}},
+	OpImportAlias: {"OpImportAlias", []int{2}},
+	OpImportName:  {"OpImportName", []int{2, 2}},
+	OpExport:      {"OpExport", []int{2}},
+}
+
+// Lookup returns the definition of op
+func Lookup(op byte) (*Definition, error) {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+	return def, nil
+}
+
+// Make encodes an instruction
+func Make(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	length := 1
+	for _, w := range def.OperandWidths {
+		length += w
+	}
+
+	instruction := make([]byte, length)
+	instruction[0] = byte(op)
+
+	offset := 1
+	for i, o := range operands {
+		switch def.OperandWidths[i] {
+		case 2:
+			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
+		}
+		offset += def.OperandWidths[i]
+	}
+
+	return instruction
+}
+
+// ReadOperands decodes the operands of an instruction, returning them and how many bytes they took
+func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
+	operands := make([]int, len(def.OperandWidths))
+	offset := 0
+
+	for i, width := range def.OperandWidths {
+		switch width {
+		case 2:
+			operands[i] = int(ReadUint16(ins[offset:]))
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
+		}
+		offset += width
+	}
+
+	return operands, offset
+}
+
+func ReadUint16(ins Instructions) uint16 { return binary.BigEndian.Uint16(ins) }
+func ReadUint32(ins Instructions) uint32 { return binary.BigEndian.Uint32(ins) }
+
+// String disassembles the instructions, one per line, each prefixed with its offset
+func (ins Instructions) String() string {
+	var out bytes.Buffer
+
+	i := 0
+	for i < len(ins) {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			i++
+			continue
+		}
+
+		operands, read := ReadOperands(def, ins[i+1:])
+		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+
+		i += 1 + read
+	}
+
+	return out.String()
+}
+
+func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
+	if len(operands) != len(def.OperandWidths) {
+		return fmt.Sprintf("ERROR: operand len %d does not match defined %d\n", len(operands), len(def.OperandWidths))
+	}
+
+	out := def.Name
+	for _, operand := range operands {
+		out += fmt.Sprintf(" %d", operand)
+	}
+	return out
+}
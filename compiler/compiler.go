@@ -0,0 +1,826 @@
+// Package compiler lowers a parsed program to bytecode for the vm package to run.
+// Compiled code behaves exactly like the evaluator running the same program,
+// errors included, only faster
+package compiler
+
+import (
+	"encoding/binary"
+	"farcical/ast"
+	"farcical/diag"
+	"farcical/object"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
+
+// CompiledFunction is the code of a function literal, or of the top level of a program
+type CompiledFunction struct {
+	Instructions Instructions
+	Constants    []object.Object // the literals, names and nested functions the instructions refer to
+	NumLocals    int             // slots in the frame: parameters first, then other variables and temporaries
+	NumParams    int
+	Required     int  // parameters without a default
+	Rest         bool // extra arguments are collected in the slot after the parameters
+	Scopes       []ScopeLayout
+	Chains       [][]Location // where variable references fall back to, see OpGetLocal
+	Positions    []Position
+	Literal      *ast.FunctionLiteral // nil for the top level
+}
+
+func (cf *CompiledFunction) Type() object.ObjectType { return COMPILED_FUNCTION_OBJ }
+func (cf *CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", cf)
+}
+
+// Span returns the span of the node the instruction at offset was compiled from
+func (cf *CompiledFunction) Span(offset int) diag.Span {
+	i := sort.Search(len(cf.Positions), func(i int) bool { return cf.Positions[i].Offset > offset })
+	if i == 0 {
+		return diag.Span{}
+	}
+	return cf.Positions[i-1].Span
+}
+
+// ScopeLayout is what OpEnterScope does to the frame: the slots to clear, for a
+// scope that starts afresh each time, and then the slots to move into new cells
+type ScopeLayout struct {
+	Clear []int
+	Cells []int
+}
+
+// Position records that the instructions from Offset on, up to the next Position,
+// were compiled from the node at Span, for placing errors
+type Position struct {
+	Offset int
+	Span   diag.Span
+}
+
+// Compile compiles a program to the function that runs its top level
+func Compile(program *ast.Program) (*CompiledFunction, error) {
+	c := &Compiler{}
+	c.fn = c.newFunction(NewSymbolTable(), nil)
+
+	c.compileStatements(program.Statements, true)
+	c.emit(OpReturnValue)
+
+	main := c.finishFunction()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return main, nil
+}
+
+// Compiler holds the state of one compilation
+type Compiler struct {
+	fn    *function  // the function being compiled
+	nodes []ast.Node // the nodes being compiled, innermost last, for positions
+	err   error
+}
+
+// function is a function part way through being compiled
+type function struct {
+	outer    *function
+	compiled *CompiledFunction
+	symbols  *SymbolTable
+	chains   [][]Location
+	strings  map[string]int // constants holding each string, which names are too
+	integers map[int64]int  // constants holding each integer
+	loops    []*loop        // the loops being compiled, innermost last
+	tries    []tryBlock     // the try statements being compiled, innermost last
+}
+
+// loop is where break and continue statements jump
+type loop struct {
+	start  int   // where continue goes
+	breaks []int // jumps to patch to the end of the loop
+	tries  int   // how many tries enclosed the loop
+}
+
+// tryBlock is a part of a try statement that break, continue and return have to
+// clean up after leaving early: by dropping the handler guarding it, if there is
+// one, and then running the finally block, if there is one
+type tryBlock struct {
+	handler bool
+	finally *ast.BlockStatement
+}
+
+func (c *Compiler) newFunction(symbols *SymbolTable, lit *ast.FunctionLiteral) *function {
+	return &function{
+		outer:    c.fn,
+		compiled: &CompiledFunction{Literal: lit},
+		symbols:  symbols,
+		strings:  make(map[string]int),
+		integers: make(map[int64]int),
+	}
+}
+
+func (c *Compiler) fail(format string, a ...interface{}) {
+	if c.err == nil {
+		c.err = fmt.Errorf("compile error: "+format, a...)
+	}
+}
+
+// compileStatements compiles a sequence of statements, leaving the value of the
+// last on the stack if keep is set, as the value of a block or program
+func (c *Compiler) compileStatements(statements []ast.Statement, keep bool) {
+	if len(statements) == 0 {
+		if keep {
+			c.emit(OpNil)
+		}
+		return
+	}
+
+	for i, statement := range statements {
+		c.compileStatement(statement, keep && i == len(statements)-1)
+	}
+}
+
+func (c *Compiler) compileBlock(block *ast.BlockStatement, keep bool) {
+	c.compileStatements(block.Statements, keep)
+}
+
+// compileStatement compiles a statement, leaving its value on the stack if keep is set.
+// Statements without a value, such as let, leave nothing, which isn't the same as null
+func (c *Compiler) compileStatement(stmt ast.Statement, keep bool) {
+	c.nodes = append(c.nodes, stmt)
+	defer func() { c.nodes = c.nodes[:len(c.nodes)-1] }()
+
+	switch stmt := stmt.(type) {
+	case *ast.ExpressionStatement:
+		c.compileExpression(stmt.Expression)
+		if !keep {
+			c.emit(OpPop)
+		}
+		return
+
+	case *ast.BlockStatement:
+		c.compileBlock(stmt, keep)
+		return
+
+	case *ast.LetStatement:
+		c.compileExpression(stmt.Value)
+		c.emit(OpNameFunction, c.stringConstant(stmt.Name.Value))
+		c.define(stmt.Name.Value)
+
+	case *ast.ExportStatement:
+		c.compileStatement(stmt.Statement, false)
+		c.emit(OpExport, c.stringConstant(stmt.Statement.Name.Value))
+
+	case *ast.ReturnStatement:
+		c.compileExpression(stmt.ReturnValue)
+		c.leaveTries(0)
+		c.emit(OpReturnValue)
+		return
+
+	case *ast.BreakStatement:
+		l := c.fn.loops[len(c.fn.loops)-1]
+		c.leaveTries(l.tries)
+		l.breaks = append(l.breaks, c.emit(OpJump, 0))
+		return
+
+	case *ast.ContinueStatement:
+		l := c.fn.loops[len(c.fn.loops)-1]
+		c.leaveTries(l.tries)
+		c.emit(OpJump, l.start)
+		return
+
+	case *ast.WhileStatement:
+		c.compileWhile(stmt)
+
+	case *ast.ForStatement:
+		c.compileFor(stmt)
+
+	case *ast.TryStatement:
+		c.compileTry(stmt, keep)
+		return
+
+	case *ast.ThrowStatement:
+		c.compileExpression(stmt.Value)
+		c.emit(OpThrow)
+		return
+
+	case *ast.ImportStatement:
+		path := c.stringConstant(stmt.Path.Value)
+		c.emit(OpImport, path)
+		if stmt.Alias != nil {
+			c.emit(OpImportAlias, c.stringConstant(stmt.Alias.Value))
+		}
+		for _, name := range stmt.Names {
+			c.emit(OpImportName, c.stringConstant(name.Value), path)
+		}
+		c.emit(OpPop)
+
+	default:
+		c.fail("unknown statement %T", stmt)
+	}
+
+	if keep {
+		c.emit(OpNil)
+	}
+}
+
+func (c *Compiler) compileExpression(expr ast.Expression) {
+	c.nodes = append(c.nodes, expr)
+	defer func() { c.nodes = c.nodes[:len(c.nodes)-1] }()
+
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral:
+		if expr.Big != nil {
+			c.emit(OpConstant, c.addConstant(&object.BigInt{Value: expr.Big}))
+		} else {
+			c.emit(OpConstant, c.integerConstant(expr.Value))
+		}
+
+	case *ast.FloatLiteral:
+		c.emit(OpConstant, c.addConstant(&object.Float{Value: expr.Value}))
+
+	case *ast.StringLiteral:
+		c.emit(OpConstant, c.stringConstant(expr.Value))
+
+	case *ast.Boolean:
+		if expr.Value {
+			c.emit(OpTrue)
+		} else {
+			c.emit(OpFalse)
+		}
+
+	case *ast.PrefixExpression:
+		c.compileExpression(expr.Right)
+		switch expr.Operator {
+		case "!":
+			c.emit(OpBang)
+		case "-":
+			c.emit(OpMinus)
+		default:
+			c.fail("unknown operator %s", expr.Operator)
+		}
+
+	case *ast.InfixExpression:
+		c.compileInfix(expr)
+
+	case *ast.IfExpression:
+		c.compileExpression(expr.Condition)
+		skipConsequence := c.emit(OpJumpIfFalse, 0)
+		c.compileBlock(expr.Consequence, true)
+		skipAlternative := c.emit(OpJump, 0)
+
+		c.patchJump(skipConsequence)
+		if expr.Alternative != nil {
+			c.compileBlock(expr.Alternative, true)
+		} else {
+			c.emit(OpNull)
+		}
+		c.patchJump(skipAlternative)
+
+	case *ast.Identifier:
+		c.compileIdentifier(expr.Value)
+
+	case *ast.MemberExpression:
+		c.compileExpression(expr.Object)
+		c.emit(OpMember, c.stringConstant(expr.Property.Value))
+
+	case *ast.FunctionLiteral:
+		c.compileFunction(expr)
+
+	case *ast.CallExpression:
+		c.compileExpression(expr.Function)
+		for _, arg := range expr.Arguments {
+			c.compileExpression(arg)
+		}
+		c.emit(OpCall, len(expr.Arguments))
+
+	case *ast.ArrayLiteral:
+		for _, el := range expr.Elements {
+			c.compileExpression(el)
+		}
+		c.emit(OpArray, len(expr.Elements))
+
+	case *ast.HashLiteral:
+		for _, key := range expr.Keys {
+			c.compileExpression(key)
+			c.emit(OpHashKey)
+			c.compileExpression(expr.Pairs[key])
+		}
+		c.emit(OpHash, len(expr.Keys))
+
+	case *ast.IndexExpression:
+		c.compileExpression(expr.Left)
+		c.compileExpression(expr.Index)
+		c.emit(OpIndex)
+
+	case *ast.AssignExpression:
+		c.compileAssign(expr)
+
+	default:
+		c.fail("unknown expression %T", expr)
+	}
+}
+
+var infixOperators = map[string]Opcode{
+	"+":  OpAdd,
+	"-":  OpSub,
+	"*":  OpMul,
+	"/":  OpDiv,
+	"%":  OpMod,
+	"==": OpEqual,
+	"!=": OpNotEqual,
+	"<":  OpLess,
+	">":  OpGreater,
+	"<=": OpLessEqual,
+	">=": OpGreaterEqual,
+	"..": OpRange,
+}
+
+// Operators gives the operator each binary opcode applies, for falling back to the evaluator's arithmetic
+var Operators = func() map[Opcode]string {
+	operators := make(map[Opcode]string, len(infixOperators))
+	for operator, op := range infixOperators {
+		operators[op] = operator
+	}
+	return operators
+}()
+
+func (c *Compiler) compileInfix(expr *ast.InfixExpression) {
+	c.compileExpression(expr.Left)
+
+	if expr.Operator == "&&" || expr.Operator == "||" {
+		op := OpAnd
+		if expr.Operator == "||" {
+			op = OpOr
+		}
+		skip := c.emit(op, 0)
+		c.compileExpression(expr.Right)
+		c.patchJump(skip)
+		return
+	}
+
+	c.compileExpression(expr.Right)
+	c.emitOperator(expr.Operator)
+}
+
+func (c *Compiler) emitOperator(operator string) {
+	op, ok := infixOperators[operator]
+	if !ok {
+		c.fail("unknown operator %s", operator)
+		return
+	}
+	c.emit(op)
+}
+
+// compileAssign compiles assignments to variables and to elements of arrays and hashes.
+// Like the evaluator, compound operators evaluate the target's index only once
+func (c *Compiler) compileAssign(expr *ast.AssignExpression) {
+	operator := strings.TrimSuffix(expr.Operator, "=")
+
+	switch target := expr.Target.(type) {
+	case *ast.Identifier:
+		if expr.Operator != "=" {
+			c.compileIdentifier(target.Value)
+		}
+		c.compileExpression(expr.Value)
+		if expr.Operator != "=" {
+			c.emitOperator(operator)
+		}
+		c.emit(OpNameFunction, c.stringConstant(target.Value))
+
+		chain := c.fn.symbols.Resolve(target.Value)
+		if first := chain[0]; first.Kind == Local {
+			c.useSymbol(first.Symbol, c.emit(OpAssignLocal, first.Index, c.addChain(chain[1:])))
+		} else {
+			c.emit(OpAssign, c.addChain(chain))
+		}
+
+	case *ast.IndexExpression:
+		c.compileExpression(target.Left)
+		c.compileExpression(target.Index)
+		if expr.Operator != "=" {
+			c.emit(OpDup2)
+			c.emit(OpIndex)
+		}
+		c.compileExpression(expr.Value)
+		if expr.Operator != "=" {
+			c.emitOperator(operator)
+		}
+		c.emit(OpSetIndex)
+
+	default:
+		c.fail("cannot assign to %s", expr.Target.String())
+	}
+}
+
+func (c *Compiler) compileIdentifier(name string) {
+	chain := c.fn.symbols.Resolve(name)
+
+	switch first := chain[0]; first.Kind {
+	case Local:
+		c.useSymbol(first.Symbol, c.emit(OpGetLocal, first.Index, c.addChain(chain[1:])))
+	case Free:
+		c.emit(OpGetFree, first.Index, c.addChain(chain[1:]))
+	default:
+		c.emit(OpGetGlobal, c.stringConstant(name))
+	}
+}
+
+// define pops the value on top of the stack into the variable name of the current scope
+func (c *Compiler) define(name string) {
+	symbol := c.fn.symbols.Define(name)
+	if symbol == nil {
+		c.emit(OpDefineGlobal, c.stringConstant(name))
+		return
+	}
+	c.setLocal(symbol)
+}
+
+func (c *Compiler) setLocal(symbol *Symbol) {
+	c.useSymbol(symbol, c.emit(OpSetLocal, symbol.Index))
+}
+
+// useSymbol records that the instruction at pos addresses symbol's slot, so it can
+// be switched to the cell version if a closure turns out to capture symbol
+func (c *Compiler) useSymbol(symbol *Symbol, pos int) {
+	symbol.uses = append(symbol.uses, pos)
+}
+
+func (c *Compiler) compileWhile(ws *ast.WhileStatement) {
+	start := len(c.fn.compiled.Instructions)
+	c.emit(OpCheckContext)
+	c.compileExpression(ws.Condition)
+	exit := c.emit(OpJumpIfFalse, 0)
+
+	c.compileLoopBody(ws.Body, start)
+	c.emit(OpJump, start)
+
+	c.patchJump(exit)
+	c.endLoop()
+}
+
+// compileFor compiles a for loop. Its variable and the variables declared in its body
+// belong to a scope entered afresh for every iteration, so closures created in the body
+// capture that iteration's values
+func (c *Compiler) compileFor(fs *ast.ForStatement) {
+	symbols := c.fn.symbols
+
+	c.compileExpression(fs.Iterable)
+	iterator := symbols.Temporary()
+	c.emit(OpIterInit, iterator)
+
+	scope := symbols.EnterScope()
+	variable := symbols.Define(fs.Variable.Value)
+	c.hoist(fs.Body)
+
+	start := len(c.fn.compiled.Instructions)
+	exit := c.emit(OpIterNext, iterator, 0)
+	c.emit(OpEnterScope, scope.Index)
+	c.setLocal(variable)
+
+	c.compileLoopBody(fs.Body, start)
+	c.emit(OpJump, start)
+	symbols.LeaveScope()
+
+	c.patchJump(exit)
+	c.endLoop()
+}
+
+// compileLoopBody compiles the body of a loop whose continue statements jump to start.
+// endLoop must be called once the loop's end has been reached
+func (c *Compiler) compileLoopBody(body *ast.BlockStatement, start int) {
+	c.fn.loops = append(c.fn.loops, &loop{start: start, tries: len(c.fn.tries)})
+	c.compileBlock(body, false)
+}
+
+// endLoop points the break statements of the innermost loop here
+func (c *Compiler) endLoop() {
+	l := c.fn.loops[len(c.fn.loops)-1]
+	c.fn.loops = c.fn.loops[:len(c.fn.loops)-1]
+	for _, pos := range l.breaks {
+		c.patchJump(pos)
+	}
+}
+
+// compileTry compiles a try statement as the evaluator runs it: the catch block handles
+// an error from the try block, and the finally block runs afterwards whichever of them
+// completed. Errors in the catch block are handled too, so finally can run before they
+// carry on. The finally block is compiled once for each way out: after finishing normally,
+// before an error carries on, and before each break, continue or return that leaves early
+func (c *Compiler) compileTry(ts *ast.TryStatement, keep bool) {
+	fn := c.fn
+	var ends []int
+
+	handler := c.emit(OpSetupTry, 0)
+	fn.tries = append(fn.tries, tryBlock{handler: true, finally: ts.Finally})
+	c.compileBlock(ts.Block, keep)
+	fn.tries = fn.tries[:len(fn.tries)-1]
+	c.emit(OpPopTry)
+	if ts.Finally != nil {
+		c.compileBlock(ts.Finally, false)
+	}
+	ends = append(ends, c.emit(OpJump, 0))
+
+	// the handler jumps here with the error on the stack
+	c.patchJump(handler)
+	if ts.Catch != nil {
+		if ts.Finally != nil {
+			handler = c.emit(OpSetupTry, 0)
+			fn.tries = append(fn.tries, tryBlock{handler: true, finally: ts.Finally})
+		}
+
+		scope := fn.symbols.EnterScope()
+		var param *Symbol
+		if ts.Param != nil {
+			param = fn.symbols.Define(ts.Param.Value)
+		}
+		c.hoist(ts.Catch)
+		c.emit(OpEnterScope, scope.Index)
+		if param != nil {
+			c.emit(OpCatch)
+			c.setLocal(param)
+		} else {
+			c.emit(OpPop)
+		}
+		c.compileBlock(ts.Catch, keep)
+		fn.symbols.LeaveScope()
+
+		if ts.Finally != nil {
+			fn.tries = fn.tries[:len(fn.tries)-1]
+			c.emit(OpPopTry)
+			c.compileBlock(ts.Finally, false)
+			ends = append(ends, c.emit(OpJump, 0))
+			c.patchJump(handler)
+		} else {
+			ends = append(ends, c.emit(OpJump, 0))
+		}
+	}
+	if ts.Finally != nil {
+		c.compileBlock(ts.Finally, false)
+		c.emit(OpRethrow)
+	}
+
+	for _, pos := range ends {
+		c.patchJump(pos)
+	}
+}
+
+// leaveTries cleans up after the tries a break, continue or return leaves early, from the
+// innermost out to the one at depth. Each finally block is compiled as if the tries and
+// loops inside it had already been left, as they will have been when it runs
+func (c *Compiler) leaveTries(depth int) {
+	fn := c.fn
+	tries, loops := fn.tries, fn.loops
+
+	for i := len(tries) - 1; i >= depth; i-- {
+		if tries[i].handler {
+			c.emit(OpPopTry)
+		}
+		if tries[i].finally == nil {
+			continue
+		}
+
+		fn.tries = tries[:i]
+		fn.loops = loops
+		for len(fn.loops) > 0 && fn.loops[len(fn.loops)-1].tries > i {
+			fn.loops = fn.loops[:len(fn.loops)-1]
+		}
+		c.compileBlock(tries[i].finally, false)
+	}
+
+	fn.tries, fn.loops = tries, loops
+}
+
+// compileFunction compiles a function literal to a constant, and code to make a closure
+// of it that captures the variables it uses from the functions around it
+func (c *Compiler) compileFunction(lit *ast.FunctionLiteral) {
+	c.fn = c.newFunction(NewEnclosedSymbolTable(c.fn.symbols), lit)
+	symbols := c.fn.symbols
+	compiled := c.fn.compiled
+
+	params := make([]*Symbol, len(lit.Parameters))
+	for i, param := range lit.Parameters {
+		params[i] = symbols.DefineParameter(param.Value)
+	}
+	if lit.Rest != nil {
+		symbols.DefineParameter(lit.Rest.Value)
+	}
+	c.hoist(lit.Body)
+
+	compiled.NumParams = len(lit.Parameters)
+	compiled.Required = len(lit.Parameters)
+	compiled.Rest = lit.Rest != nil
+
+	c.emit(OpEnterScope, 0)
+	for i, def := range lit.Defaults {
+		if def == nil {
+			continue
+		}
+		compiled.Required--
+		skip := c.emit(OpArgGiven, i, 0)
+		c.compileExpression(def)
+		c.setLocal(params[i])
+		c.patchJump(skip)
+	}
+
+	c.compileBlock(lit.Body, true)
+	c.emit(OpReturnValue)
+
+	free := symbols.Free
+	fn := c.finishFunction()
+	c.fn = c.fn.outer
+
+	for _, loc := range free {
+		if loc.Kind == Free {
+			c.emit(OpLoadFree, loc.Index)
+		} else {
+			c.emit(OpLoadCell, loc.Index)
+		}
+	}
+	c.emit(OpClosure, c.addConstant(fn), len(free))
+}
+
+// finishFunction completes the function being compiled, now that it is known which
+// of its variables closures capture: instructions addressing them switch to their
+// cell versions, and they are put in cells as their scopes are entered
+func (c *Compiler) finishFunction() *CompiledFunction {
+	fn := c.fn
+	compiled := fn.compiled
+	compiled.NumLocals = fn.symbols.NumLocals
+
+	for _, scope := range fn.symbols.Scopes() {
+		var layout ScopeLayout
+		for _, symbol := range scope.Symbols() {
+			// a function's own scope is entered once, with its arguments already in place
+			if fn.symbols.Outer == nil || scope.Index != 0 {
+				layout.Clear = append(layout.Clear, symbol.Index)
+			}
+			if !symbol.Captured {
+				continue
+			}
+			layout.Cells = append(layout.Cells, symbol.Index)
+			for _, pos := range symbol.uses {
+				compiled.Instructions[pos] = byte(cellOpcodes[Opcode(compiled.Instructions[pos])])
+			}
+		}
+		compiled.Scopes = append(compiled.Scopes, layout)
+	}
+
+	compiled.Chains = make([][]Location, len(fn.chains))
+	for i, chain := range fn.chains {
+		compiled.Chains[i] = make([]Location, len(chain))
+		for j, loc := range chain {
+			if loc.Kind == Local && loc.Symbol.Captured {
+				loc.Kind = Cell
+			}
+			loc.Symbol = nil
+			compiled.Chains[i][j] = loc
+		}
+	}
+
+	return compiled
+}
+
+// cellOpcodes gives the version of each instruction addressing a local for a captured one
+var cellOpcodes = map[Opcode]Opcode{
+	OpGetLocal:    OpGetCell,
+	OpSetLocal:    OpSetCell,
+	OpAssignLocal: OpAssignCell,
+}
+
+// hoist declares the variables the let statements in node declare in the current
+// scope, before any of its code is compiled, so a function can refer to a variable
+// declared after it. It doesn't look inside code that has a scope of its own
+func (c *Compiler) hoist(node ast.Node) {
+	if c.fn.symbols.current.global {
+		return
+	}
+
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		for _, stmt := range node.Statements {
+			c.hoist(stmt)
+		}
+	case *ast.LetStatement:
+		c.fn.symbols.Define(node.Name.Value)
+		c.hoist(node.Value)
+	case *ast.ExpressionStatement:
+		c.hoist(node.Expression)
+	case *ast.ReturnStatement:
+		c.hoist(node.ReturnValue)
+	case *ast.ThrowStatement:
+		c.hoist(node.Value)
+	case *ast.WhileStatement:
+		c.hoist(node.Condition)
+		c.hoist(node.Body)
+	case *ast.ForStatement:
+		c.hoist(node.Iterable)
+	case *ast.TryStatement:
+		c.hoist(node.Block)
+		if node.Finally != nil {
+			c.hoist(node.Finally)
+		}
+	case *ast.IfExpression:
+		c.hoist(node.Condition)
+		c.hoist(node.Consequence)
+		if node.Alternative != nil {
+			c.hoist(node.Alternative)
+		}
+	case *ast.PrefixExpression:
+		c.hoist(node.Right)
+	case *ast.InfixExpression:
+		c.hoist(node.Left)
+		c.hoist(node.Right)
+	case *ast.CallExpression:
+		c.hoist(node.Function)
+		for _, arg := range node.Arguments {
+			c.hoist(arg)
+		}
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			c.hoist(el)
+		}
+	case *ast.HashLiteral:
+		for _, key := range node.Keys {
+			c.hoist(key)
+			c.hoist(node.Pairs[key])
+		}
+	case *ast.IndexExpression:
+		c.hoist(node.Left)
+		c.hoist(node.Index)
+	case *ast.MemberExpression:
+		c.hoist(node.Object)
+	case *ast.AssignExpression:
+		c.hoist(node.Target)
+		c.hoist(node.Value)
+	}
+}
+
+// emit appends an instruction, returning its offset
+func (c *Compiler) emit(op Opcode, operands ...int) int {
+	def := definitions[op]
+	for i, operand := range operands {
+		if max := 1<<(8*def.OperandWidths[i]) - 1; operand > max {
+			c.fail("%s operand %d exceeds %d", def.Name, operand, max)
+		}
+	}
+
+	compiled := c.fn.compiled
+	pos := len(compiled.Instructions)
+	compiled.Instructions = append(compiled.Instructions, Make(op, operands...)...)
+
+	var span diag.Span
+	if len(c.nodes) > 0 {
+		node := c.nodes[len(c.nodes)-1]
+		span = diag.Span{Pos: node.Pos(), End: node.End()}
+	}
+	if n := len(compiled.Positions); n == 0 || compiled.Positions[n-1].Span != span {
+		compiled.Positions = append(compiled.Positions, Position{Offset: pos, Span: span})
+	}
+
+	return pos
+}
+
+// patchJump points the jump instruction at pos, whose target is its last operand, here
+func (c *Compiler) patchJump(pos int) {
+	ins := c.fn.compiled.Instructions
+	def := definitions[Opcode(ins[pos])]
+
+	offset := pos + 1
+	for _, w := range def.OperandWidths[:len(def.OperandWidths)-1] {
+		offset += w
+	}
+	binary.BigEndian.PutUint32(ins[offset:], uint32(len(ins)))
+}
+
+func (c *Compiler) addConstant(obj object.Object) int {
+	compiled := c.fn.compiled
+	compiled.Constants = append(compiled.Constants, obj)
+	return len(compiled.Constants) - 1
+}
+
+func (c *Compiler) stringConstant(s string) int {
+	if i, ok := c.fn.strings[s]; ok {
+		return i
+	}
+	i := c.addConstant(&object.String{Value: s})
+	c.fn.strings[s] = i
+	return i
+}
+
+func (c *Compiler) integerConstant(n int64) int {
+	if i, ok := c.fn.integers[n]; ok {
+		return i
+	}
+	i := c.addConstant(&object.Integer{Value: n})
+	c.fn.integers[n] = i
+	return i
+}
+
+// addChain records the fallback chain of a variable reference, returning its index
+func (c *Compiler) addChain(chain []Location) int {
+	for i := range chain {
+		if chain[i].Kind == Global {
+			chain[i].Index = c.stringConstant(chain[i].Name)
+		}
+	}
+	c.fn.chains = append(c.fn.chains, chain)
+	return len(c.fn.chains) - 1
+}
@@ -0,0 +1,236 @@
+package compiler
+
+import (
+	"farcical/lexer"
+	"farcical/parser"
+	"strings"
+	"testing"
+)
+
+func TestMake(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+	}{
+		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
+		{OpAdd, []int{}, []byte{byte(OpAdd)}},
+		{OpGetLocal, []int{1, 258}, []byte{byte(OpGetLocal), 0, 1, 1, 2}},
+		{OpJump, []int{65536}, []byte{byte(OpJump), 0, 1, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		instruction := Make(tt.op, tt.operands...)
+		if string(instruction) != string(tt.expected) {
+			t.Errorf("Make(%d, %v) = %v, want %v", tt.op, tt.operands, instruction, tt.expected)
+		}
+
+		def, err := Lookup(byte(tt.op))
+		if err != nil {
+			t.Fatalf("definition not found: %s", err)
+		}
+		operands, read := ReadOperands(def, instruction[1:])
+		if read != len(instruction)-1 {
+			t.Errorf("%s: read %d bytes, want %d", def.Name, read, len(instruction)-1)
+		}
+		for i, want := range tt.operands {
+			if operands[i] != want {
+				t.Errorf("%s: operand %d = %d, want %d", def.Name, i, operands[i], want)
+			}
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			"let x = 1 + 2; x",
+			`0000 OpConstant 0
+0003 OpConstant 1
+0006 OpAdd
+0007 OpNameFunction 2
+0010 OpDefineGlobal 2
+0013 OpGetGlobal 2
+0016 OpReturnValue
+`,
+		},
+		{
+			"true && !false",
+			`0000 OpTrue
+0001 OpAnd 8
+0006 OpFalse
+0007 OpBang
+0008 OpReturnValue
+`,
+		},
+		{
+			"if (1 < 2) { 3 }",
+			`0000 OpConstant 0
+0003 OpConstant 1
+0006 OpLess
+0007 OpJumpIfFalse 20
+0012 OpConstant 2
+0015 OpJump 21
+0020 OpNull
+0021 OpReturnValue
+`,
+		},
+		{
+			"let a = 0; while (a < 3) { a += 1 }",
+			`0000 OpConstant 0
+0003 OpNameFunction 1
+0006 OpDefineGlobal 1
+0009 OpCheckContext
+0010 OpGetGlobal 1
+0013 OpConstant 2
+0016 OpLess
+0017 OpJumpIfFalse 41
+0022 OpGetGlobal 1
+0025 OpConstant 3
+0028 OpAdd
+0029 OpNameFunction 1
+0032 OpAssign 0
+0035 OpPop
+0036 OpJump 9
+0041 OpNil
+0042 OpReturnValue
+`,
+		},
+		{
+			"try { throw 1 } catch (e) { e }",
+			`0000 OpSetupTry 15
+0005 OpConstant 0
+0008 OpThrow
+0009 OpPopTry
+0010 OpJump 32
+0015 OpEnterScope 0
+0018 OpCatch
+0019 OpSetLocal 0
+0022 OpGetLocal 0 0
+0027 OpJump 32
+0032 OpReturnValue
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		main := compile(t, tt.input)
+		if got := main.Instructions.String(); got != tt.expected {
+			t.Errorf("%q: wrong instructions\nwant:\n%sgot:\n%s", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestCompileClosures(t *testing.T) {
+	main := compile(t, "let adder = function(a) { function(b) { a + b } }")
+
+	adder, ok := main.Constants[0].(*CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 0 is %T, want a function", main.Constants[0])
+	}
+	if adder.NumParams != 1 || adder.NumLocals != 1 {
+		t.Errorf("adder has %d params and %d locals, want 1 and 1", adder.NumParams, adder.NumLocals)
+	}
+	// a is captured, so it's kept in a cell the inner function shares
+	expected := `0000 OpEnterScope 0
+0003 OpLoadCell 0
+0006 OpClosure 0 1
+0011 OpReturnValue
+`
+	if got := adder.Instructions.String(); got != expected {
+		t.Errorf("wrong instructions for adder\nwant:\n%sgot:\n%s", expected, got)
+	}
+	if len(adder.Scopes) != 1 || len(adder.Scopes[0].Cells) != 1 || adder.Scopes[0].Cells[0] != 0 {
+		t.Errorf("wrong scopes for adder, got %+v", adder.Scopes)
+	}
+
+	inner := adder.Constants[0].(*CompiledFunction)
+	if !strings.Contains(inner.Instructions.String(), "OpGetFree 0") {
+		t.Errorf("inner function doesn't read a from its free variables:\n%s", inner.Instructions)
+	}
+}
+
+func TestCompilePositions(t *testing.T) {
+	main := compile(t, "let x = 1;\nx + true")
+
+	// the OpAdd is the instruction that raises the type mismatch
+	pc := 0
+	for Opcode(main.Instructions[pc]) != OpAdd {
+		def, _ := Lookup(main.Instructions[pc])
+		_, read := ReadOperands(def, main.Instructions[pc+1:])
+		pc += 1 + read
+	}
+	if span := main.Span(pc); span.Pos.String() != "2:1" || span.End.String() != "2:9" {
+		t.Errorf("OpAdd at %d has span %s-%s, want 2:1-2:9", pc, span.Pos, span.End)
+	}
+}
+
+func TestSymbolTable(t *testing.T) {
+	global := NewSymbolTable()
+	if global.Define("g") != nil {
+		t.Errorf("a global got a slot")
+	}
+
+	outer := NewEnclosedSymbolTable(global)
+	a := outer.DefineParameter("a")
+	outer.EnterScope()
+	b := outer.Define("b")
+	if again := outer.Define("b"); again != b {
+		t.Errorf("defining b twice in one scope gave two symbols")
+	}
+	if a.Index != 0 || b.Index != 1 || outer.NumLocals != 2 {
+		t.Errorf("wrong slots: a=%d b=%d locals=%d", a.Index, b.Index, outer.NumLocals)
+	}
+
+	inner := NewEnclosedSymbolTable(outer)
+	inner.Define("a")
+
+	tests := []struct {
+		table    *SymbolTable
+		name     string
+		expected []Location
+	}{
+		{outer, "b", []Location{{Kind: Local, Index: 1}, {Kind: Global, Name: "b"}}},
+		{outer, "g", []Location{{Kind: Global, Name: "g"}}},
+		{inner, "a", []Location{{Kind: Local, Index: 0}, {Kind: Free, Index: 0}, {Kind: Global, Name: "a"}}},
+		{inner, "b", []Location{{Kind: Free, Index: 1}, {Kind: Global, Name: "b"}}},
+	}
+
+	for _, tt := range tests {
+		chain := tt.table.Resolve(tt.name)
+		if len(chain) != len(tt.expected) {
+			t.Errorf("%s resolved to %+v, want %+v", tt.name, chain, tt.expected)
+			continue
+		}
+		for i, loc := range chain {
+			want := tt.expected[i]
+			if loc.Kind != want.Kind || loc.Index != want.Index || loc.Name != want.Name {
+				t.Errorf("%s: location %d is %+v, want %+v", tt.name, i, loc, want)
+			}
+		}
+	}
+
+	if !a.Captured || !b.Captured {
+		t.Errorf("variables referred to by the inner function aren't captured")
+	}
+	if len(inner.Free) != 2 || inner.Free[0].Symbol != a || inner.Free[1].Symbol != b {
+		t.Errorf("wrong free variables, got %+v", inner.Free)
+	}
+}
+
+func compile(t *testing.T, input string) *CompiledFunction {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("%q: parse errors: %v", input, p.Errors())
+	}
+	main, err := Compile(program)
+	if err != nil {
+		t.Fatalf("%q: compile error: %s", input, err)
+	}
+	return main
+}
@@ -0,0 +1,165 @@
+package compiler
+
+// Farcical resolves variables at run time, walking out through nested environments
+// until it finds one that holds the name. The compiler keeps those semantics without
+// the environments: every variable a scope declares gets a slot in its function's
+// frame, and a variable reference is compiled to the chain of places it could refer
+// to, innermost first, ending with the global environment. A read takes the first
+// of them that has been set, so a variable can be used before the let that declares
+// it in the same scope runs, and then refers to whatever is further out
+
+// LocationKind is where a variable lives while the program runs
+type LocationKind byte
+
+const (
+	Local  LocationKind = iota // a slot in the frame of the running function
+	Cell                       // a slot holding a cell, for a local that closures capture
+	Free                       // one of the running closure's free variables, a cell it captured
+	Global                     // a global variable, or failing that a builtin, looked up by name
+)
+
+// Location is one place a variable reference can resolve to
+type Location struct {
+	Kind   LocationKind
+	Index  int     // the slot, the free variable, or for Global the constant holding the name
+	Symbol *Symbol // the local's declaration while compiling, which decides between Local and Cell
+	Name   string  // the name of a Global
+}
+
+// Symbol is a variable declared in a scope: a parameter, a let, a for loop's
+// variable or the error bound by a catch
+type Symbol struct {
+	Name     string
+	Index    int  // its slot in the frame
+	Captured bool // referred to by a nested function, so kept in a cell it can share
+	uses     []int
+}
+
+// Scope is a stretch of code whose variables go away when it ends: a function
+// body, one iteration of a for loop or a catch block. Other blocks declare their
+// variables in the scope around them, as they do in the evaluator
+type Scope struct {
+	Index   int // in CompiledFunction.Scopes
+	outer   *Scope
+	global  bool // the top level, whose variables live in the global environment
+	symbols map[string]*Symbol
+	order   []*Symbol
+}
+
+// SymbolTable holds the scopes and variables of one function being compiled, or of the top level
+type SymbolTable struct {
+	Outer     *SymbolTable
+	Free      []Location // where each free variable lives in Outer, in the order a closure captures them
+	NumLocals int
+
+	definedIn *Scope // the scope of Outer the function appears in
+	current   *Scope
+	scopes    []*Scope
+	freeIndex map[Location]int
+}
+
+// NewSymbolTable returns the table for the top level of a program, whose variables are globals
+func NewSymbolTable() *SymbolTable {
+	s := &SymbolTable{freeIndex: make(map[Location]int)}
+	s.current = &Scope{Index: -1, global: true}
+	return s
+}
+
+// NewEnclosedSymbolTable returns the table for a function appearing in the current scope of outer
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := &SymbolTable{Outer: outer, definedIn: outer.current, freeIndex: make(map[Location]int)}
+	s.EnterScope()
+	return s
+}
+
+// EnterScope starts a new scope inside the current one and returns it
+func (s *SymbolTable) EnterScope() *Scope {
+	scope := &Scope{Index: len(s.scopes), outer: s.current, symbols: make(map[string]*Symbol)}
+	s.scopes = append(s.scopes, scope)
+	s.current = scope
+	return scope
+}
+
+// LeaveScope returns to the scope the current one is inside
+func (s *SymbolTable) LeaveScope() {
+	s.current = s.current.outer
+}
+
+// Define declares name in the current scope, returning its symbol, or nil at
+// the top level, where it is a global. Defining a name twice gives the same symbol
+func (s *SymbolTable) Define(name string) *Symbol {
+	if s.current.global {
+		return nil
+	}
+	if symbol, ok := s.current.symbols[name]; ok {
+		return symbol
+	}
+
+	symbol := &Symbol{Name: name, Index: s.NumLocals}
+	s.NumLocals++
+	s.current.symbols[name] = symbol
+	s.current.order = append(s.current.order, symbol)
+	return symbol
+}
+
+// DefineParameter declares a parameter in the next slot, even if an earlier
+// parameter has the same name, so arguments can be copied straight into the
+// first slots of the frame. The last parameter with a name is the one it refers to
+func (s *SymbolTable) DefineParameter(name string) *Symbol {
+	symbol := &Symbol{Name: name, Index: s.NumLocals}
+	s.NumLocals++
+	s.current.symbols[name] = symbol
+	s.current.order = append(s.current.order, symbol)
+	return symbol
+}
+
+// Temporary reserves a slot that belongs to no variable, such as a loop's iterator
+func (s *SymbolTable) Temporary() int {
+	s.NumLocals++
+	return s.NumLocals - 1
+}
+
+// Resolve returns the places a reference to name in the current scope could refer
+// to, innermost first. The last is always the global of that name
+func (s *SymbolTable) Resolve(name string) []Location {
+	return append(s.resolveFrom(s.current, name), Location{Kind: Global, Name: name})
+}
+
+// resolveFrom returns the locals and free variables called name visible from scope.
+// Locals of enclosing functions become free variables of this one, and are marked
+// as captured so they are kept in cells
+func (s *SymbolTable) resolveFrom(scope *Scope, name string) []Location {
+	var chain []Location
+	for ; scope != nil && !scope.global; scope = scope.outer {
+		if symbol, ok := scope.symbols[name]; ok {
+			chain = append(chain, Location{Kind: Local, Index: symbol.Index, Symbol: symbol})
+		}
+	}
+
+	if s.Outer == nil {
+		return chain
+	}
+	for _, outer := range s.Outer.resolveFrom(s.definedIn, name) {
+		if outer.Symbol != nil {
+			outer.Symbol.Captured = true
+		}
+		index, ok := s.freeIndex[outer]
+		if !ok {
+			index = len(s.Free)
+			s.freeIndex[outer] = index
+			s.Free = append(s.Free, outer)
+		}
+		chain = append(chain, Location{Kind: Free, Index: index})
+	}
+	return chain
+}
+
+// Scopes returns every scope of the function, by index
+func (s *SymbolTable) Scopes() []*Scope {
+	return s.scopes
+}
+
+// Symbols returns the variables a scope declares, in the order they were defined
+func (sc *Scope) Symbols() []*Symbol {
+	return sc.order
+}
@@ -0,0 +1,198 @@
+package diag
+
+import (
+	"farcical/token"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+	Info
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Error:
+		return "error"
+	case Warning:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// codes identify each kind of diagnostic, grouped by the phase that reports it
+const (
+	CodeIllegalCharacter    = "E0001" // lexer
+	CodeUnterminatedComment = "E0002"
+	CodeUnterminatedString  = "E0003"
+	CodeInvalidEscape       = "E0004"
+
+	CodeUnexpectedToken    = "E0100" // parser
+	CodeExpectedExpr       = "E0101"
+	CodeInvalidLiteral     = "E0102"
+	CodeMisplacedStatement = "E0103"
+	CodeInvalidAssignment  = "E0104"
+	CodeInvalidParameter   = "E0105"
+
+	CodeRuntime = "E0200" // evaluator
+)
+
+// Span is the region of source a diagnostic points at. End is the position
+// immediately after the last character, just like token.Token.End
+type Span struct {
+	Pos token.Position
+	End token.Position
+}
+
+// TokenSpan returns the span covering a single token
+func TokenSpan(tok token.Token) Span {
+	return Span{Pos: tok.Pos, End: tok.End}
+}
+
+// Note is a secondary message attached to a diagnostic, optionally pointing at its own span
+type Note struct {
+	Span    Span
+	Message string
+}
+
+type Diagnostic struct {
+	Severity Severity
+	Code     string
+	Message  string
+	Span     Span   // the primary location of the problem
+	Notes    []Note // secondary locations and explanations
+	Fix      string // suggested fix, empty if there isn't one
+}
+
+// Error renders the diagnostic on a single line, e.g. "3:14: expected ")", found end of file"
+func (d Diagnostic) Error() string {
+	if !d.Span.Pos.IsValid() {
+		return d.Message
+	}
+	return fmt.Sprintf("%s: %s", d.Span.Pos, d.Message)
+}
+
+// Render writes d in the style of a modern compiler: a header, the offending
+// source line with the span underlined, then any notes and the suggested fix.
+// src is the text the positions in d refer to.
+func Render(w io.Writer, src string, d Diagnostic) {
+	lines := strings.Split(src, "\n")
+
+	header := d.Severity.String()
+	if d.Code != "" {
+		header += "[" + d.Code + "]"
+	}
+	fmt.Fprintf(w, "%s: %s\n", header, d.Message)
+
+	if !d.Span.Pos.IsValid() {
+		renderNotes(w, d)
+		return
+	}
+
+	gutter := strings.Repeat(" ", len(strconv.Itoa(maxLine(d))))
+
+	fmt.Fprintf(w, "%s--> %s\n", gutter, d.Span.Pos)
+	fmt.Fprintf(w, "%s |\n", gutter)
+	renderSnippet(w, lines, gutter, d.Span, "^", "", true)
+
+	for _, note := range d.Notes {
+		if inSnippet(d, note) {
+			// a note on the primary line just gets a second underline
+			showSource := note.Span.Pos.Line != d.Span.Pos.Line
+			renderSnippet(w, lines, gutter, note.Span, "-", note.Message, showSource)
+		}
+	}
+
+	renderNotes(w, d)
+}
+
+// RenderAll renders each diagnostic in turn, separated by blank lines
+func RenderAll(w io.Writer, src string, diagnostics []Diagnostic) {
+	for i, d := range diagnostics {
+		if i > 0 {
+			io.WriteString(w, "\n")
+		}
+		Render(w, src, d)
+	}
+}
+
+func renderSnippet(w io.Writer, lines []string, gutter string, span Span, marker string, label string, showSource bool) {
+	lineIdx := span.Pos.Line - 1
+	if lineIdx < 0 || lineIdx >= len(lines) {
+		return
+	}
+	line := strings.TrimRight(lines[lineIdx], "\r")
+
+	start := span.Pos.Column - 1
+	if start > len(line) {
+		start = len(line)
+	}
+
+	// spans that run over several lines are underlined to the end of the first one
+	width := len(line) - start
+	if span.End.Line == span.Pos.Line {
+		width = span.End.Column - span.Pos.Column
+	}
+	if width < 1 {
+		width = 1
+	}
+
+	// keep tabs in the padding so the underline lines up with the source
+	padding := strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return '\t'
+		}
+		return ' '
+	}, line[:start])
+
+	underline := padding + strings.Repeat(marker, width)
+	if label != "" {
+		underline += " " + label
+	}
+
+	if showSource {
+		fmt.Fprintf(w, "%*d | %s\n", len(gutter), span.Pos.Line, line)
+	}
+	fmt.Fprintf(w, "%s | %s\n", gutter, underline)
+}
+
+func renderNotes(w io.Writer, d Diagnostic) {
+	gutter := strings.Repeat(" ", len(strconv.Itoa(maxLine(d))))
+
+	for _, note := range d.Notes {
+		switch {
+		case !note.Span.Pos.IsValid():
+			fmt.Fprintf(w, "%s = note: %s\n", gutter, note.Message)
+		case !inSnippet(d, note):
+			fmt.Fprintf(w, "%s = note: %s at %s\n", gutter, note.Message, note.Span.Pos)
+		}
+	}
+	if d.Fix != "" {
+		fmt.Fprintf(w, "%s = help: %s\n", gutter, d.Fix)
+	}
+}
+
+// maxLine is the largest line number rendered for d, used to size the gutter
+func maxLine(d Diagnostic) int {
+	max := d.Span.Pos.Line
+	for _, note := range d.Notes {
+		if inSnippet(d, note) && note.Span.Pos.Line > max {
+			max = note.Span.Pos.Line
+		}
+	}
+	return max
+}
+
+// inSnippet reports whether note is drawn under the source alongside d's own span.
+// Notes in other files, such as the call into a module a runtime error came from,
+// can't be, as the source given to Render is only that of d's file
+func inSnippet(d Diagnostic, note Note) bool {
+	return note.Span.Pos.IsValid() && d.Span.Pos.IsValid() && note.Span.Pos.Filename == d.Span.Pos.Filename
+}
@@ -0,0 +1,98 @@
+package diag
+
+import (
+	"bytes"
+	"farcical/token"
+	"testing"
+)
+
+func span(line, col, endCol int) Span {
+	return Span{
+		Pos: token.Position{Filename: "test.fa", Line: line, Column: col},
+		End: token.Position{Filename: "test.fa", Line: line, Column: endCol},
+	}
+}
+
+func TestRender(t *testing.T) {
+	src := "let x = 1;\nlet y = add(x, 2;\n"
+
+	tests := []struct {
+		diagnostic Diagnostic
+		expected   string
+	}{
+		{
+			Diagnostic{Severity: Error, Code: CodeUnexpectedToken, Message: `expected ")", found ";"`, Span: span(2, 17, 18)},
+			"error[E0100]: expected \")\", found \";\"\n" +
+				" --> test.fa:2:17\n" +
+				"  |\n" +
+				"2 | let y = add(x, 2;\n" +
+				"  |                 ^\n",
+		},
+		{
+			Diagnostic{
+				Severity: Error,
+				Code:     CodeUnexpectedToken,
+				Message:  `expected ")", found ";"`,
+				Span:     span(2, 17, 18),
+				Notes:    []Note{{Span: span(2, 12, 13), Message: "unclosed delimiter"}, {Message: "calls need parentheses"}},
+				Fix:      `insert ")"`,
+			},
+			"error[E0100]: expected \")\", found \";\"\n" +
+				" --> test.fa:2:17\n" +
+				"  |\n" +
+				"2 | let y = add(x, 2;\n" +
+				"  |                 ^\n" +
+				"  |            - unclosed delimiter\n" +
+				"  = note: calls need parentheses\n" +
+				"  = help: insert \")\"\n",
+		},
+		{
+			Diagnostic{Severity: Warning, Message: "unused variable", Span: span(1, 5, 6), Notes: []Note{{Span: span(2, 1, 4), Message: "declared again here"}}},
+			"warning: unused variable\n" +
+				" --> test.fa:1:5\n" +
+				"  |\n" +
+				"1 | let x = 1;\n" +
+				"  |     ^\n" +
+				"2 | let y = add(x, 2;\n" +
+				"  | --- declared again here\n",
+		},
+		{
+			Diagnostic{
+				Severity: Error,
+				Code:     CodeRuntime,
+				Message:  "boom",
+				Span:     span(1, 9, 10),
+				Notes: []Note{{
+					Span:    Span{Pos: token.Position{Filename: "main.fa", Line: 4, Column: 1}, End: token.Position{Filename: "main.fa", Line: 4, Column: 7}},
+					Message: "in call to boom",
+				}},
+			},
+			"error[E0200]: boom\n" +
+				" --> test.fa:1:9\n" +
+				"  |\n" +
+				"1 | let x = 1;\n" +
+				"  |         ^\n" +
+				"  = note: in call to boom at main.fa:4:1\n",
+		},
+		{
+			Diagnostic{Severity: Error, Code: CodeRuntime, Message: "no position"},
+			"error[E0200]: no position\n",
+		},
+	}
+
+	for i, tt := range tests {
+		var out bytes.Buffer
+		Render(&out, src, tt.diagnostic)
+
+		if out.String() != tt.expected {
+			t.Errorf("tests[%d] - wrong rendering, expected=\n%s\ngot=\n%s", i, tt.expected, out.String())
+		}
+	}
+}
+
+func TestDiagnosticError(t *testing.T) {
+	d := Diagnostic{Message: "illegal character \"#\"", Span: span(3, 4, 5)}
+	if d.Error() != `test.fa:3:4: illegal character "#"` {
+		t.Errorf("d.Error() wrong, got=%q", d.Error())
+	}
+}
@@ -1,105 +1,1151 @@
 package evaluator
 
 import (
+	"bufio"
 	"farcical/object"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
-var builtins = map[string]*object.Builtin{
-	"len": &object.Builtin{
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments, got=%d want=1", len(args))
-			}
+// ioBuiltinNames are the builtins that reach outside the interpreter, removed by DisableIO
+var ioBuiltinNames = []string{"print", "eprint", "input"}
 
-			switch arg := args[0].(type) {
-			case *object.Array:
-				return &object.Integer{Value: int64(len(arg.Elements))}
-			case *object.String:
-				return &object.Integer{Value: int64(len(arg.Value))}
-			default:
-				return newError("argument to `len` not supported, got %s", args[0].Type())
-			}
+// defaultBuiltins returns a fresh set of the standard builtins, so each Evaluator can change its own
+func defaultBuiltins() map[string]object.Object {
+	return map[string]object.Object{
+		"len": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments, got=%d want=1", len(args))
+				}
+
+				switch arg := args[0].(type) {
+				case *object.Array:
+					return &object.Integer{Value: int64(len(arg.Elements))}
+				case *object.String:
+					return &object.Integer{Value: int64(utf8.RuneCountInString(arg.Value))}
+				case *object.Hash:
+					return &object.Integer{Value: int64(arg.Len())}
+				default:
+					return newError("argument to `len` not supported, got %s", args[0].Type())
+				}
+			},
 		},
-	},
-	"first": &object.Builtin{
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments, got=%d, want=1", len(args))
-			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `first` must be ARRAY, got %s", args[0].Type())
-			}
+		"first": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments, got=%d, want=1", len(args))
+				}
+				if args[0].Type() != object.ARRAY_OBJ {
+					return newError("argument to `first` must be ARRAY, got %s", args[0].Type())
+				}
 
-			arr := args[0].(*object.Array)
-			if len(arr.Elements) > 0 {
-				return arr.Elements[0]
-			}
-			return NULL
+				arr := args[0].(*object.Array)
+				if len(arr.Elements) > 0 {
+					return arr.Elements[0]
+				}
+				return NULL
+			},
+		},
+		"last": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments, got=%d, want=1", len(args))
+				}
+				if args[0].Type() != object.ARRAY_OBJ {
+					return newError("argument to `last` must be ARRAY, got %s", args[0].Type())
+				}
+
+				arr := args[0].(*object.Array)
+				length := len(arr.Elements)
+				if len(arr.Elements) > 0 {
+					return arr.Elements[length-1]
+				}
+				return NULL
+			},
+		},
+		"rest": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments, got=%d, want=1", len(args))
+				}
+				if args[0].Type() != object.ARRAY_OBJ {
+					return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
+				}
+
+				arr := args[0].(*object.Array)
+				length := len(arr.Elements)
+				if length > 0 {
+					newElements := make([]object.Object, length-1, length-1)
+					copy(newElements, arr.Elements[1:length])
+					return &object.Array{Elements: newElements}
+				}
+				return NULL
+			},
+		},
+		"push": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) != 2 {
+					return newError("wrong number of arguments, got=%d, want=2", len(args))
+				}
+				if args[0].Type() != object.ARRAY_OBJ {
+					return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
+				}
+
+				arr := args[0].(*object.Array)
+				length := len(arr.Elements)
+
+				newElements := make([]object.Object, length+1, length+1)
+				copy(newElements, arr.Elements)
+				newElements[length] = args[1]
+
+				return &object.Array{Elements: newElements}
+			},
+		},
+		"int": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments, got=%d, want=1", len(args))
+				}
+
+				switch arg := args[0].(type) {
+				case *object.Integer, *object.BigInt:
+					return arg
+				case *object.Float:
+					return floatToInteger(math.Trunc(arg.Value))
+				case *object.String:
+					value, ok := new(big.Int).SetString(strings.TrimSpace(arg.Value), 10)
+					if !ok {
+						return newError("could not parse %q as integer", arg.Value)
+					}
+					return object.NewInteger(value)
+				default:
+					return newError("argument to `int` not supported, got %s", args[0].Type())
+				}
+			},
+		},
+		"float": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments, got=%d, want=1", len(args))
+				}
+
+				switch arg := args[0].(type) {
+				case *object.Integer, *object.BigInt:
+					return &object.Float{Value: toFloat(arg)}
+				case *object.Float:
+					return arg
+				case *object.String:
+					value, err := strconv.ParseFloat(strings.TrimSpace(arg.Value), 64)
+					if err != nil {
+						return newError("could not parse %q as float", arg.Value)
+					}
+					return &object.Float{Value: value}
+				default:
+					return newError("argument to `float` not supported, got %s", args[0].Type())
+				}
+			},
+		},
+		"round": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) != 1 && len(args) != 2 {
+					return newError("wrong number of arguments, got=%d, want=1 or 2", len(args))
+				}
+
+				// round(x) gives the nearest integer, round(x, digits) a float with that many decimal places
+				if len(args) == 2 {
+					digits, ok := args[1].(*object.Integer)
+					if !ok {
+						return newError("second argument to `round` must be INTEGER, got %s", args[1].Type())
+					}
+					if !isNumber(args[0]) {
+						return newError("argument to `round` not supported, got %s", args[0].Type())
+					}
+					scale := math.Pow(10, float64(digits.Value))
+					return &object.Float{Value: math.Round(toFloat(args[0])*scale) / scale}
+				}
+
+				switch arg := args[0].(type) {
+				case *object.Integer, *object.BigInt:
+					return arg
+				case *object.Float:
+					return floatToInteger(math.Round(arg.Value))
+				default:
+					return newError("argument to `round` not supported, got %s", args[0].Type())
+				}
+			},
+		},
+		"floor": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments, got=%d, want=1", len(args))
+				}
+
+				switch arg := args[0].(type) {
+				case *object.Integer, *object.BigInt:
+					return arg
+				case *object.Float:
+					return floatToInteger(math.Floor(arg.Value))
+				default:
+					return newError("argument to `floor` not supported, got %s", args[0].Type())
+				}
+			},
+		},
+	}
+}
+
+// floatToInteger converts a float with no fractional part to an Integer, or a BigInt if it
+// is too big for one. NaN and the infinities have no integer value
+func floatToInteger(value float64) object.Object {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return newError("float %s out of integer range", (&object.Float{Value: value}).Inspect())
+	}
+	if value >= math.MinInt64 && value < math.MaxInt64 {
+		return &object.Integer{Value: int64(value)}
+	}
+	integer, _ := big.NewFloat(value).Int(nil)
+	return &object.BigInt{Value: integer}
+}
+
+// ioBuiltins returns the builtins that talk to e's Stdin, Stdout and Stderr.
+// They read the fields on every call, so redirecting them later still takes effect
+func (e *Evaluator) ioBuiltins() map[string]object.Object {
+	return map[string]object.Object{
+		"print": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				return writeLine(e.Stdout, args)
+			},
+		},
+		"eprint": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				return writeLine(e.Stderr, args)
+			},
+		},
+		"input": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) > 1 {
+					return newError("wrong number of arguments, got=%d, want=0 or 1", len(args))
+				}
+				if len(args) == 1 {
+					if _, err := io.WriteString(e.Stdout, args[0].Inspect()); err != nil {
+						return newError("could not write prompt: %s", err)
+					}
+				}
+
+				// input() gives null once there is nothing left to read
+				line, err := e.stdin().ReadString('\n')
+				if err == io.EOF && line == "" {
+					return NULL
+				}
+				if err != nil && err != io.EOF {
+					return newError("could not read input: %s", err)
+				}
+				line = strings.TrimSuffix(line, "\n")
+				line = strings.TrimSuffix(line, "\r")
+				return &object.String{Value: line}
+			},
+		},
+	}
+}
+
+// stringBuiltins returns the builtins for working with strings. Positions and lengths
+// count characters rather than bytes, so they agree with len, indexing and for-in
+func (e *Evaluator) stringBuiltins() map[string]object.Object {
+	return map[string]object.Object{
+		"split": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				// split(s) splits on runs of whitespace, split(s, "") into characters
+				if err := checkArgCount(args, 1, 2); err != nil {
+					return err
+				}
+				str, err := stringArg("split", args, 0)
+				if err != nil {
+					return err
+				}
+				if len(args) == 1 {
+					return stringsToArray(strings.Fields(str))
+				}
+				sep, err := stringArg("split", args, 1)
+				if err != nil {
+					return err
+				}
+				return stringsToArray(strings.Split(str, sep))
+			},
+		},
+		"join": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if err := checkArgCount(args, 1, 2); err != nil {
+					return err
+				}
+				arr, ok := args[0].(*object.Array)
+				if !ok {
+					return newError("first argument to `join` must be ARRAY, got %s", args[0].Type())
+				}
+				sep := ""
+				if len(args) == 2 {
+					var err *object.Error
+					if sep, err = stringArg("join", args, 1); err != nil {
+						return err
+					}
+				}
+
+				strs := make([]string, len(arr.Elements))
+				for i, el := range arr.Elements {
+					str, ok := el.(*object.String)
+					if !ok {
+						return newError("elements joined by `join` must be STRING, got %s", el.Type())
+					}
+					strs[i] = str.Value
+				}
+				return &object.String{Value: strings.Join(strs, sep)}
+			},
+		},
+		"trim":  stringFunction("trim", strings.TrimSpace),
+		"upper": stringFunction("upper", strings.ToUpper),
+		"lower": stringFunction("lower", strings.ToLower),
+		"replace": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				// replace(s, old, new) replaces every old, replace(s, old, new, n) only the first n
+				if err := checkArgCount(args, 3, 4); err != nil {
+					return err
+				}
+				strs, err := stringArgs("replace", args[:3])
+				if err != nil {
+					return err
+				}
+				n := int64(-1)
+				if len(args) == 4 {
+					if n, err = integerArg("replace", args, 3); err != nil {
+						return err
+					}
+				}
+				return &object.String{Value: strings.Replace(strs[0], strs[1], strs[2], int(n))}
+			},
+		},
+		"contains":   stringPredicate("contains", strings.Contains),
+		"startsWith": stringPredicate("startsWith", strings.HasPrefix),
+		"endsWith":   stringPredicate("endsWith", strings.HasSuffix),
+		"indexOf": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if err := checkArgCount(args, 2, 2); err != nil {
+					return err
+				}
+				strs, err := stringArgs("indexOf", args)
+				if err != nil {
+					return err
+				}
+				i := strings.Index(strs[0], strs[1])
+				if i < 0 {
+					return &object.Integer{Value: -1}
+				}
+				return &object.Integer{Value: int64(utf8.RuneCountInString(strs[0][:i]))}
+			},
+		},
+		"repeat": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if err := checkArgCount(args, 2, 2); err != nil {
+					return err
+				}
+				str, err := stringArg("repeat", args, 0)
+				if err != nil {
+					return err
+				}
+				count, err := integerArg("repeat", args, 1)
+				if err != nil {
+					return err
+				}
+				if count < 0 {
+					return newError("repeat count must not be negative, got %d", count)
+				}
+
+				// checked before building the string, which could otherwise exhaust memory
+				if max := e.Limits.MaxStringLength; max > 0 && count > 0 && int64(len(str)) > int64(max)/count {
+					return limitError("MaxStringLength", max)
+				}
+				if count > 0 && int64(len(str)) > math.MaxInt32/count {
+					return newError("repeated string too long")
+				}
+				return &object.String{Value: strings.Repeat(str, int(count))}
+			},
+		},
+		"substr": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				// substr(s, start, end) is s[start..end], and substr(s, start) runs to the end of s
+				if err := checkArgCount(args, 2, 3); err != nil {
+					return err
+				}
+				str, err := stringArg("substr", args, 0)
+				if err != nil {
+					return err
+				}
+				start, err := integerArg("substr", args, 1)
+				if err != nil {
+					return err
+				}
+				end := int64(math.MaxInt64)
+				if len(args) == 3 {
+					if end, err = integerArg("substr", args, 2); err != nil {
+						return err
+					}
+				}
+				return sliceString(str, start, end)
+			},
+		},
+		"chars": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if err := checkArgCount(args, 1, 1); err != nil {
+					return err
+				}
+				str, err := stringArg("chars", args, 0)
+				if err != nil {
+					return err
+				}
+				return stringsToArray(strings.Split(str, ""))
+			},
+		},
+		"format": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if len(args) == 0 {
+					return newError("wrong number of arguments, got=0, want=at least 1")
+				}
+				template, err := stringArg("format", args, 0)
+				if err != nil {
+					return err
+				}
+				return formatString(template, args[1:])
+			},
+		},
+	}
+}
+
+// arrayBuiltins returns the builtins for working with arrays, many of which
+// take a function to call on each element through the Runtime
+func (e *Evaluator) arrayBuiltins() map[string]object.Object {
+	return map[string]object.Object{
+		"map": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				arr, fn, err := arrayAndFunctionArgs("map", args)
+				if err != nil {
+					return err
+				}
+				elements := make([]object.Object, len(arr.Elements))
+				for i, el := range arr.Elements {
+					result := rt.Call(fn, el)
+					if isError(result) {
+						return result
+					}
+					elements[i] = result
+				}
+				return &object.Array{Elements: elements}
+			},
+		},
+		"filter": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				arr, fn, err := arrayAndFunctionArgs("filter", args)
+				if err != nil {
+					return err
+				}
+				elements := []object.Object{}
+				for _, el := range arr.Elements {
+					result := rt.Call(fn, el)
+					if isError(result) {
+						return result
+					}
+					if isTruthy(result) {
+						elements = append(elements, el)
+					}
+				}
+				return &object.Array{Elements: elements}
+			},
+		},
+		"reduce": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				// reduce(arr, fn, initial) folds from initial, reduce(arr, fn) from the first element
+				if err := checkArgCount(args, 2, 3); err != nil {
+					return err
+				}
+				arr, fn, err := arrayAndFunctionArgs("reduce", args[:2])
+				if err != nil {
+					return err
+				}
+				elements := arr.Elements
+				var acc object.Object
+				if len(args) == 3 {
+					acc = args[2]
+				} else if len(elements) > 0 {
+					acc, elements = elements[0], elements[1:]
+				} else {
+					return newError("reduce of empty array with no initial value")
+				}
+
+				for _, el := range elements {
+					acc = rt.Call(fn, acc, el)
+					if isError(acc) {
+						return acc
+					}
+				}
+				return acc
+			},
+		},
+		"each": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				arr, fn, err := arrayAndFunctionArgs("each", args)
+				if err != nil {
+					return err
+				}
+				for _, el := range arr.Elements {
+					if result := rt.Call(fn, el); isError(result) {
+						return result
+					}
+				}
+				return NULL
+			},
+		},
+		"any": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				return searchArray(rt, "any", args, true, TRUE, FALSE)
+			},
+		},
+		"all": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				return searchArray(rt, "all", args, false, FALSE, TRUE)
+			},
+		},
+		"find": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				arr, fn, err := arrayAndFunctionArgs("find", args)
+				if err != nil {
+					return err
+				}
+				for _, el := range arr.Elements {
+					result := rt.Call(fn, el)
+					if isError(result) {
+						return result
+					}
+					if isTruthy(result) {
+						return el
+					}
+				}
+				return NULL
+			},
+		},
+		"sort": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if err := checkArgCount(args, 1, 1); err != nil {
+					return err
+				}
+				arr, err := arrayArg("sort", args, 0)
+				if err != nil {
+					return err
+				}
+				return sortArray(arr.Elements, arr.Elements)
+			},
+		},
+		"sortBy": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				arr, fn, err := arrayAndFunctionArgs("sortBy", args)
+				if err != nil {
+					return err
+				}
+				keys := make([]object.Object, len(arr.Elements))
+				for i, el := range arr.Elements {
+					keys[i] = rt.Call(fn, el)
+					if isError(keys[i]) {
+						return keys[i]
+					}
+				}
+				return sortArray(arr.Elements, keys)
+			},
+		},
+		"zip": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				// zip stops at the end of the shortest array, like a for loop over all of them would
+				if len(args) < 2 {
+					return newError("wrong number of arguments, got=%d, want=at least 2", len(args))
+				}
+				length := -1
+				arrays := make([]*object.Array, len(args))
+				for i := range args {
+					arr, ok := args[i].(*object.Array)
+					if !ok {
+						return newError("arguments to `zip` must be ARRAY, got %s", args[i].Type())
+					}
+					arrays[i] = arr
+					if length < 0 || len(arr.Elements) < length {
+						length = len(arr.Elements)
+					}
+				}
+
+				tuples := make([]object.Object, length)
+				for i := range tuples {
+					tuple := make([]object.Object, len(arrays))
+					for j, arr := range arrays {
+						tuple[j] = arr.Elements[i]
+					}
+					tuples[i] = &object.Array{Elements: tuple}
+				}
+				return &object.Array{Elements: tuples}
+			},
+		},
+		"flatten": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				// flatten(arr) flattens one level of nested arrays, flatten(arr, depth) that many
+				if err := checkArgCount(args, 1, 2); err != nil {
+					return err
+				}
+				arr, err := arrayArg("flatten", args, 0)
+				if err != nil {
+					return err
+				}
+				depth := int64(1)
+				if len(args) == 2 {
+					if depth, err = integerArg("flatten", args, 1); err != nil {
+						return err
+					}
+				}
+				return flattenArray(arr, depth)
+			},
+		},
+		"range": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				// range(end), range(start, end) and range(start, end, step), up to but not including end
+				if err := checkArgCount(args, 1, 3); err != nil {
+					return err
+				}
+				values := make([]int64, len(args))
+				for i := range args {
+					value, err := integerArg("range", args, i)
+					if err != nil {
+						return err
+					}
+					values[i] = value
+				}
+				start, end, step := int64(0), values[0], int64(1)
+				if len(values) > 1 {
+					start, end = values[0], values[1]
+				}
+				if len(values) > 2 {
+					step = values[2]
+				}
+				if step == 0 {
+					return newError("range step must not be zero")
+				}
+
+				// the length is worked out first so a huge range fails instead of exhausting memory
+				count := uint64(0)
+				if step > 0 && start < end {
+					count = (uint64(end)-uint64(start)-1)/uint64(step) + 1
+				} else if step < 0 && start > end {
+					count = (uint64(start)-uint64(end)-1)/uint64(-step) + 1
+				}
+				if max := e.Limits.MaxArrayLength; max > 0 && count > uint64(max) {
+					return limitError("MaxArrayLength", max)
+				}
+				if count > math.MaxInt32 {
+					return newError("range too long")
+				}
+
+				elements := make([]object.Object, count)
+				for i := range elements {
+					elements[i] = &object.Integer{Value: start + int64(i)*step}
+				}
+				return &object.Array{Elements: elements}
+			},
+		},
+	}
+}
+
+// hashBuiltins returns the builtins for working with hashes. Like the array builtins
+// they leave their arguments alone, returning a new hash rather than changing one
+func hashBuiltins() map[string]object.Object {
+	return map[string]object.Object{
+		"keys": hashListing("keys", func(pair object.HashPair) object.Object {
+			return pair.Key
+		}),
+		"values": hashListing("values", func(pair object.HashPair) object.Object {
+			return pair.Value
+		}),
+		"items": hashListing("items", func(pair object.HashPair) object.Object {
+			return &object.Array{Elements: []object.Object{pair.Key, pair.Value}}
+		}),
+		"has": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if err := checkArgCount(args, 2, 2); err != nil {
+					return err
+				}
+				hash, err := hashArg("has", args, 0)
+				if err != nil {
+					return err
+				}
+				key, err := hashKey(args[1])
+				if err != nil {
+					return err
+				}
+				_, found := hash.Get(key)
+				return nativeBoolToBooleanObject(found)
+			},
 		},
-	},
-	"last": &object.Builtin{
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments, got=%d, want=1", len(args))
+		"delete": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				if err := checkArgCount(args, 2, 2); err != nil {
+					return err
+				}
+				hash, err := hashArg("delete", args, 0)
+				if err != nil {
+					return err
+				}
+				key, err := hashKey(args[1])
+				if err != nil {
+					return err
+				}
+				result := copyHash(hash)
+				result.Delete(key)
+				return result
+			},
+		},
+		"merge": &object.Builtin{
+			Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+				// keys keep the place they first appear in, with values from the last hash that has them
+				if len(args) == 0 {
+					return newError("wrong number of arguments, got=0, want=at least 1")
+				}
+				result := &object.Hash{}
+				for i := range args {
+					hash, ok := args[i].(*object.Hash)
+					if !ok {
+						return newError("arguments to `merge` must be HASH, got %s", args[i].Type())
+					}
+					for _, pair := range hash.Ordered() {
+						result.Set(pair.Key.(object.Hashable), pair.Value)
+					}
+				}
+				return result
+			},
+		},
+	}
+}
+
+// hashListing makes a builtin that lists one thing about each pair in a hash, in order
+func hashListing(name string, item func(object.HashPair) object.Object) *object.Builtin {
+	return &object.Builtin{
+		Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+			if err := checkArgCount(args, 1, 1); err != nil {
+				return err
 			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `last` must be ARRAY, got %s", args[0].Type())
+			hash, err := hashArg(name, args, 0)
+			if err != nil {
+				return err
 			}
-
-			arr := args[0].(*object.Array)
-			length := len(arr.Elements)
-			if len(arr.Elements) > 0 {
-				return arr.Elements[length-1]
+			pairs := hash.Ordered()
+			elements := make([]object.Object, len(pairs))
+			for i, pair := range pairs {
+				elements[i] = item(pair)
 			}
-			return NULL
+			return &object.Array{Elements: elements}
 		},
-	},
-	"rest": &object.Builtin{
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments, got=%d, want=1", len(args))
+	}
+}
+
+func copyHash(hash *object.Hash) *object.Hash {
+	result := &object.Hash{}
+	for _, pair := range hash.Ordered() {
+		result.Set(pair.Key.(object.Hashable), pair.Value)
+	}
+	return result
+}
+
+// searchArray implements any and all: it returns found as soon as fn gives a truthy result
+// for an element (or a falsy one, when truthy is false), and notFound if it never does.
+// Without fn, the elements themselves are tested
+func searchArray(rt object.Runtime, name string, args []object.Object, truthy bool, found, notFound object.Object) object.Object {
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return err
+	}
+	arr, err := arrayArg(name, args, 0)
+	if err != nil {
+		return err
+	}
+	var fn object.Object
+	if len(args) == 2 {
+		if fn, err = functionArg(name, args, 1); err != nil {
+			return err
+		}
+	}
+
+	for _, el := range arr.Elements {
+		result := el
+		if fn != nil {
+			result = rt.Call(fn, el)
+			if isError(result) {
+				return result
 			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
+		}
+		if isTruthy(result) == truthy {
+			return found
+		}
+	}
+	return notFound
+}
+
+// sortArray returns a sorted copy of elements, ordered by the key at the same index in keys.
+// Sorting is stable, and keys must all be numbers or all be strings
+func sortArray(elements, keys []object.Object) object.Object {
+	indices := make([]int, len(elements))
+	for i := range indices {
+		indices[i] = i
+	}
+
+	var err *object.Error
+	sort.SliceStable(indices, func(i, j int) bool {
+		order, cmpErr := compareObjects(keys[indices[i]], keys[indices[j]])
+		if cmpErr != nil && err == nil {
+			err = cmpErr
+		}
+		return order < 0
+	})
+	if err != nil {
+		return err
+	}
+
+	sorted := make([]object.Object, len(elements))
+	for i, index := range indices {
+		sorted[i] = elements[index]
+	}
+	return &object.Array{Elements: sorted}
+}
+
+// compareObjects orders two numbers or two strings, returning -1, 0 or 1
+func compareObjects(a, b object.Object) (int, *object.Error) {
+	switch {
+	case a.Type() == object.INTEGER_OBJ && b.Type() == object.INTEGER_OBJ:
+		x, y := a.(*object.Integer).Value, b.(*object.Integer).Value
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	case isInteger(a) && isInteger(b):
+		return toBigInt(a).Cmp(toBigInt(b)), nil
+	case isNumber(a) && isNumber(b):
+		x, y := toFloat(a), toFloat(b)
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	case a.Type() == object.STRING_OBJ && b.Type() == object.STRING_OBJ:
+		return strings.Compare(a.(*object.String).Value, b.(*object.String).Value), nil
+	default:
+		return 0, newError("cannot compare %s and %s", a.Type(), b.Type())
+	}
+}
+
+// flattenArray splices the elements of nested arrays into their parent, depth levels deep.
+// It keeps its own stack of the arrays it's inside, so deep nesting can't exhaust Go's,
+// and refuses an array that contains itself rather than splicing it in forever
+func flattenArray(arr *object.Array, depth int64) object.Object {
+	type level struct {
+		arr  *object.Array
+		next int
+	}
+	stack := []level{{arr: arr}}
+	inside := map[*object.Array]bool{arr: true}
+
+	flat := []object.Object{}
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next == len(top.arr.Elements) {
+			delete(inside, top.arr)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		el := top.arr.Elements[top.next]
+		top.next++
+
+		nested, ok := el.(*object.Array)
+		if !ok || int64(len(stack)) > depth {
+			flat = append(flat, el)
+			continue
+		}
+		if inside[nested] {
+			return newError("cannot flatten an array that contains itself")
+		}
+		inside[nested] = true
+		stack = append(stack, level{arr: nested})
+	}
+	return &object.Array{Elements: flat}
+}
+
+// formatString replaces each {} in template with the next of args, and each {n}
+// with args[n]. Strings are inserted as they are, other values as print shows them.
+// {{ and }} stand for literal braces
+func formatString(template string, args []object.Object) object.Object {
+	var out strings.Builder
+	next := 0
+	for i := 0; i < len(template); i++ {
+		ch := template[i]
+		if (ch == '{' || ch == '}') && i+1 < len(template) && template[i+1] == ch {
+			out.WriteByte(ch)
+			i++
+			continue
+		}
+		if ch == '}' {
+			return newError("unmatched } in format string at %d", i)
+		}
+		if ch != '{' {
+			out.WriteByte(ch)
+			continue
+		}
+
+		end := strings.IndexByte(template[i:], '}')
+		if end < 0 {
+			return newError("unmatched { in format string at %d", i)
+		}
+		field := template[i+1 : i+end]
+		i += end
+
+		index := next
+		if field == "" {
+			next++
+		} else {
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 0 {
+				return newError("invalid format field {%s}", field)
 			}
+			index = n
+		}
+		if index >= len(args) {
+			return newError("not enough arguments for format string, got=%d", len(args))
+		}
+		out.WriteString(args[index].Inspect())
+	}
+	return &object.String{Value: out.String()}
+}
 
-			arr := args[0].(*object.Array)
-			length := len(arr.Elements)
-			if length > 0 {
-				newElements := make([]object.Object, length-1, length-1)
-				copy(newElements, arr.Elements[1:length])
-				return &object.Array{Elements: newElements}
+// sliceString returns the characters of str from start up to but not including end.
+// Both are clamped to the string, as they are when slicing with a range
+func sliceString(str string, start, end int64) *object.String {
+	runes := []rune(str)
+	clamp := func(i int64) int64 {
+		if i < 0 {
+			return 0
+		}
+		if i > int64(len(runes)) {
+			return int64(len(runes))
+		}
+		return i
+	}
+	start, end = clamp(start), clamp(end)
+	if start >= end {
+		return &object.String{Value: ""}
+	}
+	return &object.String{Value: string(runes[start:end])}
+}
+
+// stringFunction makes a builtin of fn, which transforms one string
+func stringFunction(name string, fn func(string) string) *object.Builtin {
+	return &object.Builtin{
+		Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+			if err := checkArgCount(args, 1, 1); err != nil {
+				return err
 			}
-			return NULL
+			str, err := stringArg(name, args, 0)
+			if err != nil {
+				return err
+			}
+			return &object.String{Value: fn(str)}
 		},
-	},
-	"push": &object.Builtin{
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 2 {
-				return newError("wrong number of arguments, got=%d, want=2", len(args))
+	}
+}
+
+// stringPredicate makes a builtin of fn, which tests one string against another
+func stringPredicate(name string, fn func(s, substr string) bool) *object.Builtin {
+	return &object.Builtin{
+		Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+			if err := checkArgCount(args, 2, 2); err != nil {
+				return err
 			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
+			strs, err := stringArgs(name, args)
+			if err != nil {
+				return err
 			}
+			return nativeBoolToBooleanObject(fn(strs[0], strs[1]))
+		},
+	}
+}
 
-			arr := args[0].(*object.Array)
-			length := len(arr.Elements)
+func stringsToArray(strs []string) *object.Array {
+	elements := make([]object.Object, len(strs))
+	for i, str := range strs {
+		elements[i] = &object.String{Value: str}
+	}
+	return &object.Array{Elements: elements}
+}
 
-			newElements := make([]object.Object, length+1, length+1)
-			copy(newElements, arr.Elements)
-			newElements[length] = args[1]
+// checkArgCount returns an error unless a builtin got between min and max arguments
+func checkArgCount(args []object.Object, min, max int) *object.Error {
+	if len(args) < min || len(args) > max {
+		return newError("wrong number of arguments, got=%d, want=%s", len(args), describeArity(min, max, false))
+	}
+	return nil
+}
 
-			return &object.Array{Elements: newElements}
-		},
-	},
-	"print": &object.Builtin{
-		Fn: func(args ...object.Object) object.Object {
-			for _, arg := range args {
-				fmt.Print(arg.Inspect() + " ")
-			}
-			fmt.Println("")
-			return &object.String{Value: ""}
-		},
-	},
+var ordinals = []string{"first", "second", "third", "fourth"}
+
+// argumentName describes args[i] in an error from the builtin name
+func argumentName(name string, args []object.Object, i int) string {
+	if len(args) == 1 {
+		return fmt.Sprintf("argument to `%s`", name)
+	}
+	return fmt.Sprintf("%s argument to `%s`", ordinals[i], name)
+}
+
+// stringArg returns args[i] as a Go string, or an error if it isn't a STRING
+func stringArg(name string, args []object.Object, i int) (string, *object.Error) {
+	str, ok := args[i].(*object.String)
+	if !ok {
+		return "", newError("%s must be STRING, got %s", argumentName(name, args, i), args[i].Type())
+	}
+	return str.Value, nil
+}
+
+// stringArgs returns every one of args as a Go string, or an error if any isn't a STRING
+func stringArgs(name string, args []object.Object) ([]string, *object.Error) {
+	strs := make([]string, len(args))
+	for i := range args {
+		str, err := stringArg(name, args, i)
+		if err != nil {
+			return nil, err
+		}
+		strs[i] = str
+	}
+	return strs, nil
+}
+
+// arrayArg returns args[i] as an Array, or an error if it isn't one
+func arrayArg(name string, args []object.Object, i int) (*object.Array, *object.Error) {
+	arr, ok := args[i].(*object.Array)
+	if !ok {
+		return nil, newError("%s must be ARRAY, got %s", argumentName(name, args, i), args[i].Type())
+	}
+	return arr, nil
+}
+
+// hashArg returns args[i] as a Hash, or an error if it isn't one
+func hashArg(name string, args []object.Object, i int) (*object.Hash, *object.Error) {
+	hash, ok := args[i].(*object.Hash)
+	if !ok {
+		return nil, newError("%s must be HASH, got %s", argumentName(name, args, i), args[i].Type())
+	}
+	return hash, nil
+}
+
+// functionArg returns args[i] if it can be called, or an error if it can't
+func functionArg(name string, args []object.Object, i int) (object.Object, *object.Error) {
+	// checking the type rather than the Go type accepts the vm's closures too
+	switch args[i].Type() {
+	case object.FUNCTION_OBJ, object.BUILTIN_OBJ:
+		return args[i], nil
+	default:
+		return nil, newError("%s must be FUNCTION, got %s", argumentName(name, args, i), args[i].Type())
+	}
+}
+
+// arrayAndFunctionArgs checks the arguments of a builtin called as name(arr, fn)
+func arrayAndFunctionArgs(name string, args []object.Object) (*object.Array, object.Object, *object.Error) {
+	if err := checkArgCount(args, 2, 2); err != nil {
+		return nil, nil, err
+	}
+	arr, err := arrayArg(name, args, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fn, err := functionArg(name, args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return arr, fn, nil
+}
+
+// integerArg returns args[i] as an int64, or an error if it isn't an INTEGER
+func integerArg(name string, args []object.Object, i int) (int64, *object.Error) {
+	integer, ok := args[i].(*object.Integer)
+	if !ok {
+		return 0, newError("%s must be INTEGER, got %s", argumentName(name, args, i), args[i].Type())
+	}
+	return integer.Value, nil
+}
+
+// writeLine prints args separated and followed by spaces, then a newline
+func writeLine(w io.Writer, args []object.Object) object.Object {
+	var out strings.Builder
+	for _, arg := range args {
+		out.WriteString(arg.Inspect() + " ")
+	}
+	out.WriteString("\n")
+
+	if _, err := io.WriteString(w, out.String()); err != nil {
+		return newError("could not write output: %s", err)
+	}
+	return &object.String{Value: ""}
+}
+
+// stdin returns a buffered reader over Stdin, made again if Stdin has been replaced
+func (e *Evaluator) stdin() *bufio.Reader {
+	if e.stdinReader == nil || e.stdinSource != e.Stdin {
+		e.stdinReader = bufio.NewReader(e.Stdin)
+		e.stdinSource = e.Stdin
+	}
+	return e.stdinReader
+}
+
+// RegisterBuiltin makes fn callable from Farcical code as name, replacing any
+// builtin already registered under it. A dotted name such as "str.upper"
+// registers fn as a member of the namespace "str", creating it if needed
+func (e *Evaluator) RegisterBuiltin(name string, fn object.BuiltinFunction) {
+	path := strings.Split(name, ".")
+	members := e.builtins
+	for _, part := range path[:len(path)-1] {
+		ns, ok := members[part].(*object.Namespace)
+		if !ok {
+			ns = &object.Namespace{Name: part, Members: make(map[string]object.Object)}
+			members[part] = ns
+		}
+		members = ns.Members
+	}
+	members[path[len(path)-1]] = &object.Builtin{Fn: fn}
+}
+
+// UnregisterBuiltin removes the builtin registered as name, which may be dotted
+// or the name of a whole namespace. Unknown names are ignored
+func (e *Evaluator) UnregisterBuiltin(name string) {
+	path := strings.Split(name, ".")
+	members := e.builtins
+	for _, part := range path[:len(path)-1] {
+		ns, ok := members[part].(*object.Namespace)
+		if !ok {
+			return
+		}
+		members = ns.Members
+	}
+	delete(members, path[len(path)-1])
+}
+
+// DisableIO removes every builtin that reads or writes outside the interpreter
+// and turns off imports, for running untrusted scripts
+func (e *Evaluator) DisableIO() {
+	for _, name := range ioBuiltinNames {
+		e.UnregisterBuiltin(name)
+	}
+	e.ReadModule = nil
 }
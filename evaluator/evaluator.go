@@ -1,98 +1,290 @@
 package evaluator
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"farcical/ast"
+	"farcical/diag"
 	"farcical/object"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"strings"
 )
 
 // there is no point making new instance of object.Boolean every time a boolean is created
 // there is no difference between 2 trues/falses
 // therefore reference the values instead of creating new ones - same for NULL
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL     = &object.Null{}
+	TRUE     = &object.Boolean{Value: true}
+	FALSE    = &object.Boolean{Value: false}
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
+// Evaluator holds the state of one evaluation: the builtins it can see, where
+// they do I/O and the stack of active function calls
+type Evaluator struct {
+	Stdin  io.Reader // read by input
+	Stdout io.Writer // written by print
+	Stderr io.Writer // written by eprint
+	Limits Limits
+
+	// ReadModule reads the file an import refers to. It is os.ReadFile by default,
+	// and imports fail while it is nil. SearchPath lists the directories imports
+	// look in when a module isn't found relative to the importing file
+	ReadModule func(path string) ([]byte, error)
+	SearchPath []string
+
+	// RunModule runs the program of an imported module in env and returns the names
+	// it exported. When it is nil modules are evaluated like any other program; the
+	// vm package sets it so that modules imported by compiled code are compiled too
+	RunModule func(program *ast.Program, env *object.Environment) ([]string, object.Object)
+
+	builtins    map[string]object.Object
+	frames      []object.Frame
+	nesting     int             // how many calls to Eval are active, to spot the outermost one
+	steps       int             // nodes evaluated since the outermost Eval began
+	ctx         context.Context // checked at calls and loop iterations, nil if evaluation can't be cancelled
+	stdinReader *bufio.Reader
+	stdinSource io.Reader          // the Stdin stdinReader was made for
+	modules     map[string]*module // imported modules by resolved path
+	loading     []string           // modules being evaluated, innermost last, to spot import cycles
+	exports     *[]string          // collects the names exported by the module being evaluated
+}
+
+// New returns an Evaluator with the standard builtins registered, doing I/O on
+// the process's standard streams, and with only the call depth limited
+func New() *Evaluator {
+	e := &Evaluator{
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		Limits:     Limits{MaxDepth: DefaultMaxDepth},
+		ReadModule: os.ReadFile,
+		builtins:   defaultBuiltins(),
+	}
+	for name, builtin := range e.stringBuiltins() {
+		e.builtins[name] = builtin
+	}
+	for name, builtin := range e.arrayBuiltins() {
+		e.builtins[name] = builtin
+	}
+	for name, builtin := range hashBuiltins() {
+		e.builtins[name] = builtin
+	}
+	for name, builtin := range e.ioBuiltins() {
+		e.builtins[name] = builtin
+	}
+	return e
+}
+
+// Eval evaluates node with a fresh Evaluator
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	return New().Eval(node, env)
+}
+
+// EvalContext evaluates node with a fresh Evaluator, stopping early if ctx is done
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment) object.Object {
+	return New().EvalContext(ctx, node, env)
+}
+
+// EvalContext is Eval that gives up once ctx is cancelled or its deadline passes.
+// ctx is checked before every function call and loop iteration; when it is done the
+// result is an error whose Cause is ctx.Err(), so hosts can tell it apart from script errors
+func (e *Evaluator) EvalContext(ctx context.Context, node ast.Node, env *object.Environment) object.Object {
+	prev := e.ctx
+	e.ctx = ctx
+	defer func() { e.ctx = prev }()
+
+	return e.Eval(node, env)
+}
+
+// checkContext returns an error if the context of the current evaluation is done
+func (e *Evaluator) checkContext() *object.Error {
+	if e.ctx == nil {
+		return nil
+	}
+	if err := e.ctx.Err(); err != nil {
+		return stoppedError(err)
+	}
+	return nil
+}
+
+// stoppedError is the error raised when the context of an evaluation is done
+func stoppedError(err error) *object.Error {
+	return &object.Error{Message: "evaluation stopped: " + err.Error(), Cause: err}
+}
+
+func (e *Evaluator) Eval(node ast.Node, env *object.Environment) (result object.Object) {
+	if e.nesting == 0 {
+		e.steps = 0 // each evaluation started from Go gets the whole step budget
+	}
+	e.nesting++
+	defer func() {
+		e.nesting--
+		if r := recover(); r != nil {
+			result = e.panicError(node, r)
+		}
+	}()
+
+	if err := e.step(); err != nil {
+		result = err
+	} else {
+		result = e.eval(node, env)
+	}
+
+	// only check the nodes that can build a new string, array or hash
+	switch node.(type) {
+	case *ast.InfixExpression, *ast.ArrayLiteral, *ast.HashLiteral, *ast.CallExpression, *ast.AssignExpression:
+		if err := e.checkSize(result); err != nil {
+			result = err
+		}
+	}
+
+	// the innermost node an error passes through is where it happened
+	if err, ok := result.(*object.Error); ok && !err.Span.Pos.IsValid() {
+		err.Span = diag.Span{Pos: node.Pos(), End: node.End()}
+		err.Stack = e.stackTrace()
+	}
+
+	return result
+}
+
+// panicError turns a Go panic raised while evaluating node, in the evaluator or in a builtin,
+// into an error at node's position, so the bug fails one script instead of crashing the host
+func (e *Evaluator) panicError(node ast.Node, r interface{}) *object.Error {
+	err := &object.Error{Message: fmt.Sprintf("internal error: %v", r), Kind: "InternalError", Stack: e.stackTrace()}
+	if cause, ok := r.(error); ok {
+		err.Cause = cause
+	}
+	if node != nil {
+		err.Span = diag.Span{Pos: node.Pos(), End: node.End()}
+	}
+	return err
+}
+
+// stackTrace returns a copy of the active call frames, outermost first
+func (e *Evaluator) stackTrace() []object.Frame {
+	if len(e.frames) == 0 {
+		return nil
+	}
+	return append([]object.Frame{}, e.frames...)
+}
+
+func (e *Evaluator) eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	case *ast.Program:
-		return evalProgram(node, env)
+		return e.evalProgram(node, env)
 	case *ast.ExpressionStatement:
-		return Eval(node.Expression, env)
+		return e.Eval(node.Expression, env)
 	case *ast.IntegerLiteral:
+		if node.Big != nil {
+			return &object.BigInt{Value: node.Big}
+		}
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 	case *ast.PrefixExpression:
-		right := Eval(node.Right, env)
+		right := e.Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
 		return evalPrefixExpression(node.Operator, right)
 	case *ast.InfixExpression:
-		left := Eval(node.Left, env)
+		if node.Operator == "&&" || node.Operator == "||" {
+			return e.evalLogicalExpression(node, env)
+		}
+		left := e.Eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
-		right := Eval(node.Right, env)
+		right := e.Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
 		return evalInfixExpression(node.Operator, left, right)
 	case *ast.BlockStatement:
-		return evalBlockStatement(node, env)
+		return e.evalBlockStatement(node, env)
 	case *ast.IfExpression:
-		return evalIfExpression(node, env)
+		return e.evalIfExpression(node, env)
 	case *ast.ReturnStatement:
-		val := Eval(node.ReturnValue, env)
+		val := e.Eval(node.ReturnValue, env)
 		if isError(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
 	case *ast.LetStatement:
-		val := Eval(node.Value, env)
+		val := e.Eval(node.Value, env)
 		if isError(val) {
 			return val
 		}
+		if fn, ok := val.(*object.Function); ok && fn.Name == "" {
+			fn.Name = node.Name.Value // name anonymous functions after their first binding, for stack traces
+		}
 		env.Set(node.Name.Value, val) // create the variable in the environment
 	case *ast.Identifier:
-		return evalIdentifier(node, env)
+		return e.evalIdentifier(node, env)
+	case *ast.MemberExpression:
+		return e.evalMemberExpression(node, env)
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return &object.Function{Parameters: params, Defaults: node.Defaults, Rest: node.Rest, Env: env, Body: body}
 	case *ast.CallExpression:
-		function := Eval(node.Function, env)
+		function := e.Eval(node.Function, env)
 		if isError(function) {
 			return function
 		}
-		args := evalExpressions(node.Arguments, env)
+		args := e.evalExpressions(node.Arguments, env)
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
-		return applyFunction(function, args)
+		return e.applyFunction(function, args, node)
 	case *ast.ArrayLiteral:
-		elements := evalExpressions(node.Elements, env)
+		elements := e.evalExpressions(node.Elements, env)
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
 		return &object.Array{Elements: elements}
 	case *ast.IndexExpression:
-		left := Eval(node.Left, env)
+		left := e.Eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
-		index := Eval(node.Index, env)
+		index := e.Eval(node.Index, env)
 		if isError(index) {
 			return index
 		}
 		return evalIndexExpression(left, index)
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		return e.evalHashLiteral(node, env)
+	case *ast.AssignExpression:
+		return e.evalAssignExpression(node, env)
+	case *ast.WhileStatement:
+		return e.evalWhileStatement(node, env)
+	case *ast.ForStatement:
+		return e.evalForStatement(node, env)
+	case *ast.TryStatement:
+		return e.evalTryStatement(node, env)
+	case *ast.ThrowStatement:
+		return e.evalThrowStatement(node, env)
+	case *ast.ImportStatement:
+		return e.evalImportStatement(node, env)
+	case *ast.ExportStatement:
+		return e.evalExportStatement(node, env)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
 
 	}
 
@@ -124,22 +316,35 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 }
 
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+	switch right := right.(type) {
+	case *object.Integer:
+		if right.Value == math.MinInt64 {
+			return &object.BigInt{Value: new(big.Int).Neg(big.NewInt(right.Value))}
+		}
+		return &object.Integer{Value: -right.Value}
+	case *object.BigInt:
+		return object.NewInteger(new(big.Int).Neg(right.Value))
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
-
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
 }
 
 func evalInfixExpression(operator string, left, right object.Object) object.Object {
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(operator, left, right)
+	case operator == "..":
+		return newError("range bounds must be INTEGER, got %s..%s", left.Type(), right.Type())
+	case isInteger(left) && isInteger(right): // at least one is a BigInt
+		return evalBigIntInfixExpression(operator, left, right)
+	case isNumber(left) && isNumber(right): // at least one is a float
+		return evalFloatInfixExpression(operator, left, right)
 	case operator == "==":
-		return nativeBoolToBooleanObject(left == right)
+		return nativeBoolToBooleanObject(object.Equal(left, right))
 	case operator == "!=":
-		return nativeBoolToBooleanObject(left != right)
+		return nativeBoolToBooleanObject(!object.Equal(left, right))
 	case left.Type() != right.Type():
 		return newError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
@@ -155,26 +360,155 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 
 	switch operator {
 	case "+":
+		if (rightVal > 0 && leftVal > math.MaxInt64-rightVal) || (rightVal < 0 && leftVal < math.MinInt64-rightVal) {
+			return evalBigIntInfixExpression(operator, left, right)
+		}
 		return &object.Integer{Value: leftVal + rightVal}
 	case "-":
+		if (rightVal < 0 && leftVal > math.MaxInt64+rightVal) || (rightVal > 0 && leftVal < math.MinInt64+rightVal) {
+			return evalBigIntInfixExpression(operator, left, right)
+		}
 		return &object.Integer{Value: leftVal - rightVal}
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		product := leftVal * rightVal
+		if leftVal != 0 && (product/leftVal != rightVal || (leftVal == -1 && rightVal == math.MinInt64)) {
+			return evalBigIntInfixExpression(operator, left, right)
+		}
+		return &object.Integer{Value: product}
 	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		if leftVal == math.MinInt64 && rightVal == -1 {
+			return evalBigIntInfixExpression(operator, left, right)
+		}
 		return &object.Integer{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return &object.Integer{Value: leftVal % rightVal}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
 		return nativeBoolToBooleanObject(leftVal != rightVal)
+	case "..":
+		return &object.Range{Start: leftVal, End: rightVal}
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
+// evalBigIntInfixExpression does integer arithmetic that doesn't fit in an int64, giving
+// an Integer again whenever the result does fit. Division truncates, as for Integers
+func evalBigIntInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toBigInt(left)
+	rightVal := toBigInt(right)
+
+	switch operator {
+	case "+":
+		return object.NewInteger(new(big.Int).Add(leftVal, rightVal))
+	case "-":
+		return object.NewInteger(new(big.Int).Sub(leftVal, rightVal))
+	case "*":
+		return object.NewInteger(new(big.Int).Mul(leftVal, rightVal))
+	case "/":
+		if rightVal.Sign() == 0 {
+			return newError("division by zero")
+		}
+		return object.NewInteger(new(big.Int).Quo(leftVal, rightVal))
+	case "%":
+		if rightVal.Sign() == 0 {
+			return newError("division by zero")
+		}
+		return object.NewInteger(new(big.Int).Rem(leftVal, rightVal))
+	case "<":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) < 0)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) > 0)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) <= 0)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) >= 0)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) == 0)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) != 0)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+// evalFloatInfixExpression handles float arithmetic, promoting an integer operand to a float
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	return isInteger(obj) || obj.Type() == object.FLOAT_OBJ
+}
+
+// isInteger reports whether obj is an Integer or a BigInt
+func isInteger(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.BIGINT_OBJ
+}
+
+// toBigInt converts an Integer or BigInt to a *big.Int, which the caller mustn't change
+func toBigInt(obj object.Object) *big.Int {
+	if i, ok := obj.(*object.Integer); ok {
+		return big.NewInt(i.Value)
+	}
+	return obj.(*object.BigInt).Value
+}
+
+// toFloat converts an Integer or Float to a float64
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.BigInt:
+		f, _ := new(big.Float).SetInt(obj.Value).Float64()
+		return f
+	}
+	return obj.(*object.Float).Value
+}
+
 func evalStringInfixExpression(operator string, left, right object.Object) object.Object {
 	if operator != "+" {
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
@@ -185,16 +519,35 @@ func evalStringInfixExpression(operator string, left, right object.Object) objec
 	return &object.String{Value: leftVal + rightVal}
 }
 
-func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
-	condition := Eval(ie.Condition, env)
+// evalLogicalExpression short-circuits && and ||: the right operand is only evaluated if the
+// left one doesn't decide the result. Like the condition of an if, any value can be an operand,
+// and the result is the operand that decided it, so `name || "default"` works
+func (e *Evaluator) evalLogicalExpression(ie *ast.InfixExpression, env *object.Environment) object.Object {
+	left := e.Eval(ie.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	if ie.Operator == "&&" && !isTruthy(left) {
+		return left
+	}
+	if ie.Operator == "||" && isTruthy(left) {
+		return left
+	}
+
+	return e.Eval(ie.Right, env)
+}
+
+func (e *Evaluator) evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
+	condition := e.Eval(ie.Condition, env)
 	if isError(condition) {
 		return condition
 	}
 
 	if isTruthy(condition) {
-		return Eval(ie.Consequence, env)
+		return e.Eval(ie.Consequence, env)
 	} else if ie.Alternative != nil {
-		return Eval(ie.Alternative, env)
+		return e.Eval(ie.Alternative, env)
 	} else {
 		return NULL
 	}
@@ -204,8 +557,12 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.ARRAY_OBJ:
+		return newError("array index must be INTEGER, got %s", index.Type())
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ:
+		return evalStringIndexExpression(left, index)
 	default:
 		return newError("index operator not supported: %s", left.Type())
 	}
@@ -223,20 +580,54 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	return arrayObject.Elements[idx]
 }
 
+// evalStringIndexExpression gives the character at an integer index, or null past either end,
+// and the characters from start up to but not including end for a range start..end
+func evalStringIndexExpression(str, index object.Object) object.Object {
+	value := str.(*object.String).Value
+
+	switch index := index.(type) {
+	case *object.Integer:
+		if index.Value < 0 {
+			return NULL
+		}
+		i := int64(0)
+		for _, ch := range value {
+			if i == index.Value {
+				return &object.String{Value: string(ch)}
+			}
+			i++
+		}
+		return NULL
+	case *object.Range:
+		return sliceString(value, index.Start, index.End)
+	default:
+		return newError("string index must be INTEGER or RANGE, got %s", index.Type())
+	}
+}
+
 func evalHashIndexExpression(hash, index object.Object) object.Object {
 	hashObject := hash.(*object.Hash) // is a pointer - store the data
 
-	key, ok := index.(object.Hashable) // not a pointer - just check it is a hashable type
-	if !ok {
-		return newError("unusable as hash key: %s", index.Type())
+	key, err := hashKey(index)
+	if err != nil {
+		return err
 	}
 
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	value, ok := hashObject.Get(key)
 	if !ok {
 		return NULL
 	}
 
-	return pair.Value
+	return value
+}
+
+// hashKey returns obj as a hash key, or an error naming the type that stops it being one
+func hashKey(obj object.Object) (object.Hashable, *object.Error) {
+	key, bad, ok := object.AsHashable(obj)
+	if !ok {
+		return nil, newError("unusable as hash key: %s", bad.Type())
+	}
+	return key, nil
 }
 
 func isTruthy(obj object.Object) bool {
@@ -259,11 +650,11 @@ func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	return FALSE
 }
 
-func evalProgram(program *ast.Program, env *object.Environment) object.Object {
+func (e *Evaluator) evalProgram(program *ast.Program, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, statement := range program.Statements {
-		result = Eval(statement, env)
+		result = e.Eval(statement, env)
 
 		switch result := result.(type) {
 		case *object.ReturnValue:
@@ -276,15 +667,15 @@ func evalProgram(program *ast.Program, env *object.Environment) object.Object {
 	return result
 }
 
-func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
+func (e *Evaluator) evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, statement := range block.Statements {
-		result = Eval(statement, env)
+		result = e.Eval(statement, env)
 
 		if result != nil {
 			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == object.BREAK_OBJ || rt == object.CONTINUE_OBJ {
 				return result
 			}
 		}
@@ -292,23 +683,354 @@ func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) obje
 	return result
 }
 
-func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
-	if val, ok := env.Get(node.Value); ok {
+// evalAssignExpression updates an existing variable, array element or hash entry. Compound
+// operators like += evaluate the target and its index only once
+func (e *Evaluator) evalAssignExpression(ae *ast.AssignExpression, env *object.Environment) object.Object {
+	switch target := ae.Target.(type) {
+	case *ast.Identifier:
+		var current object.Object
+		if ae.Operator != "=" {
+			current = e.evalIdentifier(target, env)
+			if isError(current) {
+				return current
+			}
+		}
+
+		val := e.evalAssignedValue(ae, current, env)
+		if isError(val) {
+			return val
+		}
+		if fn, ok := val.(*object.Function); ok && fn.Name == "" {
+			fn.Name = target.Value
+		}
+
+		if !env.Assign(target.Value, val) {
+			return newError("assignment to undeclared variable: %s", target.Value)
+		}
+		return val
+
+	case *ast.IndexExpression:
+		left := e.Eval(target.Left, env)
+		if isError(left) {
+			return left
+		}
+		index := e.Eval(target.Index, env)
+		if isError(index) {
+			return index
+		}
+
+		var current object.Object
+		if ae.Operator != "=" {
+			current = evalIndexExpression(left, index)
+			if isError(current) {
+				return current
+			}
+		}
+
+		val := e.evalAssignedValue(ae, current, env)
+		if isError(val) {
+			return val
+		}
+
+		result := evalIndexAssignment(left, index, val)
+		if err := e.checkSize(left); err != nil {
+			return err // assigning a new key can grow a hash past its limit
+		}
+		return result
+
+	default:
+		return newError("cannot assign to %s", ae.Target.String())
+	}
+}
+
+// evalAssignedValue evaluates the right hand side of an assignment, combining it with
+// the target's current value for compound operators
+func (e *Evaluator) evalAssignedValue(ae *ast.AssignExpression, current object.Object, env *object.Environment) object.Object {
+	val := e.Eval(ae.Value, env)
+	if isError(val) || ae.Operator == "=" {
+		return val
+	}
+
+	operator := strings.TrimSuffix(ae.Operator, "=")
+	return evalInfixExpression(operator, current, val)
+}
+
+func evalIndexAssignment(left, index, val object.Object) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			return newError("array index must be INTEGER, got %s", index.Type())
+		}
+		if idx.Value < 0 || idx.Value >= int64(len(left.Elements)) {
+			return newError("array index out of range: %d", idx.Value)
+		}
+		left.Elements[idx.Value] = val
+		return val
+
+	case *object.Hash:
+		key, err := hashKey(index)
+		if err != nil {
+			return err
+		}
+		left.Set(key, val)
+		return val
+
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
+}
+
+func (e *Evaluator) evalWhileStatement(ws *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		if err := e.checkContext(); err != nil {
+			return err
+		}
+
+		condition := e.Eval(ws.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return nil
+		}
+
+		result := e.Eval(ws.Body, env)
+		if stop, value := loopControl(result); stop {
+			return value
+		}
+	}
+}
+
+// evalForStatement runs the body once per element of an array, key of a hash, character
+// of a string or integer in a range. Each iteration gets its own environment holding the
+// loop variable, so closures created in the body capture that iteration's value
+func (e *Evaluator) evalForStatement(fs *ast.ForStatement, env *object.Environment) object.Object {
+	iterable := e.Eval(fs.Iterable, env)
+	if isError(iterable) {
+		return iterable
+	}
+
+	iterate := func(value object.Object) (bool, object.Object) {
+		if err := e.checkContext(); err != nil {
+			return true, err
+		}
+
+		loopEnv := object.NewEnclosedEnvironment(env)
+		loopEnv.Set(fs.Variable.Value, value)
+		return loopControl(e.Eval(fs.Body, loopEnv))
+	}
+
+	switch iterable := iterable.(type) {
+	case *object.Array:
+		for i := 0; i < len(iterable.Elements); i++ {
+			if stop, value := iterate(iterable.Elements[i]); stop {
+				return value
+			}
+		}
+	case *object.Hash:
+		for _, pair := range iterable.Ordered() {
+			if stop, value := iterate(pair.Key); stop {
+				return value
+			}
+		}
+	case *object.String:
+		for _, ch := range iterable.Value {
+			if stop, value := iterate(&object.String{Value: string(ch)}); stop {
+				return value
+			}
+		}
+	case *object.Range:
+		for i := iterable.Start; i < iterable.End; i++ {
+			if stop, value := iterate(&object.Integer{Value: i}); stop {
+				return value
+			}
+		}
+	default:
+		return newError("cannot iterate over %s", iterable.Type())
+	}
+
+	return nil
+}
+
+// evalTryStatement runs the try block, then the catch block if it failed, then the finally
+// block whatever happened. A finally block that itself returns, fails or leaves a loop
+// overrides the outcome of the others
+func (e *Evaluator) evalTryStatement(ts *ast.TryStatement, env *object.Environment) object.Object {
+	result := e.Eval(ts.Block, env)
+
+	err, failed := result.(*object.Error)
+	if failed && !isCatchable(err) {
+		return err // skipping finally too, so a script can't outlive its deadline
+	}
+
+	if failed && ts.Catch != nil {
+		catchEnv := object.NewEnclosedEnvironment(env)
+		if ts.Param != nil {
+			catchEnv.Set(ts.Param.Value, errorToHash(err))
+		}
+		result = e.Eval(ts.Catch, catchEnv)
+	}
+
+	if ts.Finally != nil {
+		if err, ok := result.(*object.Error); ok && !isCatchable(err) {
+			return err
+		}
+
+		finally := e.Eval(ts.Finally, env)
+		if finally != nil {
+			switch finally.Type() {
+			case object.RETURN_VALUE_OBJ, object.ERROR_OBJ, object.BREAK_OBJ, object.CONTINUE_OBJ:
+				return finally
+			}
+		}
+	}
+
+	return result
+}
+
+// isCatchable reports whether try can handle err. Errors from a cancelled context
+// can't be caught, or a script could ignore its host's deadline
+func isCatchable(err *object.Error) bool {
+	return !errors.Is(err.Cause, context.Canceled) && !errors.Is(err.Cause, context.DeadlineExceeded)
+}
+
+// evalThrowStatement raises any value as an error. Throwing a hash sets the
+// error's message and type from its "message" and "type" keys, so a caught
+// error can be thrown again unchanged
+func (e *Evaluator) evalThrowStatement(ts *ast.ThrowStatement, env *object.Environment) object.Object {
+	val := e.Eval(ts.Value, env)
+	if isError(val) {
 		return val
 	}
+	return thrownError(val)
+}
+
+// thrownError is the error raised by throwing val
+func thrownError(val object.Object) *object.Error {
+	err := &object.Error{Message: val.Inspect(), Kind: "Error", Value: val}
+	if hash, ok := val.(*object.Hash); ok {
+		if message, ok := hashLookup(hash, "message"); ok {
+			err.Message = message.Inspect()
+		}
+		if kind, ok := hashLookup(hash, "type"); ok {
+			if str, ok := kind.(*object.String); ok {
+				err.Kind = str.Value
+			}
+		}
+	}
+	return err
+}
 
-	if builtin, ok := builtins[node.Value]; ok {
-		return builtin
+// errorToHash is what a catch block sees: a hash holding the error's message,
+// type, position and stack. If a hash was thrown its other keys are kept, and
+// any other thrown value is available as "value"
+func errorToHash(err *object.Error) *object.Hash {
+	hash := &object.Hash{}
+	set := func(key string, value object.Object) {
+		hash.Set(&object.String{Value: key}, value)
+	}
+
+	switch thrown := err.Value.(type) {
+	case nil:
+	case *object.Hash:
+		for _, pair := range thrown.Ordered() {
+			hash.Set(pair.Key.(object.Hashable), pair.Value)
+		}
+	default:
+		set("value", thrown)
+	}
+
+	set("message", &object.String{Value: err.Message})
+	set("type", &object.String{Value: err.ErrorType()})
+
+	if err.Span.Pos.IsValid() {
+		set("position", &object.String{Value: err.Span.Pos.String()})
+	} else {
+		set("position", NULL)
+	}
+
+	stack := []object.Object{}
+	if err.Span.Pos.IsValid() {
+		for _, line := range err.Traceback() {
+			stack = append(stack, &object.String{Value: line})
+		}
+	}
+	set("stack", &object.Array{Elements: stack})
+
+	return hash
+}
+
+// hashLookup gets the value stored under a string key in hash
+func hashLookup(hash *object.Hash, key string) (object.Object, bool) {
+	return hash.Get(&object.String{Value: key})
+}
+
+// loopControl interprets the result of one run of a loop body. It reports whether the
+// loop should stop and, if so, what the loop statement itself evaluates to -
+// nothing for a break, the return value or error for anything that has to keep propagating
+func loopControl(result object.Object) (bool, object.Object) {
+	if result == nil {
+		return false, nil
+	}
+
+	switch result.Type() {
+	case object.BREAK_OBJ:
+		return true, nil
+	case object.RETURN_VALUE_OBJ, object.ERROR_OBJ:
+		return true, result
+	}
+	return false, nil
+}
+
+func (e *Evaluator) evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
+	if val, ok := e.Lookup(node.Value, env); ok {
+		return val
 	}
 
 	return newError("identifier not found: " + node.Value)
 }
 
-func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
+// Lookup resolves name the way an identifier in Farcical code would: variables first, then builtins
+func (e *Evaluator) Lookup(name string, env *object.Environment) (object.Object, bool) {
+	if val, ok := env.Get(name); ok {
+		return val, true
+	}
+
+	if builtin, ok := e.builtins[name]; ok {
+		return builtin, true
+	}
+
+	return nil, false
+}
+
+func (e *Evaluator) evalMemberExpression(node *ast.MemberExpression, env *object.Environment) object.Object {
+	obj := e.Eval(node.Object, env)
+	if isError(obj) {
+		return obj
+	}
+	return evalMember(obj, node.Property.Value)
+}
+
+// evalMember gets the member called name from obj, which has to be a namespace
+func evalMember(obj object.Object, name string) object.Object {
+	ns, ok := obj.(*object.Namespace)
+	if !ok {
+		return newError("member access not supported: %s", obj.Type())
+	}
+
+	member, ok := ns.Members[name]
+	if !ok {
+		return newError("identifier not found: %s.%s", ns.Name, name)
+	}
+	return member
+}
+
+func (e *Evaluator) evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
 	var result []object.Object
 
-	for _, e := range exps {
-		evaluated := Eval(e, env)
+	for _, exp := range exps {
+		evaluated := e.Eval(exp, env)
 		if isError(evaluated) {
 			return []object.Object{evaluated}
 		}
@@ -317,28 +1039,127 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 	return result
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+// Call applies a function or builtin to args, for Go code calling into Farcical
+func (e *Evaluator) Call(fn object.Object, args ...object.Object) (result object.Object) {
+	// a builtin called straight from Go isn't inside any Eval to recover its panics
+	defer func() {
+		if r := recover(); r != nil {
+			result = e.panicError(nil, r)
+		}
+	}()
+
+	return e.applyFunction(fn, args, nil)
+}
+
+// CallContext is Call that gives up once ctx is done, like EvalContext
+func (e *Evaluator) CallContext(ctx context.Context, fn object.Object, args ...object.Object) object.Object {
+	prev := e.ctx
+	e.ctx = ctx
+	defer func() { e.ctx = prev }()
+
+	return e.Call(fn, args...)
+}
+
+// applyFunction calls fn, recording call as the call site on the stack; call is nil when called from Go
+func (e *Evaluator) applyFunction(fn object.Object, args []object.Object, call *ast.CallExpression) object.Object {
+	if err := e.checkContext(); err != nil {
+		return err
+	}
+
 	switch fn := fn.(type) {
 	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
+		if err := e.checkDepth(); err != nil {
+			return err
+		}
+
+		name := fn.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+		frame := object.Frame{Function: name}
+		if call != nil {
+			frame.CallSite = diag.Span{Pos: call.Pos(), End: call.End()}
+		}
+		e.frames = append(e.frames, frame)
+		defer func() { e.frames = e.frames[:len(e.frames)-1] }()
+
+		extendedEnv, err := e.extendFunctionEnv(fn, name, args)
+		if err != nil {
+			return err
+		}
+		evaluated := e.Eval(fn.Body, extendedEnv)
 		return unwrapReturnValue(evaluated)
 	case *object.Builtin:
-		return fn.Fn(args...)
+		return fn.Fn(e, args...)
 	default:
 		return newError("not a function: %s", fn.Type())
 	}
 
 }
 
-func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Environment {
+// extendFunctionEnv binds args to the parameters of fn in a new environment enclosed by the one
+// fn was defined in. Missing arguments take their defaults, which are evaluated in the new
+// environment so they can refer to earlier parameters, and extra ones are collected by ...rest
+func (e *Evaluator) extendFunctionEnv(fn *object.Function, name string, args []object.Object) (*object.Environment, object.Object) {
+	required := 0
+	for i := range fn.Parameters {
+		if i >= len(fn.Defaults) || fn.Defaults[i] == nil {
+			required++
+		}
+	}
+	if err := checkArity(name, len(args), required, len(fn.Parameters), fn.Rest != nil); err != nil {
+		return nil, err
+	}
+
 	env := object.NewEnclosedEnvironment(fn.Env)
 
 	// bind the function call arguments to the function parameter names
 	for paramIdx, param := range fn.Parameters {
-		env.Set(param.Value, args[paramIdx])
+		if paramIdx < len(args) {
+			env.Set(param.Value, args[paramIdx])
+			continue
+		}
+
+		val := e.Eval(fn.Defaults[paramIdx], env)
+		if isError(val) {
+			return nil, val
+		}
+		env.Set(param.Value, val)
+	}
+
+	if fn.Rest != nil {
+		rest := []object.Object{}
+		if len(args) > len(fn.Parameters) {
+			rest = append(rest, args[len(fn.Parameters):]...)
+		}
+		env.Set(fn.Rest.Value, &object.Array{Elements: rest})
+	}
+
+	return env, nil
+}
+
+// checkArity returns an error if a function called name, taking between required and params
+// arguments or more if it is variadic, can't be called with got of them
+func checkArity(name string, got, required, params int, variadic bool) *object.Error {
+	if got < required || (!variadic && got > params) {
+		return newError("wrong number of arguments to %s, got=%d, want=%s",
+			name, got, describeArity(required, params, variadic))
+	}
+	return nil
+}
+
+// describeArity words the number of arguments a function accepts for error messages
+func describeArity(min, max int, variadic bool) string {
+	switch {
+	case variadic:
+		return fmt.Sprintf("at least %d", min)
+	case min == max:
+		return fmt.Sprintf("%d", min)
+	case max == min+1:
+		return fmt.Sprintf("%d or %d", min, max)
+	default:
+		return fmt.Sprintf("%d to %d", min, max)
 	}
-	return env
 }
 
 // unwrap the return value of the function call
@@ -350,30 +1171,29 @@ func unwrapReturnValue(obj object.Object) object.Object {
 	return obj
 }
 
-func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
-	pairs := make(map[object.HashKey]object.HashPair)
+func (e *Evaluator) evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
+	hash := &object.Hash{}
 
-	for keyNode, valueNode := range node.Pairs {
-		key := Eval(keyNode, env)
+	for _, keyNode := range node.Keys {
+		key := e.Eval(keyNode, env)
 		if isError(key) {
 			return key
 		}
 
-		hashKey, ok := key.(object.Hashable)
-		if !ok {
-			return newError("unusable as hash key: %s", key.Type())
+		hashed, err := hashKey(key)
+		if err != nil {
+			return err
 		}
 
-		value := Eval(valueNode, env)
+		value := e.Eval(node.Pairs[keyNode], env)
 		if isError(value) {
 			return value
 		}
 
-		hashed := hashKey.HashKey()
-		pairs[hashed] = object.HashPair{Key: key, Value: value}
+		hash.Set(hashed, value)
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return hash
 }
 
 func newError(format string, a ...interface{}) *object.Error {
@@ -1,11 +1,17 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
 	"farcical/lexer"
 	"farcical/object"
 	"farcical/parser"
 	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEvalIntegerExpression(t *testing.T) {
@@ -28,6 +34,9 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"2 + 10 % 4 * 3", 8},
 	}
 
 	for _, tt := range tests {
@@ -36,6 +45,46 @@ func TestEvalIntegerExpression(t *testing.T) {
 	}
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.5", 3.5},
+		{"-2.25", -2.25},
+		{"1.5 + 1.5", 3},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2},
+		{"7 / 2.0", 3.5},
+		{"10 - 2.5 * 2", 5},
+		{"1e3 / 4", 250},
+		{"-(1.5 + 1)", -2.5},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testFloatObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestFloatComparison(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"1.0 == 1", true},
+		{"0.1 + 0.2 == 0.3", false},
+		{"2.5 != 2.5", false},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -60,6 +109,36 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"2 >= 2", true},
+		{"1 >= 2", false},
+		{"1.5 >= 1", true},
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		{"!(1 < 2) || 3 >= 3", true},
+		{`"a" == "a"`, true},
+		{`"a" + "b" == "ab"`, true},
+		{`"a" != "b"`, true},
+		{`"1" == 1`, false},
+		{"1 == 1.0", true},
+		{"[1, [2, 3]] == [1, [2, 3]]", true},
+		{"[1, 2] == [2, 1]", false},
+		{"[1] == [1, 1]", false},
+		{"[1] == [1.0]", false},
+		{"[] != []", false},
+		{`{"a": 1, "b": [2]} == {"b": [2], "a": 1}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`{"a": 1} == {"b": 1}`, false},
+		{"let f = function() { 1 }; f == f", true},
+		{"function() { 1 } == function() { 1 }", false},
+		{"0..3 == 0..3", true},
+		{"let a = [1]; a[0] = a; let b = [1]; b[0] = b; a == b", true},
 	}
 
 	for _, tt := range tests {
@@ -87,6 +166,43 @@ func TestBangOperator(t *testing.T) {
 	}
 }
 
+func TestLogicalShortCircuit(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let called = false; let f = function() { called = true; true }; false && f(); called", false},
+		{"let called = false; let f = function() { called = true; true }; true || f(); called", false},
+		{"let called = false; let f = function() { called = true; true }; true && f(); called", true},
+		{"let called = false; let f = function() { called = true; true }; false || f(); called", true},
+		{"false && undefinedName", false},
+		{"true || 1 + true", true},
+		{"0 || 5", 0},
+		{`let name = if (false) { 1 }; name || 5`, 5},
+		{"1 && 2", 2},
+		{"true && 1 + true", "type mismatch: INTEGER + BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned, got %T(%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message, expected %q got %q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestIfElseExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -210,6 +326,144 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input     string
+		startLine int
+		startCol  int
+		endCol    int
+	}{
+		{"5 + true;", 1, 1, 9},
+		{"let a = 1;\nlet b = a + foobar;", 2, 13, 19},
+		{"let f = function(x) {\n  x - \"s\"\n};\nf(1)", 2, 3, 10},
+		{`len(1)`, 1, 1, 7},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned, got %T(%+v)", evaluated, evaluated)
+			continue
+		}
+
+		pos, end := errObj.Span.Pos, errObj.Span.End
+		if pos.Line != tt.startLine || pos.Column != tt.startCol || end.Column != tt.endCol {
+			t.Errorf("wrong error span for %q, expected %d:%d-%d got %d:%d-%d",
+				tt.input, tt.startLine, tt.startCol, tt.endCol, pos.Line, pos.Column, end.Column)
+		}
+	}
+}
+
+func TestErrorStackTrace(t *testing.T) {
+	input := `let add = function(a, b) {
+  a + b
+};
+let sum = function(xs) {
+  add(first(xs), last(xs))
+};
+sum([1, "two"])`
+
+	evaluated := testEval(input)
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned, got %T(%+v)", evaluated, evaluated)
+	}
+
+	expectedFrames := []struct {
+		function string
+		line     int
+	}{
+		{"sum", 7},
+		{"add", 5},
+	}
+
+	if len(errObj.Stack) != len(expectedFrames) {
+		t.Fatalf("wrong number of stack frames, expected=%d got=%d", len(expectedFrames), len(errObj.Stack))
+	}
+	for i, frame := range expectedFrames {
+		if errObj.Stack[i].Function != frame.function || errObj.Stack[i].CallSite.Pos.Line != frame.line {
+			t.Errorf("Stack[%d] wrong, expected %s at line %d got %s at line %d", i,
+				frame.function, frame.line, errObj.Stack[i].Function, errObj.Stack[i].CallSite.Pos.Line)
+		}
+	}
+
+	expected := `Traceback (most recent call last):
+  line 7, column 1, in <main>
+  line 5, column 3, in sum
+  line 2, column 3, in add
+ERROR: type mismatch: INTEGER + STRING`
+	if errObj.Inspect() != expected {
+		t.Errorf("wrong traceback, expected=\n%s\ngot=\n%s", expected, errObj.Inspect())
+	}
+}
+
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let sum = function(xs) { let total = 0; for (x in xs) { let total = total + x; } total }; sum([1, 2, 3])", 0},
+		{"let count = function(n) { let seen = []; for (i in 0..n) { let seen = push(seen, i); } seen }; len(count(5))", 0},
+		{"let f = function() { for (i in 0..10) { if (i > 3) { return i; } } }; f()", 4},
+		{"let f = function() { let out = 0; for (i in 0..10) { if (i == 2) { break; } return 99; } }; f()", 99},
+		{"let f = function() { for (i in 0..5) { if (i < 4) { continue; } return i; } }; f()", 4},
+		{"let f = function() { for (c in \"héllo\") { if (c == \"é\") { return 1; } } 0 }; f()", 1},
+		{"let f = function() { for (k in {\"only\": 1}) { return k; } }; f()", "only"},
+		{"let f = function() { while (true) { return 7; } }; f()", 7},
+		{"let f = function() { while (false) { return 7; } 8 }; f()", 8},
+		{"let f = function() { while (true) { break; } 9 }; f()", 9},
+		{"for (x in 5) { x }", "cannot iterate over INTEGER"},
+		{"for (x in [1, 2]) { x + true }", "type mismatch: INTEGER + BOOLEAN"},
+		{"while (1 + true) { 1 }", "type mismatch: INTEGER + BOOLEAN"},
+		{"1.5..3", "range bounds must be INTEGER, got FLOAT..INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			switch obj := evaluated.(type) {
+			case *object.Error:
+				if obj.Message != expected {
+					t.Errorf("wrong error message, expected=%q got=%q", expected, obj.Message)
+				}
+			case *object.String:
+				if obj.Value != expected {
+					t.Errorf("wrong string, expected=%q got=%q", expected, obj.Value)
+				}
+			default:
+				t.Errorf("unexpected result for %q, got %T (%+v)", tt.input, evaluated, evaluated)
+			}
+		}
+	}
+}
+
+func TestLoopVariableCapture(t *testing.T) {
+	input := `
+	let f = function() {
+		let fns = [];
+		for (i in 0..3) {
+			let fns = push(fns, function() { i });
+		}
+		fns
+	};
+	f()`
+
+	evaluated := testEval(input)
+	arr, ok := evaluated.(*object.Array)
+	if !ok {
+		t.Fatalf("object is not an array, got %T (%+v)", evaluated, evaluated)
+	}
+	// let inside the body is scoped to the iteration, so fns is never extended outside it
+	if len(arr.Elements) != 0 {
+		t.Fatalf("expected the outer array to be untouched, got %d elements", len(arr.Elements))
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -226,6 +480,80 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = 5; a = 10; a;", 10},
+		{"let a = 5; a = a + 1;", 6},
+		{"let a = 5; a += 2; a -= 1; a *= 3; a /= 2; a %= 5; a;", 4},
+		{"let a = 1; let b = 1; a = b = 7; a + b;", 14},
+		{"let a = 1.5; a += 1; a;", 2.5},
+		{"let counter = function() { let n = 0; function() { n += 1; n } }; let c = counter(); c(); c(); c();", 3},
+		{"let total = 0; for (x in [1, 2, 3]) { total += x; } total;", 6},
+		{"let i = 0; while (i < 10) { i += 1; if (i == 4) { break; } } i;", 4},
+		{"let arr = [1, 2, 3]; arr[0] = 5; arr[0] + arr[1];", 7},
+		{"let arr = [1, 2, 3]; arr[2] *= 10; arr[2];", 30},
+		{`let h = {"k": 1}; h["k"] += 1; h["k"];`, 2},
+		{`let h = {}; h["new"] = 3; h["new"];`, 3},
+		{"let grid = [[0, 0], [0, 0]]; grid[1][0] = 9; grid[1][0];", 9},
+		{"b = 5;", "assignment to undeclared variable: b"},
+		{"let f = function() { undeclared = 1 }; f();", "assignment to undeclared variable: undeclared"},
+		{"let arr = [1]; arr[3] = 1;", "array index out of range: 3"},
+		{`let arr = [1]; arr["x"] = 1;`, "array index must be INTEGER, got STRING"},
+		{`let s = "str"; s[0] = "x";`, "index assignment not supported: STRING"},
+		{`let a = "x"; a -= 1;`, "type mismatch: STRING - INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			testFloatObject(t, evaluated, expected)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned for %q, got %T(%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message, expected %q got %q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestSelfContainingCollections(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let a = [0]; a[0] = a; a", "[[...]]"},
+		{`let h = {"k": 1}; h["self"] = h; h`, "{k: 1, self: {...}}"},
+		{`let a = [1]; let h = {"a": a}; a[0] = h; [a, h]`, "[[{a: [...]}], {a: [{...}]}]"},
+		{"let b = [1]; [b, b]", "[[1], [1]]"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+
+	var stdout strings.Builder
+	e := New()
+	e.Stdout = &stdout
+	program := parser.New(lexer.New("let a = [0]; a[0] = a; print(a)")).ParseProgram()
+	e.Eval(program, object.NewEnvironment())
+	if stdout.String() != "[[...]] \n" {
+		t.Errorf("wrong output printing an array containing itself, got=%q", stdout.String())
+	}
+}
+
 func TestFunctionObject(t *testing.T) {
 	input := "function(x) { x + 2; };"
 
@@ -264,6 +592,53 @@ func TestFunctionApplication(t *testing.T) {
 	}
 }
 
+func TestFunctionArguments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let f = function(a, b = 10) { a + b }; f(1)", 11},
+		{"let f = function(a, b = 10) { a + b }; f(1, 2)", 3},
+		{"let f = function(a, b = a * 2) { a + b }; f(4)", 12},
+		{"let n = 0; let next = function() { n += 1 }; let f = function(a = next()) { a }; f(); f(5); f(); n", 2},
+		{"let f = function(first, ...rest) { len(rest) }; f(1)", 0},
+		{"let f = function(first, ...rest) { rest[1] }; f(1, 2, 3)", 3},
+		{"let f = function(...all) { len(all) }; f(1, 2, 3, 4)", 4},
+		{"let f = function(a, b) { a }; f(1)", "wrong number of arguments to f, got=1, want=2"},
+		{"let f = function(a) { a }; f(1, 2)", "wrong number of arguments to f, got=2, want=1"},
+		{"let f = function(a, b = 1) { a }; f()", "wrong number of arguments to f, got=0, want=1 or 2"},
+		{"let f = function(a, b = 1, c = 2) { a }; f(1, 2, 3, 4)", "wrong number of arguments to f, got=4, want=1 to 3"},
+		{"let f = function(a, ...r) { a }; f()", "wrong number of arguments to f, got=0, want=at least 1"},
+		{"function() { 1 }(1)", "wrong number of arguments to <anonymous>, got=1, want=0"},
+		{"let f = function(a = b) { a }; f()", "identifier not found: b"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("%q: expected an error, got %T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message, expected=%q got=%q", expected, errObj.Message)
+			}
+		}
+	}
+
+	fn, ok := testEval("function(a, b = 2, ...c) { a }").(*object.Function)
+	if !ok {
+		t.Fatalf("expected a function")
+	}
+	if expected := "fn(a, b = 2, ...c) {\na\n}"; fn.Inspect() != expected {
+		t.Errorf("wrong Inspect, expected=%q got=%q", expected, fn.Inspect())
+	}
+}
+
 func TestClosures(t *testing.T) {
 	input := `
 	let newAdder = function(x) {
@@ -312,8 +687,23 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
+		{`len("héllo, 世界")`, 9},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments, got=2 want=1"},
+		{`int(3.99)`, 3},
+		{`int(-3.99)`, -3},
+		{`int("42")`, 42},
+		{`int("abc")`, `could not parse "abc" as integer`},
+		{`int(0.0 / 0.0)`, "float NaN out of integer range"},
+		{`float(2)`, 2.0},
+		{`float("2.5")`, 2.5},
+		{`round(2.5)`, 3},
+		{`round(-2.4)`, -2},
+		{`round(3.14159, 2)`, 3.14},
+		{`round(7)`, 7},
+		{`floor(2.7)`, 2},
+		{`floor(-2.1)`, -3},
+		{`floor("x")`, "argument to `floor` not supported, got STRING"},
 	}
 
 	for _, tt := range tests {
@@ -321,6 +711,8 @@ func TestBuiltinFunctions(t *testing.T) {
 		switch expected := tt.expected.(type) {
 		case int:
 			testIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			testFloatObject(t, evaluated, expected)
 		case string:
 			errObj, ok := evaluated.(*object.Error)
 			if !ok {
@@ -334,6 +726,778 @@ func TestBuiltinFunctions(t *testing.T) {
 	}
 }
 
+func TestStringBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`split("a,b,,c", ",")`, []string{"a", "b", "", "c"}},
+		{`split("  one two\tthree ")`, []string{"one", "two", "three"}},
+		{`split("añb", "")`, []string{"a", "ñ", "b"}},
+		{`join(["a", "b", "c"], ", ")`, "a, b, c"},
+		{`join(["x", "y"])`, "xy"},
+		{`join([], "-")`, ""},
+		{`join(["a", 1])`, "elements joined by `join` must be STRING, got INTEGER"},
+		{`join("ab", "")`, "first argument to `join` must be ARRAY, got STRING"},
+		{`trim("  hi \n")`, "hi"},
+		{`upper("ÿé")`, "ŸÉ"},
+		{`lower("ÀB")`, "àb"},
+		{`upper(1)`, "argument to `upper` must be STRING, got INTEGER"},
+		{`replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`replace("a-b-c", "-", "+", 1)`, "a+b-c"},
+		{`replace("abc", "b", 2)`, "third argument to `replace` must be STRING, got INTEGER"},
+		{`contains("farcical", "cic")`, true},
+		{`contains("farcical", "x")`, false},
+		{`startsWith("farcical", "far")`, true},
+		{`endsWith("farcical", "far")`, false},
+		{`indexOf("日本語", "語")`, 2},
+		{`indexOf("abc", "z")`, -1},
+		{`repeat("ab", 3)`, "ababab"},
+		{`repeat("ab", 0)`, ""},
+		{`repeat("ab", -1)`, "repeat count must not be negative, got -1"},
+		{`repeat("ab", 9223372036854775807)`, "repeated string too long"},
+		{`substr("héllo", 1, 3)`, "él"},
+		{`substr("héllo", 3)`, "lo"},
+		{`substr("héllo", -5, 99)`, "héllo"},
+		{`substr("héllo", 4, 2)`, ""},
+		{`chars("añ")`, []string{"a", "ñ"}},
+		{`chars("")`, []string{}},
+		{`format("{} + {} = {}", 1, 2.5, "x")`, "1 + 2.5 = x"},
+		{`format("{1}{0}{1}", "a", "b")`, "bab"},
+		{`format("{{}} {}", [1, 2])`, "{} [1, 2]"},
+		{`format("{} {}", 1)`, "not enough arguments for format string, got=1"},
+		{`format("{x}", 1)`, "invalid format field {x}"},
+		{`format("{", 1)`, "unmatched { in format string at 0"},
+		{`format()`, "wrong number of arguments, got=0, want=at least 1"},
+		{`contains("a")`, "wrong number of arguments, got=1, want=2"},
+		{`split()`, "wrong number of arguments, got=0, want=1 or 2"},
+		{`"héllo"[1]`, "é"},
+		{`"héllo"[5]`, nil},
+		{`"héllo"[-1]`, nil},
+		{`"héllo"[1..3]`, "él"},
+		{`"héllo"[3..10]`, "lo"},
+		{`"abc"["a"]`, "string index must be INTEGER or RANGE, got STRING"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if errObj, ok := evaluated.(*object.Error); ok {
+			if errObj.Message != tt.expected {
+				t.Errorf("%s: wrong error, expected=%v got=%q", tt.input, tt.expected, errObj.Message)
+			}
+			continue
+		}
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok || str.Value != expected {
+				t.Errorf("%s: expected %q, got %T (%+v)", tt.input, expected, evaluated, evaluated)
+			}
+		case []string:
+			arr, ok := evaluated.(*object.Array)
+			if !ok || len(arr.Elements) != len(expected) {
+				t.Errorf("%s: expected %q, got %T (%+v)", tt.input, expected, evaluated, evaluated)
+				continue
+			}
+			for i, el := range arr.Elements {
+				if str, ok := el.(*object.String); !ok || str.Value != expected[i] {
+					t.Errorf("%s: element %d expected %q, got %+v", tt.input, i, expected[i], el)
+				}
+			}
+		}
+	}
+
+	e := New()
+	e.Limits.MaxStringLength = 100
+	program := parser.New(lexer.New(`repeat("abc", 1000000000)`)).ParseProgram()
+	if errObj, ok := e.Eval(program, object.NewEnvironment()).(*object.Error); !ok || errObj.Kind != "LimitError" {
+		t.Errorf("repeat not bounded by MaxStringLength, got %+v", errObj)
+	}
+}
+
+func TestArrayBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`map([1, 2, 3], function(x) { x * x })`, "[1, 4, 9]"},
+		{`map([], function(x) { x })`, "[]"},
+		{`map(["a", "b"], upper)`, "[A, B]"},
+		{`filter([1, 2, 3, 4], function(x) { x % 2 == 0 })`, "[2, 4]"},
+		{`reduce([1, 2, 3, 4], function(acc, x) { acc + x })`, "10"},
+		{`reduce([1, 2], function(acc, x) { acc + x }, 10)`, "13"},
+		{`reduce([], function(acc, x) { acc + x }, 0)`, "0"},
+		{`let total = 0; each([1, 2, 3], function(x) { total += x }); total`, "6"},
+		{`any([1, 2, 3], function(x) { x > 2 })`, "true"},
+		{`any([], function(x) { true })`, "false"},
+		{`any([false, 0])`, "true"},
+		{`any([false, if (false) { 1 }])`, "false"},
+		{`all([1, 2, 3], function(x) { x > 0 })`, "true"},
+		{`all([1, 2, 3], function(x) { x > 1 })`, "false"},
+		{`all([])`, "true"},
+		{`find([1, 2, 3, 4], function(x) { x > 2 })`, "3"},
+		{`find([1, 2], function(x) { x > 2 })`, "null"},
+		{`sort([3, 1.5, 2])`, "[1.5, 2, 3]"},
+		{`sort(["pear", "apple", "fig"])`, "[apple, fig, pear]"},
+		{`sortBy(["ccc", "a", "bb", "d"], len)`, "[a, d, bb, ccc]"},
+		{`sortBy([3, 1, 2], function(x) { -x })`, "[3, 2, 1]"},
+		{`zip([1, 2, 3], ["a", "b"])`, "[[1, a], [2, b]]"},
+		{`zip([1], [2], [3])`, "[[1, 2, 3]]"},
+		{`flatten([1, [2, [3, [4]]], []])`, "[1, 2, [3, [4]]]"},
+		{`flatten([1, [2, [3, [4]]]], 2)`, "[1, 2, 3, [4]]"},
+		{`flatten([1, [2, [3, [4]]]], 0)`, "[1, [2, [3, [4]]]]"},
+		{`range(4)`, "[0, 1, 2, 3]"},
+		{`range(2, 5)`, "[2, 3, 4]"},
+		{`range(10, 0, -3)`, "[10, 7, 4, 1]"},
+		{`range(5, 2)`, "[]"},
+		{`range(-9223372036854775807, 9223372036854775807)`, "range too long"},
+
+		{`map([1, 2], function(x) { x + true })`, "type mismatch: INTEGER + BOOLEAN"},
+		{`map([1, 2], function(a, b) { a })`, "wrong number of arguments to <anonymous>, got=1, want=2"},
+		{`map([1], 1)`, "second argument to `map` must be FUNCTION, got INTEGER"},
+		{`filter("abc", len)`, "first argument to `filter` must be ARRAY, got STRING"},
+		{`reduce([], function(acc, x) { acc })`, "reduce of empty array with no initial value"},
+		{`sort([1, "a"])`, "cannot compare STRING and INTEGER"},
+		{`sortBy([1, 2], function(x) { if (false) { 1 } })`, "cannot compare NULL and NULL"},
+		{`zip([1])`, "wrong number of arguments, got=1, want=at least 2"},
+		{`zip([1], "a")`, "arguments to `zip` must be ARRAY, got STRING"},
+		{`let a = [1]; a[0] = a; flatten(a, 100000000)`, "cannot flatten an array that contains itself"},
+		{`let a = [1]; let b = [a, a]; flatten(b, 5)`, "[1, 1]"},
+		{`range(1, 2, 0)`, "range step must not be zero"},
+		{`range(1.5)`, "argument to `range` must be INTEGER, got FLOAT"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if errObj, ok := evaluated.(*object.Error); ok {
+			if errObj.Message != tt.expected {
+				t.Errorf("%s: wrong error, expected=%q got=%q", tt.input, tt.expected, errObj.Message)
+			}
+			continue
+		}
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+
+	// callbacks count towards the limits, and are stopped by the context
+	e := New()
+	e.Limits = Limits{MaxSteps: 1000, MaxArrayLength: 100}
+	for _, input := range []string{
+		`map(range(100), function(x) { let i = 0; while (i < 100) { i += 1 } })`,
+		`range(1000)`,
+	} {
+		program := parser.New(lexer.New(input)).ParseProgram()
+		if errObj, ok := e.Eval(program, object.NewEnvironment()).(*object.Error); !ok || errObj.Kind != "LimitError" {
+			t.Errorf("%s: expected a limit error, got %+v", input, errObj)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	program := parser.New(lexer.New(`each([1], function(x) { x })`)).ParseProgram()
+	if errObj, ok := New().EvalContext(ctx, program, object.NewEnvironment()).(*object.Error); !ok || !errors.Is(errObj.Cause, context.Canceled) {
+		t.Errorf("callback not stopped by the context, got %+v", errObj)
+	}
+}
+
+func TestHashBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"b": 1, "a": 2, 3: 3, true: 4}`, "{b: 1, a: 2, 3: 3, true: 4}"},
+		{`let h = {"b": 1, "a": 2}; h["c"] = 3; h["b"] = 4; h`, "{b: 4, a: 2, c: 3}"},
+		{`let out = []; for (k in {"z": 1, "y": 2, "x": 3}) { out = push(out, k) }; out`, "[z, y, x]"},
+		{`len({"a": 1, "b": 2})`, "2"},
+		{`len({})`, "0"},
+		{`keys({"b": 1, "a": 2})`, "[b, a]"},
+		{`values({"b": 1, "a": 2})`, "[1, 2]"},
+		{`items({"b": 1, "a": 2})`, "[[b, 1], [a, 2]]"},
+		{`has({"a": 1}, "a")`, "true"},
+		{`has({"a": 1}, "b")`, "false"},
+		{`has({1: 1}, 1.0)`, "false"},
+		{`delete({"a": 1, "b": 2, "c": 3}, "b")`, "{a: 1, c: 3}"},
+		{`delete({"a": 1}, "z")`, "{a: 1}"},
+		{`let h = {"a": 1}; delete(h, "a"); h`, "{a: 1}"},
+		{`let h = delete({"a": 1, "b": 2}, "a"); h["a"] = 3; h`, "{b: 2, a: 3}"},
+		{`merge({"a": 1, "b": 2}, {"c": 3, "a": 4})`, "{a: 4, b: 2, c: 3}"},
+		{`let h = {"a": 1}; merge(h, {"a": 2}); h`, "{a: 1}"},
+		{`merge({})`, "{}"},
+
+		{`keys([1])`, "argument to `keys` must be HASH, got ARRAY"},
+		{`has({}, [1, {}])`, "unusable as hash key: HASH"},
+		{`delete([], 1)`, "first argument to `delete` must be HASH, got ARRAY"},
+		{`merge({}, 1)`, "arguments to `merge` must be HASH, got INTEGER"},
+		{`merge()`, "wrong number of arguments, got=0, want=at least 1"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if errObj, ok := evaluated.(*object.Error); ok {
+			if errObj.Message != tt.expected {
+				t.Errorf("%s: wrong error, expected=%q got=%q", tt.input, tt.expected, errObj.Message)
+			}
+			continue
+		}
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestArrayHashKeys(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let h = {[1, 2]: "a", [2, 1]: "b"}; h[[1, 2]]`, "a"},
+		{`let h = {[1, [2]]: "a"}; h[[1, [2]]]`, "a"},
+		{`let h = {}; h[[1, 2]] = "a"; h[[1, 2]] = "b"; h`, "{[1, 2]: b}"},
+		{`let k = [1]; let h = {k: "a"}; k[0] = 2; [h[[1]], h[[2]]]`, "[a, null]"},
+		{`let k = [1]; let h = {k: "a"}; keys(h)[0][0] = 2; h[[1]]`, "a"},
+		{`has({["x", true]: 1}, ["x", true])`, "true"},
+		{`delete({[1]: 1, [2]: 2}, [1])`, "{[2]: 2}"},
+		{`{[1, {}]: 1}`, "unusable as hash key: HASH"},
+		{`let h = {}; h[[function() {}]] = 1`, "unusable as hash key: FUNCTION"},
+		{`let a = [0]; a[0] = a; {a: 1}`, "unusable as hash key: ARRAY"},
+		{`let a = [0]; a[0] = [1, a]; has({}, a)`, "unusable as hash key: ARRAY"},
+		{`let b = [1]; let h = {[b, b]: "a"}; h[[[1], [1]]]`, "a"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if errObj, ok := evaluated.(*object.Error); ok {
+			if errObj.Message != tt.expected {
+				t.Errorf("%s: wrong error, expected=%q got=%q", tt.input, tt.expected, errObj.Message)
+			}
+			continue
+		}
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestBuiltinRegistry(t *testing.T) {
+	e := New()
+	e.RegisterBuiltin("double", func(rt object.Runtime, args ...object.Object) object.Object {
+		return &object.Integer{Value: args[0].(*object.Integer).Value * 2}
+	})
+	e.RegisterBuiltin("str.shout", func(rt object.Runtime, args ...object.Object) object.Object {
+		return &object.String{Value: args[0].(*object.String).Value + "!"}
+	})
+	e.RegisterBuiltin("twice", func(rt object.Runtime, args ...object.Object) object.Object {
+		once := rt.Call(args[0], args[1])
+		if isError(once) {
+			return once
+		}
+		return rt.Call(args[0], once)
+	})
+	e.UnregisterBuiltin("len")
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`double(21)`, 42},
+		{`str.shout("hey")`, "hey!"},
+		{`twice(function(x) { x + 1 }, 1)`, 3},
+		{`twice(double, 5)`, 20},
+		{`twice(function(x) { x / 0 }, 1)`, "division by zero"},
+		{`let s = str; s.shout("ho")`, "ho!"},
+		{`let str = 1; str`, 1},
+		{`len("abc")`, "identifier not found: len"},
+		{`str.whisper("hey")`, "identifier not found: str.whisper"},
+		{`first.x`, "member access not supported: BUILTIN"},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated := e.Eval(program, object.NewEnvironment())
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if errObj, ok := evaluated.(*object.Error); ok {
+				if errObj.Message != expected {
+					t.Errorf("wrong error message, expected=%q got=%q", expected, errObj.Message)
+				}
+				continue
+			}
+			str, ok := evaluated.(*object.String)
+			if !ok || str.Value != expected {
+				t.Errorf("%q: expected %q, got %T (%+v)", tt.input, expected, evaluated, evaluated)
+			}
+		}
+	}
+
+	// other evaluators keep the standard builtins
+	testIntegerObject(t, testEval(`len("abc")`), 3)
+	if errObj, ok := testEval(`double(1)`).(*object.Error); !ok || errObj.Message != "identifier not found: double" {
+		t.Errorf("builtin leaked into another evaluator, got %+v", testEval(`double(1)`))
+	}
+
+	e.UnregisterBuiltin("str.shout")
+	if _, ok := e.Lookup("str", object.NewEnvironment()); !ok {
+		t.Errorf("removing a member removed its namespace")
+	}
+	e.DisableIO()
+	if _, ok := e.Lookup("print", object.NewEnvironment()); ok {
+		t.Errorf("print survived DisableIO")
+	}
+}
+
+func TestIOBuiltins(t *testing.T) {
+	var stdout, stderr strings.Builder
+	e := New()
+	e.Stdin = strings.NewReader("Ada\r\nlast line")
+	e.Stdout = &stdout
+	e.Stderr = &stderr
+
+	input := `
+let name = input("name? ");
+print("hello", name, 1 + 1);
+eprint("warning:", [1]);
+[input(), input()]
+`
+	program := parser.New(lexer.New(input)).ParseProgram()
+	evaluated := e.Eval(program, object.NewEnvironment())
+
+	if stdout.String() != "name? hello Ada 2 \n" {
+		t.Errorf("wrong stdout, got=%q", stdout.String())
+	}
+	if stderr.String() != "warning: [1] \n" {
+		t.Errorf("wrong stderr, got=%q", stderr.String())
+	}
+
+	lines, ok := evaluated.(*object.Array)
+	if !ok || len(lines.Elements) != 2 {
+		t.Fatalf("expected an array of 2 lines, got %T (%+v)", evaluated, evaluated)
+	}
+	if str, ok := lines.Elements[0].(*object.String); !ok || str.Value != "last line" {
+		t.Errorf("wrong last line, got %+v", lines.Elements[0])
+	}
+	testNullObject(t, lines.Elements[1])
+}
+
+func TestEvalContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	tests := []struct {
+		ctx   context.Context
+		input string
+		cause error
+	}{
+		{cancelled, "while (true) { }", context.Canceled},
+		{cancelled, "for (i in 0..1000000000) { }", context.Canceled},
+		{cancelled, "let f = function() { 1 }; f()", context.Canceled},
+		{expired, "while (true) { }", context.DeadlineExceeded},
+		{expired, "let f = function(n) { if (n > 0) { f(n - 1) } }; while (true) { f(100) }", context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated := EvalContext(tt.ctx, program, object.NewEnvironment())
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%q: expected an error, got %T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Cause != tt.cause {
+			t.Errorf("%q: wrong cause, expected=%v got=%v", tt.input, tt.cause, errObj.Cause)
+		}
+		if errObj.Message != "evaluation stopped: "+tt.cause.Error() {
+			t.Errorf("%q: wrong message, got=%q", tt.input, errObj.Message)
+		}
+	}
+
+	// a live context doesn't change the result
+	program := parser.New(lexer.New("let x = 0; while (x < 10) { x += 1 }; x")).ParseProgram()
+	testIntegerObject(t, EvalContext(context.Background(), program, object.NewEnvironment()), 10)
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		limits Limits
+		input  string
+		limit  string
+	}{
+		{Limits{MaxSteps: 100}, "while (true) { }", "MaxSteps"},
+		{Limits{MaxDepth: 50}, "let f = function(n) { f(n + 1) }; f(0)", "MaxDepth"},
+		{Limits{MaxStringLength: 10}, `let s = "ab"; while (true) { s = s + s }`, "MaxStringLength"},
+		{Limits{MaxStringLength: 10}, `let s = "ab"; while (true) { s += s }`, "MaxStringLength"},
+		{Limits{MaxArrayLength: 3}, "[1, 2, 3, 4]", "MaxArrayLength"},
+		{Limits{MaxArrayLength: 3}, "let a = []; while (true) { a = push(a, 1) }", "MaxArrayLength"},
+		{Limits{MaxHashSize: 2}, `{"a": 1, "b": 2, "c": 3}`, "MaxHashSize"},
+		{Limits{MaxHashSize: 2}, "let h = {}; for (i in 0..10) { h[i] = i }", "MaxHashSize"},
+	}
+
+	for _, tt := range tests {
+		e := New()
+		e.Limits = tt.limits
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated := e.Eval(program, object.NewEnvironment())
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%q: expected an error, got %T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		limitErr, ok := errObj.Cause.(*LimitError)
+		if !ok || limitErr.Limit != tt.limit {
+			t.Errorf("%q: expected %s to be exceeded, got %q", tt.input, tt.limit, errObj.Message)
+		}
+		if !strings.Contains(errObj.Message, tt.limit) {
+			t.Errorf("%q: message doesn't name the limit: %q", tt.input, errObj.Message)
+		}
+	}
+
+	// within the limits, and the step budget is per evaluation rather than per evaluator
+	e := New()
+	e.Limits = Limits{MaxSteps: 200, MaxArrayLength: 3}
+	for i := 0; i < 3; i++ {
+		program := parser.New(lexer.New("let x = 0; while (x < 5) { x += 1 }; [x, x, x]")).ParseProgram()
+		evaluated := e.Eval(program, object.NewEnvironment())
+		if arr, ok := evaluated.(*object.Array); !ok || len(arr.Elements) != 3 {
+			t.Fatalf("run %d: expected an array, got %T (%+v)", i, evaluated, evaluated)
+		}
+	}
+}
+
+func TestDeepRecursion(t *testing.T) {
+	// the default depth limit stops runaway recursion before it overflows the Go stack
+	evaluated := testEval("let f = function(n) { f(n + 1) }; f(0)")
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("expected an error, got %T (%+v)", evaluated, evaluated)
+	}
+	if errObj.Message != "exceeded MaxDepth limit (10000)" {
+		t.Errorf("wrong error message, got=%q", errObj.Message)
+	}
+
+	testIntegerObject(t, testEval("let sum = function(n) { if (n == 0) { 0 } else { n + sum(n - 1) } }; sum(5000)"), 12502500)
+}
+
+func TestBigIntegers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"9223372036854775807 + 1", "9223372036854775808"},
+		{"-9223372036854775807 - 2", "-9223372036854775809"},
+		{"4611686018427387904 * 2", "9223372036854775808"},
+		{"let min = -9223372036854775807 - 1; min / -1", "9223372036854775808"},
+		{"let min = -9223372036854775807 - 1; -min", "9223372036854775808"},
+		{"99999999999999999999 * 99999999999999999999", "9999999999999999999800000000000000000001"},
+		{"-100000000000000000000 / 7", "-14285714285714285714"},
+		{"-100000000000000000000 % 7", "-2"},
+		{"let total = 0; for (i in 0..3) { total += 9223372036854775807 }; total", "27670116110564327421"},
+		{"let n = 1; for (i in 0..25) { n *= 10 }; n", "10000000000000000000000000"},
+		{"20000000000000000000 > 3", "true"},
+		{"-20000000000000000000 < -9223372036854775807", "true"},
+		{"20000000000000000000 == 20000000000000000000", "true"},
+		{"20000000000000000000 != 20000000000000000001", "true"},
+		{"10000000000000000000 * 2 == 20000000000000000000", "true"},
+		{"20000000000000000000 + 0.5", "2e+19"},
+		{"{20000000000000000000: \"big\"}[10000000000000000000 * 2]", "big"},
+		{"sort([20000000000000000000, 1, -20000000000000000000])", "[-20000000000000000000, 1, 20000000000000000000]"},
+		{`int("123456789012345678901234567890")`, "123456789012345678901234567890"},
+		{"int(1e30)", "1000000000000000019884624838656"},
+		{"float(20000000000000000000)", "2e+19"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if errObj, ok := evaluated.(*object.Error); ok {
+			t.Errorf("%s: unexpected error %q", tt.input, errObj.Message)
+			continue
+		}
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+
+	// results that fit in an int64 become Integers again
+	testIntegerObject(t, testEval("9223372036854775808 - 1"), 9223372036854775807)
+	testIntegerObject(t, testEval("-9223372036854775808"), -9223372036854775807-1)
+	testIntegerObject(t, testEval("100000000000000000000 / 100000000000000000000"), 1)
+
+	e := New()
+	e.Limits.MaxIntegerBits = 256
+	program := parser.New(lexer.New("let n = 3; while (true) { n = n * n }")).ParseProgram()
+	if errObj, ok := e.Eval(program, object.NewEnvironment()).(*object.Error); !ok || errObj.Message != "exceeded MaxIntegerBits limit (256)" {
+		t.Errorf("squaring not bounded by MaxIntegerBits, got %+v", errObj)
+	}
+}
+
+func TestIntegerArithmeticErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 / 0", "division by zero"},
+		{"5 % 0", "division by zero"},
+		{"let x = 1; x /= 0", "division by zero"},
+		{"9223372036854775808 / 0", "division by zero"},
+		{"9223372036854775808 % 0", "division by zero"},
+		{`9223372036854775808 + "a"`, "type mismatch: BIGINT + STRING"},
+		{"9223372036854775808..9223372036854775809", "range bounds must be INTEGER, got BIGINT..BIGINT"},
+		{"[1, 2][true]", "array index must be INTEGER, got BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%q: expected an error, got %T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error message, expected=%q got=%q", tt.expected, errObj.Message)
+		}
+	}
+
+	testIntegerObject(t, testEval("9223372036854775806 + 1"), 9223372036854775807)
+	testIntegerObject(t, testEval("-9223372036854775807 - 1"), -9223372036854775807-1)
+	testIntegerObject(t, testEval("-3037000499 * 3037000499"), -9223372030926249001)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	e := New()
+	e.RegisterBuiltin("explode", func(rt object.Runtime, args ...object.Object) object.Object {
+		var arr []object.Object
+		return arr[len(args)]
+	})
+
+	input := `let f = function() {
+  explode(1)
+};
+f()`
+	program := parser.New(lexer.New(input)).ParseProgram()
+	evaluated := e.Eval(program, object.NewEnvironment())
+
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("expected an error, got %T (%+v)", evaluated, evaluated)
+	}
+	if !strings.HasPrefix(errObj.Message, "internal error: runtime error: index out of range") {
+		t.Errorf("wrong error message, got=%q", errObj.Message)
+	}
+	if errObj.Cause == nil {
+		t.Errorf("the runtime error wasn't kept as the cause")
+	}
+	if errObj.Span.Pos.String() != "2:3" {
+		t.Errorf("wrong position, got=%s", errObj.Span.Pos)
+	}
+	if len(errObj.Stack) != 1 || errObj.Stack[0].Function != "f" {
+		t.Errorf("wrong stack, got=%+v", errObj.Stack)
+	}
+
+	// the evaluator is still usable, with its call stack unwound
+	testIntegerObject(t, e.Eval(parser.New(lexer.New("1 + 1")).ParseProgram(), object.NewEnvironment()), 2)
+	if len(e.frames) != 0 {
+		t.Errorf("frames left on the stack: %+v", e.frames)
+	}
+
+	explode, _ := e.Lookup("explode", object.NewEnvironment())
+	if errObj, ok := e.Call(explode).(*object.Error); !ok || !strings.HasPrefix(errObj.Message, "internal error") {
+		t.Errorf("panic from Call not recovered, got %+v", errObj)
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`try { int("abc") } catch (e) { e["message"] }`, `could not parse "abc" as integer`},
+		{`try { int("abc") } catch (e) { e["type"] }`, "RuntimeError"},
+		{`try { {}["missing"] + 1 } catch (e) { e["message"] }`, "type mismatch: NULL + INTEGER"},
+		{`try { 1 } catch (e) { 2 }`, 1},
+		{`try { throw "bad" } catch (e) { e["message"] + " " + e["type"] + " " + e["value"] }`, "bad Error bad"},
+		{`try { throw 42 } catch (e) { e["value"] }`, 42},
+		{`try { throw {"message": "no", "type": "ValidationError", "field": "age"} } catch (e) { e["type"] + ": " + e["message"] + " (" + e["field"] + ")" }`, "ValidationError: no (age)"},
+		{`try { try { throw {"type": "A"} } catch (e) { throw e } } catch (e) { e["type"] }`, "A"},
+		{"try { 1 / 0 } catch { 5 }", 5},
+		{"try {\n  1 / 0\n} catch (e) { e[\"position\"] }", "2:3"},
+		{"let f = function() { 1 / 0 };\ntry { f() } catch (e) { len(e[\"stack\"]) }", 2},
+		{"let f = function() { 1 / 0 };\ntry { f() } catch (e) { e[\"stack\"][1] }", "line 1, column 22, in f"},
+		{"let x = 0; try { x = 1 } finally { x = 2 }; x", 2},
+		{"let x = 0; try { throw 1 } catch { x += 1 } finally { x += 10 }; x", 11},
+		{"let x = 0; let f = function() { try { return 1 } finally { x = 5 } }; f() + x", 6},
+		{"let f = function() { try { throw 1 } finally { return 2 } }; f()", 2},
+		{"let f = function() { try { return 1 } finally { throw \"late\" } }; f()", "late"},
+		{"let x = 0; try { throw \"up\" } finally { x = 1 }", "up"},
+		{"try { throw 1 } catch (e) { e }; e", "identifier not found: e"},
+		{"let n = 0; for (i in 0..5) { try { if (i == 2) { break } n += 1 } finally { n += 10 } }; n", 32},
+		{"try { throw 1 } catch (e) { throw e[\"message\"] + \"!\" }", "1!"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if errObj, ok := evaluated.(*object.Error); ok {
+				if errObj.Message != expected {
+					t.Errorf("%q: wrong error message, expected=%q got=%q", tt.input, expected, errObj.Message)
+				}
+				continue
+			}
+			str, ok := evaluated.(*object.String)
+			if !ok || str.Value != expected {
+				t.Errorf("%q: expected %q, got %T (%+v)", tt.input, expected, evaluated, evaluated)
+			}
+		}
+	}
+}
+
+func TestUncatchableErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	input := "let caught = false; try { while (true) { } } catch { caught = true } finally { caught = true }; caught"
+	program := parser.New(lexer.New(input)).ParseProgram()
+	evaluated := EvalContext(ctx, program, object.NewEnvironment())
+	if errObj, ok := evaluated.(*object.Error); !ok || errObj.Cause != context.Canceled {
+		t.Errorf("cancellation was caught, got %T (%+v)", evaluated, evaluated)
+	}
+
+	// limits can be caught, but a spent step budget stays spent
+	e := New()
+	e.Limits.MaxSteps = 100
+	program = parser.New(lexer.New("try { while (true) { } } catch (e) { e[\"type\"] }")).ParseProgram()
+	if errObj, ok := e.Eval(program, object.NewEnvironment()).(*object.Error); !ok || errObj.Kind != "LimitError" {
+		t.Errorf("expected the limit error to escape the catch block, got %+v", errObj)
+	}
+
+	e = New()
+	e.Limits.MaxDepth = 10
+	program = parser.New(lexer.New("let f = function() { f() }; try { f() } catch (e) { e[\"type\"] }")).ParseProgram()
+	if str, ok := e.Eval(program, object.NewEnvironment()).(*object.String); !ok || str.Value != "LimitError" {
+		t.Errorf("expected to catch the depth limit, got %+v", str)
+	}
+}
+
+func TestModules(t *testing.T) {
+	files := map[string]string{
+		"lib/math.fa":     `import { double } from "util"; export let square = function(x) { x * x }; export let quad = function(x) { double(double(x)) }; let hidden = 1;`,
+		"lib/util.fa":     `export let double = function(x) { x * 2 }; tick();`,
+		"vendor/greet.fa": `export let greet = function(name) { "hi " + name };`,
+		"broken.fa":       `export let f = function() { 1 + true };`,
+		"syntax.fa":       `let = 1;`,
+		"a.fa":            `import "b.fa" as b; export let x = 1;`,
+		"b.fa":            `import "a.fa" as a; export let y = 2;`,
+	}
+	reads := 0
+	newEvaluator := func() (*Evaluator, *int) {
+		e := New()
+		ticks := 0
+		e.RegisterBuiltin("tick", func(rt object.Runtime, args ...object.Object) object.Object {
+			ticks++
+			return NULL
+		})
+		e.SearchPath = []string{"vendor"}
+		e.ReadModule = func(path string) ([]byte, error) {
+			reads++
+			src, ok := files[filepath.ToSlash(path)]
+			if !ok {
+				return nil, fs.ErrNotExist
+			}
+			return []byte(src), nil
+		}
+		return e, &ticks
+	}
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`import "lib/math.fa" as m; m.square(3)`, 9},
+		{`import "lib/math" as m; m.quad(3)`, 12},
+		{`import { square, quad } from "lib/math.fa"; square(2) + quad(1)`, 8},
+		{`import "greet" as g; g.greet("bob")`, "hi bob"},
+		{`import "lib/math.fa" as m; m.hidden`, "identifier not found: m.hidden"},
+		{`import { hidden } from "lib/math.fa"`, `module "lib/math.fa" has no export hidden`},
+		{`import "missing" as m`, `cannot import "missing": module not found`},
+		{`import "syntax" as s`, `cannot import "syntax": syntax.fa:1:5: expected identifier, found "="`},
+		{`import { f } from "broken"; f()`, "type mismatch: INTEGER + BOOLEAN"},
+		{`import "a" as a`, "import cycle: a.fa -> b.fa -> a.fa"},
+		{`export let x = 5; x`, 5},
+	}
+
+	for _, tt := range tests {
+		e, _ := newEvaluator()
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated := e.Eval(program, object.NewEnvironment())
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if errObj, ok := evaluated.(*object.Error); ok {
+				if errObj.Message != expected {
+					t.Errorf("%q: wrong error message, expected=%q got=%q", tt.input, expected, errObj.Message)
+				}
+				continue
+			}
+			str, ok := evaluated.(*object.String)
+			if !ok || str.Value != expected {
+				t.Errorf("%q: expected %q, got %T (%+v)", tt.input, expected, evaluated, evaluated)
+			}
+		}
+	}
+
+	// an error inside a module points into its file
+	e, ticks := newEvaluator()
+	program := parser.New(lexer.New(`import { f } from "broken"; f()`)).ParseProgram()
+	if errObj, ok := e.Eval(program, object.NewEnvironment()).(*object.Error); !ok || errObj.Span.Pos.String() != "broken.fa:1:29" {
+		t.Errorf("wrong position for an error in a module: %+v", errObj)
+	}
+	if src, ok := e.ModuleSource("broken.fa"); !ok || src != files["broken.fa"] {
+		t.Errorf("module source not kept, got %q", src)
+	}
+
+	// modules are evaluated and read once per evaluator, however often they're imported
+	reads = 0
+	for i := 0; i < 3; i++ {
+		program := parser.New(lexer.New(`import "lib/util" as u; import { double } from "lib/util.fa"; double(1)`)).ParseProgram()
+		testIntegerObject(t, e.Eval(program, object.NewEnvironment()), 2)
+	}
+	if *ticks != 1 || reads != 1 {
+		t.Errorf("module evaluated %d times and read %d times, want once", *ticks, reads)
+	}
+
+	// a module importing the running script back is a cycle, found before the script runs twice
+	e, _ = newEvaluator()
+	program = parser.New(lexer.NewFile("a.fa", files["a.fa"])).ParseProgram()
+	leave := e.EnterFile("a.fa")
+	if errObj, ok := e.Eval(program, object.NewEnvironment()).(*object.Error); !ok || errObj.Message != "import cycle: a.fa -> b.fa -> a.fa" {
+		t.Errorf("cycle through the running script not found, got %+v", errObj)
+	}
+	leave()
+
+	e.DisableIO()
+	program = parser.New(lexer.New(`import "lib/util" as u`)).ParseProgram()
+	if errObj, ok := e.Eval(program, object.NewEnvironment()).(*object.Error); !ok || errObj.Message != "import is disabled" {
+		t.Errorf("import not disabled, got %+v", errObj)
+	}
+}
+
 func TestArrayLiterals(t *testing.T) {
 	input := "[1, 2 * 2, 3 + 3]"
 
@@ -409,25 +1573,28 @@ func TestHashLiterals(t *testing.T) {
 		t.Fatalf("Eval didn't return Hash, got=%T (%+v)", evaluated, evaluated)
 	}
 
-	expected := map[object.HashKey]int64{
-		(&object.String{Value: "one"}).HashKey():   1,
-		(&object.String{Value: "two"}).HashKey():   2,
-		(&object.String{Value: "three"}).HashKey(): 3,
-		(&object.Integer{Value: 4}).HashKey():      4,
-		TRUE.HashKey():                             5,
-		FALSE.HashKey():                            6,
+	expected := []struct {
+		key   object.Hashable
+		value int64
+	}{
+		{&object.String{Value: "one"}, 1},
+		{&object.String{Value: "two"}, 2},
+		{&object.String{Value: "three"}, 3},
+		{&object.Integer{Value: 4}, 4},
+		{TRUE, 5},
+		{FALSE, 6},
 	}
 
-	if len(result.Pairs) != len(expected) {
-		t.Fatalf("Hash has wrong number of pairs, got=%d", len(result.Pairs))
+	if result.Len() != len(expected) {
+		t.Fatalf("Hash has wrong number of pairs, got=%d", result.Len())
 	}
 
-	for expectedKey, expectedValue := range expected {
-		pair, ok := result.Pairs[expectedKey]
+	for _, tt := range expected {
+		value, ok := result.Get(tt.key)
 		if !ok {
 			t.Errorf("no pair for given key in Pairs")
 		}
-		testIntegerObject(t, pair.Value, expectedValue)
+		testIntegerObject(t, value, tt.value)
 	}
 }
 
@@ -508,6 +1675,20 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float, got %T (%+v)", obj, obj)
+		return false
+	}
+	if result.Value != expected {
+		t.Errorf("object has wrong value, got %g, want %g", result.Value, expected)
+		return false
+	}
+
+	return true
+}
+
 func testBooleanObject(t *testing.T, obj object.Object, expected bool) bool {
 	result, ok := obj.(*object.Boolean)
 	if !ok {
@@ -0,0 +1,77 @@
+package evaluator
+
+import (
+	"farcical/object"
+	"fmt"
+)
+
+// DefaultMaxDepth is the call depth New allows. It is well short of where the
+// nested Go calls for each Farcical call would overflow the goroutine stack
+const DefaultMaxDepth = 10000
+
+// Limits bounds the resources one evaluation may use, so untrusted scripts
+// can't exhaust the host. A zero field means no limit
+type Limits struct {
+	MaxSteps        int // nodes evaluated, or instructions run by the vm, per call to Eval or Call from Go
+	MaxDepth        int // nested function calls
+	MaxStringLength int // bytes in any string a script builds
+	MaxArrayLength  int // elements in any array a script builds
+	MaxHashSize     int // pairs in any hash a script builds
+	MaxIntegerBits  int // bits in any integer a script builds, once it outgrows an int64
+}
+
+// LimitError is the Cause of the error raised when a script exceeds one of its Limits.
+// Limit is the name of the Limits field that was exceeded
+type LimitError struct {
+	Limit string
+	Max   int
+}
+
+func (le *LimitError) Error() string {
+	return fmt.Sprintf("exceeded %s limit (%d)", le.Limit, le.Max)
+}
+
+func limitError(limit string, max int) *object.Error {
+	cause := &LimitError{Limit: limit, Max: max}
+	return &object.Error{Message: cause.Error(), Kind: "LimitError", Cause: cause}
+}
+
+// step counts one evaluation step, returning an error once the budget is spent
+func (e *Evaluator) step() *object.Error {
+	e.steps++
+	if max := e.Limits.MaxSteps; max > 0 && e.steps > max {
+		return limitError("MaxSteps", max)
+	}
+	return nil
+}
+
+// checkDepth returns an error if calling another function would exceed the depth limit
+func (e *Evaluator) checkDepth() *object.Error {
+	if max := e.Limits.MaxDepth; max > 0 && len(e.frames) >= max {
+		return limitError("MaxDepth", max)
+	}
+	return nil
+}
+
+// checkSize returns an error if obj is a string, array, hash or integer bigger than the limits allow
+func (e *Evaluator) checkSize(obj object.Object) *object.Error {
+	switch obj := obj.(type) {
+	case *object.String:
+		if max := e.Limits.MaxStringLength; max > 0 && len(obj.Value) > max {
+			return limitError("MaxStringLength", max)
+		}
+	case *object.Array:
+		if max := e.Limits.MaxArrayLength; max > 0 && len(obj.Elements) > max {
+			return limitError("MaxArrayLength", max)
+		}
+	case *object.BigInt:
+		if max := e.Limits.MaxIntegerBits; max > 0 && obj.Value.BitLen() > max {
+			return limitError("MaxIntegerBits", max)
+		}
+	case *object.Hash:
+		if max := e.Limits.MaxHashSize; max > 0 && obj.Len() > max {
+			return limitError("MaxHashSize", max)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package evaluator
+
+import (
+	"errors"
+	"farcical/ast"
+	"farcical/lexer"
+	"farcical/object"
+	"farcical/parser"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// module is a module that has been, or is being, evaluated
+type module struct {
+	exports *object.Namespace
+	source  string
+}
+
+func (e *Evaluator) evalImportStatement(is *ast.ImportStatement, env *object.Environment) object.Object {
+	exports := e.importModule(is.Path.Value, is.Token.Pos.Filename)
+	if isError(exports) {
+		return exports
+	}
+	ns := exports.(*object.Namespace)
+
+	if is.Alias != nil {
+		env.Set(is.Alias.Value, &object.Namespace{Name: is.Alias.Value, Members: ns.Members})
+	}
+	for _, name := range is.Names {
+		val, ok := ns.Members[name.Value]
+		if !ok {
+			return newError("module %q has no export %s", is.Path.Value, name.Value)
+		}
+		env.Set(name.Value, val)
+	}
+
+	return nil
+}
+
+func (e *Evaluator) evalExportStatement(es *ast.ExportStatement, env *object.Environment) object.Object {
+	result := e.Eval(es.Statement, env)
+	if isError(result) {
+		return result
+	}
+
+	// exports only mean something while a module is being imported; in the main program they're plain lets
+	if e.exports != nil {
+		*e.exports = append(*e.exports, es.Statement.Name.Value)
+	}
+	return result
+}
+
+// importModule returns the namespace of names exported by the module at path,
+// evaluating it in an environment of its own the first time it is imported.
+// from is the file doing the importing, which relative paths start from
+func (e *Evaluator) importModule(path string, from string) object.Object {
+	if e.ReadModule == nil {
+		return newError("import is disabled")
+	}
+
+	resolved, src, err := e.resolveModule(path, from)
+	if err != nil {
+		return newError("cannot import %q: %s", path, err)
+	}
+
+	for i, loading := range e.loading {
+		if loading == resolved {
+			cycle := append(append([]string{}, e.loading[i:]...), resolved)
+			return newError("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	if m, ok := e.modules[resolved]; ok && m.exports != nil {
+		return m.exports
+	}
+
+	if e.modules == nil {
+		e.modules = make(map[string]*module)
+	}
+	m := &module{source: src}
+	e.modules[resolved] = m // kept even if the module fails, so errors in it can be shown
+
+	p := parser.New(lexer.NewFile(resolved, m.source))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) != 0 {
+		return newError("cannot import %q: %s", path, errs[0].Error())
+	}
+
+	e.loading = append(e.loading, resolved)
+	defer func() { e.loading = e.loading[:len(e.loading)-1] }()
+
+	run := e.RunModule
+	if run == nil {
+		run = e.evalModule
+	}
+	moduleEnv := object.NewEnvironment()
+	names, result := run(program, moduleEnv)
+	if isError(result) {
+		return result
+	}
+
+	m.exports = &object.Namespace{Name: path, Members: make(map[string]object.Object)}
+	for _, name := range names {
+		m.exports.Members[name], _ = moduleEnv.Get(name)
+	}
+	return m.exports
+}
+
+// EnterFile records that the script in filename is running, so that a module importing it
+// back is reported as an import cycle rather than running the script a second time. The
+// returned function must be called once the script has finished
+func (e *Evaluator) EnterFile(filename string) func() {
+	e.loading = append(e.loading, filepath.Clean(filename))
+	return func() { e.loading = e.loading[:len(e.loading)-1] }
+}
+
+// evalModule evaluates the program of a module in env, returning the names it exported
+func (e *Evaluator) evalModule(program *ast.Program, env *object.Environment) ([]string, object.Object) {
+	prevExports := e.exports
+	names := []string{}
+	e.exports = &names
+	defer func() { e.exports = prevExports }()
+
+	return names, e.Eval(program, env)
+}
+
+// resolveModule finds the file an import refers to, and its source, looking relative to the
+// importing file and then in each SearchPath directory. A path without an extension gets ".fa"
+func (e *Evaluator) resolveModule(path string, from string) (string, string, error) {
+	if filepath.Ext(path) == "" {
+		path += ".fa"
+	}
+
+	candidates := []string{path}
+	if !filepath.IsAbs(path) {
+		candidates = []string{filepath.Join(filepath.Dir(from), path)}
+		for _, dir := range e.SearchPath {
+			candidates = append(candidates, filepath.Join(dir, path))
+		}
+	}
+
+	for _, candidate := range candidates {
+		if m, ok := e.modules[candidate]; ok {
+			return candidate, m.source, nil // already imported, no need to read it again
+		}
+
+		src, err := e.ReadModule(candidate)
+		if err == nil {
+			return candidate, string(src), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", "", err
+		}
+	}
+	return "", "", errors.New("module not found")
+}
+
+// ModuleSource returns the source of an imported module by the filename its
+// positions carry, so errors raised inside it can be shown in context
+func (e *Evaluator) ModuleSource(filename string) (string, bool) {
+	m, ok := e.modules[filename]
+	if !ok {
+		return "", false
+	}
+	return m.source, true
+}
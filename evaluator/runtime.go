@@ -0,0 +1,84 @@
+package evaluator
+
+import "farcical/object"
+
+// The functions in this file give the vm package the evaluator's semantics for the
+// operations it executes, so compiled and evaluated code agree on every result and
+// error message
+
+// Infix applies a binary operator other than && and ||, which short-circuit, to two values
+func Infix(operator string, left, right object.Object) object.Object {
+	return evalInfixExpression(operator, left, right)
+}
+
+// Prefix applies the operator ! or - to a value
+func Prefix(operator string, right object.Object) object.Object {
+	return evalPrefixExpression(operator, right)
+}
+
+// Index gives left[index]
+func Index(left, index object.Object) object.Object {
+	return evalIndexExpression(left, index)
+}
+
+// SetIndex does left[index] = val, giving val or an error
+func SetIndex(left, index, val object.Object) object.Object {
+	return evalIndexAssignment(left, index, val)
+}
+
+// Member gives obj.name
+func Member(obj object.Object, name string) object.Object {
+	return evalMember(obj, name)
+}
+
+// IsTruthy reports whether obj counts as true in a condition
+func IsTruthy(obj object.Object) bool {
+	return isTruthy(obj)
+}
+
+// HashKey returns obj as a hash key, or the error using it as one raises
+func HashKey(obj object.Object) (object.Hashable, *object.Error) {
+	return hashKey(obj)
+}
+
+// Throw gives the error raised by throwing val
+func Throw(val object.Object) *object.Error {
+	return thrownError(val)
+}
+
+// ErrorToHash gives the hash a catch block binds err to
+func ErrorToHash(err *object.Error) *object.Hash {
+	return errorToHash(err)
+}
+
+// IsCatchable reports whether try can handle err
+func IsCatchable(err *object.Error) bool {
+	return isCatchable(err)
+}
+
+// CheckArity returns an error if a function called name, taking between required and
+// params arguments or more if it is variadic, can't be called with got of them
+func CheckArity(name string, got, required, params int, variadic bool) *object.Error {
+	return checkArity(name, got, required, params, variadic)
+}
+
+// StoppedError gives the error raised once the context of a run is done with err
+func StoppedError(err error) *object.Error {
+	return stoppedError(err)
+}
+
+// LimitExceeded gives the error raised by exceeding the Limits field called limit
+func LimitExceeded(limit string, max int) *object.Error {
+	return limitError(limit, max)
+}
+
+// CheckSize returns an error if obj is a string, array, hash or integer bigger than e's limits allow
+func (e *Evaluator) CheckSize(obj object.Object) *object.Error {
+	return e.checkSize(obj)
+}
+
+// Import gives the namespace of names exported by the module at path, running
+// it first if it hasn't been imported yet. from is the file doing the importing
+func (e *Evaluator) Import(path string, from string) object.Object {
+	return e.importModule(path, from)
+}
@@ -0,0 +1,498 @@
+// Package farcical embeds the Farcical language in Go programs.
+//
+// An Interpreter holds a set of globals that persist between runs, so a host
+// can load a script once and then call the functions it defines:
+//
+//	interp := farcical.New()
+//	if _, err := interp.Run(`let discount = function(total) { total * 0.1 }`); err != nil {
+//		return err
+//	}
+//	off, err := interp.Call("discount", 250)
+//
+// Values cross the boundary as plain Go values: integers become int64 (or
+// *big.Int when too big for one), floats float64, arrays []any and hashes map[any]any. Functions and anything else
+// without a Go equivalent are passed through as their object.Object.
+package farcical
+
+import (
+	"context"
+	"farcical/compiler"
+	"farcical/diag"
+	"farcical/evaluator"
+	"farcical/lexer"
+	"farcical/object"
+	"farcical/parser"
+	"farcical/vm"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"reflect"
+	"sort"
+)
+
+// Interpreter runs Farcical code against a persistent global environment.
+// It is not safe for concurrent use; give each goroutine its own.
+type Interpreter struct {
+	env       *object.Environment
+	evaluator *evaluator.Evaluator
+	vm        *vm.VM // runs scripts when the engine is EngineVM, nil otherwise
+}
+
+// Option configures an Interpreter when it is created
+type Option func(*Interpreter)
+
+// WithStdout sends what scripts print to w instead of os.Stdout
+func WithStdout(w io.Writer) Option {
+	return func(in *Interpreter) {
+		in.evaluator.Stdout = w
+	}
+}
+
+// WithStderr sends what scripts print with eprint to w instead of os.Stderr
+func WithStderr(w io.Writer) Option {
+	return func(in *Interpreter) {
+		in.evaluator.Stderr = w
+	}
+}
+
+// WithStdin makes input read from r instead of os.Stdin
+func WithStdin(r io.Reader) Option {
+	return func(in *Interpreter) {
+		in.evaluator.Stdin = r
+	}
+}
+
+// Limits bounds the steps, call depth and allocations of a script; see WithLimits
+type Limits = evaluator.Limits
+
+// LimitError is wrapped by the *RuntimeError of a script that exceeded its Limits
+type LimitError = evaluator.LimitError
+
+// WithLimits replaces the interpreter's limits. By default only the call depth is
+// limited, to evaluator.DefaultMaxDepth; zero fields in limits are unlimited
+func WithLimits(limits Limits) Option {
+	return func(in *Interpreter) {
+		in.evaluator.Limits = limits
+	}
+}
+
+// WithSearchPath adds directories that import looks in for modules that aren't
+// found relative to the importing script
+func WithSearchPath(dirs ...string) Option {
+	return func(in *Interpreter) {
+		in.evaluator.SearchPath = append(in.evaluator.SearchPath, dirs...)
+	}
+}
+
+// WithoutIO removes the builtins that read or write outside the interpreter, such
+// as print, and disables import
+func WithoutIO() Option {
+	return func(in *Interpreter) {
+		in.evaluator.DisableIO()
+	}
+}
+
+// WithoutBuiltins removes the named builtins, which may be dotted or whole namespaces
+func WithoutBuiltins(names ...string) Option {
+	return func(in *Interpreter) {
+		for _, name := range names {
+			in.evaluator.UnregisterBuiltin(name)
+		}
+	}
+}
+
+// Engine selects how an Interpreter runs scripts
+type Engine int
+
+const (
+	// EngineEval walks the syntax tree of a script, the default
+	EngineEval Engine = iota
+	// EngineVM compiles a script to bytecode and runs it on a virtual machine, which is
+	// faster for scripts that loop or call functions a lot. Results and errors are the same
+	EngineVM
+)
+
+// WithEngine selects the engine that runs scripts
+func WithEngine(engine Engine) Option {
+	return func(in *Interpreter) {
+		if engine == EngineVM {
+			in.vm = vm.New(in.evaluator)
+			in.evaluator.RunModule = in.vm.RunModule
+		} else {
+			in.vm = nil
+			in.evaluator.RunModule = nil
+		}
+	}
+}
+
+// New returns an Interpreter with the standard builtins, adjusted by opts
+func New(opts ...Option) *Interpreter {
+	in := &Interpreter{
+		env:       object.NewEnvironment(),
+		evaluator: evaluator.New(),
+	}
+	for _, opt := range opts {
+		opt(in)
+	}
+	return in
+}
+
+// RegisterBuiltin makes fn callable from this interpreter's scripts as name.
+// A dotted name such as "str.upper" puts fn in a namespace. As with the
+// standard builtins, a script's own variables take precedence over it
+func (in *Interpreter) RegisterBuiltin(name string, fn Func) {
+	in.evaluator.RegisterBuiltin(name, wrapFunc(fn).Fn)
+}
+
+// UnregisterBuiltin removes a builtin from this interpreter only
+func (in *Interpreter) UnregisterBuiltin(name string) {
+	in.evaluator.UnregisterBuiltin(name)
+}
+
+// Run evaluates src and returns the value of its last statement, or nil if it
+// has none. Parse failures are returned as *SyntaxError and runtime failures as *RuntimeError
+func (in *Interpreter) Run(src string) (any, error) {
+	return in.RunContext(context.Background(), src)
+}
+
+// RunContext is Run that stops the script once ctx is done. The returned
+// *RuntimeError then wraps ctx.Err(), so errors.Is(err, context.DeadlineExceeded) works
+func (in *Interpreter) RunContext(ctx context.Context, src string) (any, error) {
+	result, err := in.EvalContext(ctx, "", src)
+	if err != nil {
+		return nil, err
+	}
+	return FromObject(result), nil
+}
+
+// RunFile reads and runs the script at path; positions in any errors name the file
+func (in *Interpreter) RunFile(path string) (any, error) {
+	return in.RunFileContext(context.Background(), path)
+}
+
+// RunFileContext is RunFile that stops the script once ctx is done
+func (in *Interpreter) RunFileContext(ctx context.Context, path string) (any, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := in.EvalContext(ctx, path, string(src))
+	if err != nil {
+		return nil, err
+	}
+	return FromObject(result), nil
+}
+
+// Eval is Run for callers that want the raw Farcical result rather than a Go value.
+// filename is only used in error positions and may be empty
+func (in *Interpreter) Eval(filename string, src string) (object.Object, error) {
+	return in.EvalContext(context.Background(), filename, src)
+}
+
+// EvalContext is Eval that stops the script once ctx is done
+func (in *Interpreter) EvalContext(ctx context.Context, filename string, src string) (object.Object, error) {
+	p := parser.New(lexer.NewFile(filename, src))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) != 0 {
+		return nil, &SyntaxError{Source: src, Diagnostics: errs}
+	}
+
+	if filename != "" {
+		defer in.evaluator.EnterFile(filename)()
+	}
+
+	var result object.Object
+	if in.vm != nil {
+		main, err := compiler.Compile(program)
+		if err != nil {
+			return nil, err
+		}
+		result = in.vm.RunContext(ctx, main, in.env)
+	} else {
+		result = in.evaluator.EvalContext(ctx, program, in.env)
+	}
+	if err, ok := result.(*object.Error); ok {
+		// errors raised inside an imported module point into that module's source
+		if file := err.Span.Pos.Filename; file != filename {
+			if moduleSrc, ok := in.evaluator.ModuleSource(file); ok {
+				src = moduleSrc
+			}
+		}
+		return nil, &RuntimeError{Source: src, Err: err}
+	}
+	return result, nil
+}
+
+// Call calls the global function or builtin called name with args converted by ToObject
+func (in *Interpreter) Call(name string, args ...any) (any, error) {
+	return in.CallContext(context.Background(), name, args...)
+}
+
+// CallContext is Call that stops the function once ctx is done
+func (in *Interpreter) CallContext(ctx context.Context, name string, args ...any) (any, error) {
+	fn, ok := in.evaluator.Lookup(name, in.env)
+	if !ok {
+		return nil, fmt.Errorf("farcical: %s is not defined", name)
+	}
+
+	objects := make([]object.Object, len(args))
+	for i, arg := range args {
+		obj, err := ToObject(arg)
+		if err != nil {
+			return nil, fmt.Errorf("farcical: argument %d to %s: %w", i, name, err)
+		}
+		objects[i] = obj
+	}
+
+	var result object.Object
+	if in.vm != nil {
+		result = in.vm.CallContext(ctx, fn, objects...)
+	} else {
+		result = in.evaluator.CallContext(ctx, fn, objects...)
+	}
+	if err, ok := result.(*object.Error); ok {
+		return nil, &RuntimeError{Err: err}
+	}
+	return FromObject(result), nil
+}
+
+// Set defines or replaces the global called name, converting value with ToObject
+func (in *Interpreter) Set(name string, value any) error {
+	obj, err := ToObject(value)
+	if err != nil {
+		return fmt.Errorf("farcical: setting %s: %w", name, err)
+	}
+	in.env.Set(name, obj)
+	return nil
+}
+
+// Get returns the global called name as a Go value, reporting false if it isn't defined
+func (in *Interpreter) Get(name string) (any, bool) {
+	obj, ok := in.env.Get(name)
+	if !ok {
+		return nil, false
+	}
+	return FromObject(obj), true
+}
+
+// SyntaxError reports that a script could not be parsed
+type SyntaxError struct {
+	Source      string // the text the diagnostics refer to
+	Diagnostics []diag.Diagnostic
+}
+
+func (e *SyntaxError) Error() string {
+	msg := e.Diagnostics[0].Error()
+	if more := len(e.Diagnostics) - 1; more == 1 {
+		msg += " (and 1 more error)"
+	} else if more > 1 {
+		msg += fmt.Sprintf(" (and %d more errors)", more)
+	}
+	return msg
+}
+
+// Render writes every diagnostic with the offending source underlined
+func (e *SyntaxError) Render(w io.Writer) {
+	diag.RenderAll(w, e.Source, e.Diagnostics)
+}
+
+// RuntimeError reports that a script failed while running
+type RuntimeError struct {
+	Source string // the text the error's positions refer to, empty for errors raised by Call
+	Err    *object.Error
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Err.Diagnostic().Error()
+}
+
+// Unwrap returns the Go error behind the failure, such as context.Canceled, if there is one
+func (e *RuntimeError) Unwrap() error {
+	return e.Err.Cause
+}
+
+// Traceback returns the error with the stack of calls that led to it
+func (e *RuntimeError) Traceback() string {
+	return e.Err.Inspect()
+}
+
+// Render writes the error with the offending source underlined
+func (e *RuntimeError) Render(w io.Writer) {
+	diag.Render(w, e.Source, e.Err.Diagnostic())
+}
+
+// Func is the signature of Go functions that can be handed to Farcical code with Set.
+// Returning a non-nil error raises it as a Farcical runtime error
+type Func func(args ...any) (any, error)
+
+// ToObject converts a Go value to its Farcical equivalent. It accepts nil,
+// booleans, numbers including *big.Int, strings, slices, arrays, maps with
+// hashable keys, Funcs, and object.Objects, which are returned unchanged
+func ToObject(value any) (object.Object, error) {
+	return toObject(value, map[goRef]object.Object{})
+}
+
+// goRef identifies a Go slice or map, so one that contains itself converts to a
+// Farcical value that contains itself rather than recursing forever
+type goRef struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+// toObject is ToObject remembering the slices and maps it has converted in seen
+func toObject(value any, seen map[goRef]object.Object) (object.Object, error) {
+	switch v := value.(type) {
+	case nil:
+		return evaluator.NULL, nil
+	case object.Object:
+		return v, nil
+	case Func:
+		return wrapFunc(v), nil
+	case func(args ...any) (any, error):
+		return wrapFunc(v), nil
+	case *big.Int:
+		return object.NewInteger(new(big.Int).Set(v)), nil
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return evaluator.TRUE, nil
+		}
+		return evaluator.FALSE, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: rv.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return object.NewInteger(new(big.Int).SetUint64(rv.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: rv.Float()}, nil
+	case reflect.String:
+		return &object.String{Value: rv.String()}, nil
+	case reflect.Slice, reflect.Array:
+		elements := make([]object.Object, rv.Len())
+		array := &object.Array{Elements: elements}
+		if rv.Kind() == reflect.Slice && rv.Len() > 0 {
+			ref := goRef{rv.Type(), rv.Pointer(), rv.Len()}
+			if obj, ok := seen[ref]; ok {
+				return obj, nil
+			}
+			seen[ref] = array
+		}
+		for i := range elements {
+			elem, err := toObject(rv.Index(i).Interface(), seen)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = elem
+		}
+		return array, nil
+	case reflect.Map:
+		hash := &object.Hash{}
+		if !rv.IsNil() {
+			ref := goRef{rv.Type(), rv.Pointer(), 0}
+			if obj, ok := seen[ref]; ok {
+				return obj, nil
+			}
+			seen[ref] = hash
+		}
+
+		// Go maps have no order, so keys are sorted to keep the hash's order the same every time
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+
+		for _, k := range keys {
+			key, err := toObject(k.Interface(), seen)
+			if err != nil {
+				return nil, err
+			}
+			hashKey, bad, ok := object.AsHashable(key)
+			if !ok {
+				return nil, fmt.Errorf("unusable as hash key: %s", bad.Type())
+			}
+			val, err := toObject(rv.MapIndex(k).Interface(), seen)
+			if err != nil {
+				return nil, err
+			}
+			hash.Set(hashKey, val)
+		}
+		return hash, nil
+	}
+
+	return nil, fmt.Errorf("cannot convert %T to a Farcical value", value)
+}
+
+// FromObject converts a Farcical value to Go. Objects without a Go equivalent,
+// such as functions, are returned unchanged so they can be passed back in later,
+// as are arrays used as hash keys
+func FromObject(obj object.Object) any {
+	return fromObject(obj, map[object.Object]any{})
+}
+
+// fromObject is FromObject remembering the arrays and hashes it has converted in seen,
+// so one that contains itself becomes a Go slice or map that contains itself
+func fromObject(obj object.Object, seen map[object.Object]any) any {
+	if value, ok := seen[obj]; ok {
+		return value
+	}
+
+	switch obj := obj.(type) {
+	case nil, *object.Null:
+		return nil
+	case *object.Integer:
+		return obj.Value
+	case *object.BigInt:
+		return new(big.Int).Set(obj.Value)
+	case *object.Float:
+		return obj.Value
+	case *object.Boolean:
+		return obj.Value
+	case *object.String:
+		return obj.Value
+	case *object.Array:
+		elements := make([]any, len(obj.Elements))
+		seen[obj] = elements
+		for i, elem := range obj.Elements {
+			elements[i] = fromObject(elem, seen)
+		}
+		return elements
+	case *object.Hash:
+		m := make(map[any]any, obj.Len())
+		seen[obj] = m
+		for _, pair := range obj.Ordered() {
+			key := fromObject(pair.Key, seen)
+			if _, ok := pair.Key.(*object.Array); ok {
+				key = pair.Key // a []any can't be a Go map key
+			}
+			m[key] = fromObject(pair.Value, seen)
+		}
+		return m
+	default:
+		return obj
+	}
+}
+
+func wrapFunc(fn Func) *object.Builtin {
+	return &object.Builtin{Fn: func(rt object.Runtime, args ...object.Object) object.Object {
+		values := make([]any, len(args))
+		for i, arg := range args {
+			values[i] = FromObject(arg)
+		}
+
+		result, err := fn(values...)
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+
+		obj, err := ToObject(result)
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		return obj
+	}}
+}
@@ -0,0 +1,454 @@
+package farcical
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{"5 + 5", int64(10)},
+		{"1.5 * 2", 3.0},
+		{`"a" + "b"`, "ab"},
+		{"1 < 2", true},
+		{"if (false) { 1 }", nil},
+		{"let x = 1;", nil},
+		{"[1, \"two\", [3]]", []any{int64(1), "two", []any{int64(3)}}},
+		{`{"a": 1, 2: true}`, map[any]any{"a": int64(1), int64(2): true}},
+		{"9223372036854775807 + 1", new(big.Int).Lsh(big.NewInt(1), 63)},
+	}
+
+	for _, tt := range tests {
+		result, err := New().Run(tt.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("%q: got %#v, want %#v", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestGlobalsPersistBetweenRuns(t *testing.T) {
+	interp := New()
+	if _, err := interp.Run("let total = 40;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := interp.Run("total + 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != int64(42) {
+		t.Errorf("got %#v, want 42", result)
+	}
+}
+
+func TestSetAndGet(t *testing.T) {
+	interp := New()
+	globals := map[string]any{
+		"count":  7,
+		"ratio":  float32(0.5),
+		"name":   "farcical",
+		"tags":   []string{"a", "b"},
+		"prices": map[string]int{"tea": 3},
+		"none":   nil,
+		"huge":   uint64(1) << 63,
+	}
+	for name, value := range globals {
+		if err := interp.Set(name, value); err != nil {
+			t.Fatalf("Set(%q): %v", name, err)
+		}
+	}
+
+	result, err := interp.Run(`[count * 2, ratio, name, tags[1], prices["tea"], none, huge - 1]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []any{int64(14), 0.5, "farcical", "b", int64(3), nil, int64(math.MaxInt64)}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("got %#v, want %#v", result, expected)
+	}
+
+	// a Go map's keys are sorted, so the hash comes out the same every time
+	if err := interp.Set("stock", map[string]int{"pear": 1, "apple": 2, "fig": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := interp.Run("keys(stock)"); err != nil || !reflect.DeepEqual(result, []any{"apple", "fig", "pear"}) {
+		t.Errorf("keys(stock) = %#v, %v", result, err)
+	}
+
+	if _, err := interp.Run("let doubled = count * 2;"); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := interp.Get("doubled"); !ok || got != int64(14) {
+		t.Errorf("Get(doubled) = %#v, %t, want 14, true", got, ok)
+	}
+	if _, ok := interp.Get("missing"); ok {
+		t.Errorf("Get(missing) reported a value")
+	}
+
+	if err := interp.Set("bad", make(chan int)); err == nil {
+		t.Errorf("Set accepted a channel")
+	}
+}
+
+func TestCyclicValues(t *testing.T) {
+	interp := New()
+	if _, err := interp.Run(`let a = [0]; a[0] = a; let h = {}; h["self"] = h; 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	// values that contain themselves come out as Go values that contain themselves
+	a, _ := interp.Get("a")
+	if s, ok := a.([]any); !ok || len(s) != 1 || reflect.ValueOf(s[0]).Pointer() != reflect.ValueOf(s).Pointer() {
+		t.Errorf("Get(a) = %T, want a slice holding itself", a)
+	}
+	h, _ := interp.Get("h")
+	if m, ok := h.(map[any]any); !ok || reflect.ValueOf(m["self"]).Pointer() != reflect.ValueOf(m).Pointer() {
+		t.Errorf("Get(h) = %T, want a map holding itself", h)
+	}
+
+	// and going back in they make Farcical values that contain themselves
+	s := []any{0}
+	s[0] = s
+	m := map[string]any{}
+	m["self"] = m
+	if err := interp.Set("s", s); err != nil {
+		t.Fatal(err)
+	}
+	if err := interp.Set("m", m); err != nil {
+		t.Fatal(err)
+	}
+	result, err := interp.Run(`m["self"]["self"]["x"] = 1; s[0][0][0][0] = 2; [m["x"], s[0]]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []any{int64(1), int64(2)}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("got %#v, want %#v", result, expected)
+	}
+}
+
+func TestCall(t *testing.T) {
+	interp := New()
+	_, err := interp.Run(`let discount = function(total, rate) { total * rate };`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := interp.Call("discount", 200, 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != 50.0 {
+		t.Errorf("discount = %#v, want 50.0", result)
+	}
+
+	result, err = interp.Call("len", "four")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != int64(4) {
+		t.Errorf("len = %#v, want 4", result)
+	}
+
+	if _, err := interp.Call("missing"); err == nil || err.Error() != "farcical: missing is not defined" {
+		t.Errorf("wrong error calling an undefined function: %v", err)
+	}
+
+	_, err = interp.Call("discount", "a", 1)
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected *RuntimeError, got %T (%v)", err, err)
+	}
+	if !strings.Contains(runtimeErr.Traceback(), "in discount") {
+		t.Errorf("traceback doesn't name the function:\n%s", runtimeErr.Traceback())
+	}
+}
+
+func TestGoFunctions(t *testing.T) {
+	interp := New()
+	var seen []any
+	interp.Set("record", func(args ...any) (any, error) {
+		seen = append(seen, args...)
+		return len(seen), nil
+	})
+	interp.Set("fail", Func(func(args ...any) (any, error) {
+		return nil, errors.New("service unavailable")
+	}))
+
+	result, err := interp.Run(`record("a", 1); record([true])`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != int64(3) {
+		t.Errorf("got %#v, want 3", result)
+	}
+	if expected := []any{"a", int64(1), []any{true}}; !reflect.DeepEqual(seen, expected) {
+		t.Errorf("record saw %#v, want %#v", seen, expected)
+	}
+
+	_, err = interp.Run(`fail()`)
+	if err == nil || err.Error() != "1:1: service unavailable" {
+		t.Errorf("wrong error from a failing Go function: %v", err)
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	interp := New(WithoutIO(), WithoutBuiltins("push"))
+	interp.RegisterBuiltin("str.upper", func(args ...any) (any, error) {
+		return strings.ToUpper(args[0].(string)), nil
+	})
+
+	result, err := interp.Run(`str.upper("loud")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "LOUD" {
+		t.Errorf("got %#v, want LOUD", result)
+	}
+
+	for _, input := range []string{`print("hi")`, `push([], 1)`} {
+		if _, err := interp.Run(input); err == nil || !strings.Contains(err.Error(), "identifier not found") {
+			t.Errorf("%s: expected the builtin to be missing, got %v", input, err)
+		}
+	}
+
+	interp.UnregisterBuiltin("str")
+	if _, err := interp.Run(`str.upper("quiet")`); err == nil {
+		t.Errorf("str.upper still callable after removing its namespace")
+	}
+
+	if _, err := New().Run(`push([], 1)`); err != nil {
+		t.Errorf("removing a builtin affected another interpreter: %v", err)
+	}
+}
+
+func TestRedirectedIO(t *testing.T) {
+	var stdout, stderr strings.Builder
+	interp := New(WithStdout(&stdout), WithStderr(&stderr), WithStdin(strings.NewReader("7\n")))
+
+	result, err := interp.Run(`let n = int(input("n: ")); print("double", n * 2); eprint("done"); n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != int64(7) {
+		t.Errorf("got %#v, want 7", result)
+	}
+	if stdout.String() != "n: double 14 \n" {
+		t.Errorf("wrong stdout, got=%q", stdout.String())
+	}
+	if stderr.String() != "done \n" {
+		t.Errorf("wrong stderr, got=%q", stderr.String())
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	interp := New()
+	_, err := interp.RunContext(ctx, "let spin = function() { while (true) { } };\nspin()")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || !strings.Contains(runtimeErr.Traceback(), "in spin") {
+		t.Errorf("cancellation lost the stack: %v", err)
+	}
+
+	_, err = interp.CallContext(ctx, "spin")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected CallContext to stop, got %v", err)
+	}
+
+	// the interpreter is still usable afterwards
+	if result, err := interp.Run("1 + 1"); err != nil || result != int64(2) {
+		t.Errorf("got %v, %v after cancellation", result, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	interp := New(WithLimits(Limits{MaxSteps: 1000}))
+	_, err := interp.Run("let x = 0; while (true) { x += 1 }")
+
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected a *LimitError, got %T (%v)", err, err)
+	}
+	if limitErr.Limit != "MaxSteps" || limitErr.Max != 1000 {
+		t.Errorf("wrong limit, got %+v", limitErr)
+	}
+}
+
+func TestModules(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(t.TempDir(), "shared")
+	files := map[string]string{
+		filepath.Join(dir, "main.fa"):         `import "lib/rules" as rules; import { tax } from "money"; rules.check(tax(100))`,
+		filepath.Join(dir, "lib", "rules.fa"): `export let check = function(x) { if (x > 100) { fail(x) } else { x } }; let fail = function(x) { x + "!" };`,
+		filepath.Join(shared, "money.fa"):     `export let tax = function(x) { x * 2 };`,
+	}
+	for path, src := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := New(WithSearchPath(shared)).RunFile(filepath.Join(dir, "main.fa"))
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected *RuntimeError, got %T (%v)", err, err)
+	}
+	if runtimeErr.Err.Span.Pos.Filename != filepath.Join(dir, "lib", "rules.fa") {
+		t.Errorf("error not in the module, got %s", runtimeErr.Err.Span.Pos)
+	}
+
+	// rendering shows the module's source rather than the main script's
+	var out strings.Builder
+	runtimeErr.Render(&out)
+	if !strings.Contains(out.String(), `let fail = function(x) { x + "!" }`) {
+		t.Errorf("rendered the wrong source:\n%s", out.String())
+	}
+	// while the call made from main.fa is noted with its position instead of drawn from the module's source
+	if note := "= note: in call to check at " + filepath.Join(dir, "main.fa") + ":1:59"; !strings.Contains(out.String(), note) {
+		t.Errorf("expected %q in:\n%s", note, out.String())
+	}
+
+	if _, err := New().RunFile(filepath.Join(dir, "main.fa")); err == nil || !strings.Contains(err.Error(), `cannot import "money": module not found`) {
+		t.Errorf("expected money to be missing without the search path, got %v", err)
+	}
+
+	// the vm compiles the modules too, and reports the error in the same place
+	_, err = New(WithSearchPath(shared), WithEngine(EngineVM)).RunFile(filepath.Join(dir, "main.fa"))
+	if !errors.As(err, &runtimeErr) || runtimeErr.Err.Span.Pos.Filename != filepath.Join(dir, "lib", "rules.fa") {
+		t.Errorf("wrong error from the vm: %v", err)
+	}
+}
+
+func TestImportCycleThroughEntryFile(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "main.fa")
+	libPath := filepath.Join(dir, "lib.fa")
+	if err := os.WriteFile(mainPath, []byte(`print("main runs"); import "lib" as lib;`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(libPath, []byte(`import "main" as main; export let x = 1;`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, engine := range []Engine{EngineEval, EngineVM} {
+		var out strings.Builder
+		_, err := New(WithStdout(&out), WithEngine(engine)).RunFile(mainPath)
+
+		expected := "import cycle: " + mainPath + " -> " + libPath + " -> " + mainPath
+		if err == nil || !strings.HasSuffix(err.Error(), expected) {
+			t.Errorf("engine %d: expected %q, got %v", engine, expected, err)
+		}
+		if out.String() != "main runs \n" {
+			t.Errorf("engine %d: main ran more than once, output %q", engine, out.String())
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, err := New().Run("let x = ;\nlet = 1;")
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("expected *SyntaxError, got %T (%v)", err, err)
+	}
+	if err.Error() != "1:9: expected expression, found \";\" (and 1 more error)" {
+		t.Errorf("wrong syntax error message: %q", err.Error())
+	}
+
+	_, err = New().Run("let x = 1;\nx + true")
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected *RuntimeError, got %T (%v)", err, err)
+	}
+	if err.Error() != "2:1: type mismatch: INTEGER + BOOLEAN" {
+		t.Errorf("wrong runtime error message: %q", err.Error())
+	}
+
+	var out strings.Builder
+	runtimeErr.Render(&out)
+	if !strings.Contains(out.String(), "2 | x + true") {
+		t.Errorf("rendered error doesn't show the source:\n%s", out.String())
+	}
+}
+
+func TestRunFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.fa")
+	if err := os.WriteFile(path, []byte("let f = function() { 1 + \"a\" };\nf()"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := New().RunFile(path)
+	if err == nil || !strings.HasPrefix(err.Error(), path+":1:22: ") {
+		t.Errorf("error doesn't name the file: %v", err)
+	}
+
+	if _, err := New().RunFile(filepath.Join(t.TempDir(), "missing.fa")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a not-exist error, got %v", err)
+	}
+}
+
+func TestEngineVM(t *testing.T) {
+	interp := New(WithEngine(EngineVM))
+	interp.Set("double", func(args ...any) (any, error) {
+		return args[0].(int64) * 2, nil
+	})
+
+	if _, err := interp.Run(`let count = 0; let next = function(by = 1) { count += by; double(count) };`); err != nil {
+		t.Fatal(err)
+	}
+	result, err := interp.Run("next(); next(4)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != int64(10) {
+		t.Errorf("got %#v, want 10", result)
+	}
+
+	result, err = interp.Call("next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := interp.Get("count"); result != int64(12) || count != int64(6) {
+		t.Errorf("next() = %#v with count %#v, want 12 and 6", result, count)
+	}
+
+	_, err = interp.Run("let f = function() { 1 + true };\nf()")
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected *RuntimeError, got %T (%v)", err, err)
+	}
+	if err.Error() != "1:22: type mismatch: INTEGER + BOOLEAN" {
+		t.Errorf("wrong runtime error message: %q", err.Error())
+	}
+	if !strings.Contains(runtimeErr.Traceback(), "in f") {
+		t.Errorf("traceback doesn't name the function:\n%s", runtimeErr.Traceback())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := interp.RunContext(ctx, "while (true) { }"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to stop the script, got %v", err)
+	}
+}
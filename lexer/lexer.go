@@ -1,16 +1,36 @@
 package lexer
 
-import "farcical/token"
+import (
+	"farcical/diag"
+	"farcical/token"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
 
 type Lexer struct {
 	input        string
 	position     int  // current position in input - points to current char
 	readPosition int  // current reading position in input (after current char)
 	ch           byte // current char under examination
+
+	filename  string // name reported in token positions, may be empty
+	line      int    // line of the current char
+	lineStart int    // offset of the first char on the current line
+
+	errors []diag.Diagnostic
+
+	keepComments bool // return comments as COMMENT tokens instead of skipping them
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewFile("", input)
+}
+
+// NewFile creates a lexer whose token positions are attributed to filename
+func NewFile(filename, input string) *Lexer {
+	l := &Lexer{input: input, filename: filename, line: 1}
 	l.readChar()
 	return l
 }
@@ -24,18 +44,92 @@ func (l *Lexer) peekChar() byte {
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' { // moving past a newline starts the next line
+		l.line += 1
+		l.lineStart = l.readPosition
+	}
+
 	if l.readPosition >= len(l.input) {
+		// stay parked at the end of the input however many times we are asked to read
 		l.ch = 0
-	} else {
-		l.ch = l.input[l.readPosition]
+		l.position = len(l.input)
+		l.readPosition = len(l.input) + 1
+		return
 	}
+
+	l.ch = l.input[l.readPosition]
 	l.position = l.readPosition
 	l.readPosition += 1
 }
 
+// pos returns the position of the current char
+func (l *Lexer) pos() token.Position {
+	return token.Position{
+		Filename: l.filename,
+		Offset:   l.position,
+		Line:     l.line,
+		Column:   l.position - l.lineStart + 1,
+	}
+}
+
+// KeepComments makes the lexer return comments as token.COMMENT tokens rather than
+// skipping them, for tools such as formatters that need to preserve them.
+// The parser does not expect COMMENT tokens, so don't use it for lexers fed to a parser
+func (l *Lexer) KeepComments() {
+	l.keepComments = true
+}
+
+// Errors returns the lexical errors found in the input read so far
+func (l *Lexer) Errors() []diag.Diagnostic {
+	return l.errors
+}
+
+func (l *Lexer) errorAt(span diag.Span, code string, format string, a ...interface{}) {
+	l.errors = append(l.errors, diag.Diagnostic{
+		Severity: diag.Error,
+		Code:     code,
+		Message:  fmt.Sprintf(format, a...),
+		Span:     span,
+	})
+}
+
+// spanThrough returns the span from start up to and including the current char
+func (l *Lexer) spanThrough(start token.Position) diag.Span {
+	end := l.pos()
+	if l.ch != 0 {
+		end.Offset += 1
+		end.Column += 1
+	}
+	return diag.Span{Pos: start, End: end}
+}
+
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
 	l.skipWhitespace()
+
+	for l.ch == '/' && (l.peekChar() == '/' || l.peekChar() == '*') {
+		start := l.pos()
+		comment := token.Token{Type: token.COMMENT, Literal: l.readComment(), Pos: start, End: l.pos()}
+		if l.keepComments {
+			return comment
+		}
+		l.skipWhitespace()
+	}
+
+	start := l.pos()
+	tok := l.readToken()
+	tok.Pos = start
+	tok.End = l.pos()
+
+	if tok.Type == token.ILLEGAL {
+		l.errorAt(diag.TokenSpan(tok), diag.CodeIllegalCharacter, "illegal character %q", tok.Literal)
+	}
+
+	return tok
+}
+
+// readToken reads the token starting at the current char, leaving the lexer on the char after it
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
 	switch l.ch {
 	case '=':
 		if l.peekChar() == '=' {
@@ -46,9 +140,9 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		tok = l.readOperator(token.PLUS, token.PLUS_ASSIGN)
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		tok = l.readOperator(token.MINUS, token.MINUS_ASSIGN)
 	case '!':
 		if l.peekChar() == '=' {
 			ch := l.ch
@@ -58,13 +152,19 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.BANG, l.ch)
 		}
 	case '/':
-		tok = newToken(token.SLASH, l.ch)
+		tok = l.readOperator(token.SLASH, token.SLASH_ASSIGN)
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		tok = l.readOperator(token.ASTERISK, token.ASTERISK_ASSIGN)
+	case '%':
+		tok = l.readOperator(token.PERCENT, token.PERCENT_ASSIGN)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		tok = l.readOperator(token.LT, token.LT_EQ)
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		tok = l.readOperator(token.GT, token.GT_EQ)
+	case '&':
+		tok = l.readDoubled(token.AND)
+	case '|':
+		tok = l.readDoubled(token.OR)
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ',':
@@ -86,6 +186,17 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.RBRACKET, l.ch)
 	case ':':
 		tok = newToken(token.COLON, l.ch)
+	case '.':
+		if l.peekChar() == '.' {
+			l.readChar()
+			tok = token.Token{Type: token.RANGE, Literal: ".."}
+			if l.peekChar() == '.' {
+				l.readChar()
+				tok = token.Token{Type: token.ELLIPSIS, Literal: "..."}
+			}
+		} else {
+			tok = newToken(token.DOT, l.ch)
+		}
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -95,8 +206,7 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Type = token.LookupIdent((tok.Literal))
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Type = token.INT
-			tok.Literal = l.readNumber()
+			tok.Literal, tok.Type = l.readNumber()
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
@@ -106,23 +216,182 @@ func (l *Lexer) NextToken() token.Token {
 	return tok
 }
 
-func (l *Lexer) readNumber() string {
+// readDoubled reads an operator spelt as the current char twice, e.g. "&&".
+// The char on its own is illegal
+func (l *Lexer) readDoubled(doubled token.TokenType) token.Token {
+	if l.peekChar() == l.ch {
+		ch := l.ch
+		l.readChar()
+		return token.Token{Type: doubled, Literal: string(ch) + string(l.ch)}
+	}
+	return newToken(token.ILLEGAL, l.ch)
+}
+
+// readOperator reads an operator which has a second form when followed by "=",
+// e.g. "+" and "+=", "<" and "<="
+func (l *Lexer) readOperator(single, assign token.TokenType) token.Token {
+	if l.peekChar() == '=' {
+		ch := l.ch
+		l.readChar()
+		return token.Token{Type: assign, Literal: string(ch) + string(l.ch)}
+	}
+	return newToken(single, l.ch)
+}
+
+// readNumber reads an integer or a float. A float has a fraction ("3.14"), an
+// exponent ("1e-9") or both; the fraction needs digits on both sides of the "."
+func (l *Lexer) readNumber() (string, token.TokenType) {
 	position := l.position
+	tokenType := token.TokenType(token.INT)
+
+	l.readDigits()
+
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
+		l.readChar()
+		l.readDigits()
+	}
+
+	if l.ch == 'e' || l.ch == 'E' {
+		// only an exponent if digits follow, otherwise the "e" starts the next token
+		next := l.peekChar()
+		signed := (next == '+' || next == '-') && l.readPosition+1 < len(l.input) && isDigit(l.input[l.readPosition+1])
+		if isDigit(next) || signed {
+			tokenType = token.FLOAT
+			l.readChar()
+			if signed {
+				l.readChar()
+			}
+			l.readDigits()
+		}
+	}
+
+	return l.input[position:l.position], tokenType
+}
+
+func (l *Lexer) readDigits() {
 	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
 }
 
+// readComment reads a // line comment or a /* block comment */, delimiters included.
+// Block comments nest, so a commented out region may itself contain comments
+func (l *Lexer) readComment() string {
+	start := l.pos()
+
+	if l.peekChar() == '/' {
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+		return l.input[start.Offset:l.position]
+	}
+
+	depth := 0
+	for {
+		switch {
+		case l.ch == 0:
+			l.errorAt(diag.Span{Pos: start, End: l.pos()}, diag.CodeUnterminatedComment, "unterminated block comment")
+			return l.input[start.Offset:l.position]
+		case l.ch == '/' && l.peekChar() == '*':
+			depth++
+			l.readChar()
+		case l.ch == '*' && l.peekChar() == '/':
+			depth--
+			l.readChar()
+			if depth == 0 {
+				l.readChar()
+				return l.input[start.Offset:l.position]
+			}
+		}
+		l.readChar()
+	}
+}
+
+// readString reads a string literal, leaving the lexer on the closing quote,
+// and returns its value with escape sequences decoded
 func (l *Lexer) readString() string {
-	position := l.position + 1
+	start := l.pos()
+	var out strings.Builder
+
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+
+		switch l.ch {
+		case '"':
+			return out.String()
+		case 0:
+			l.errorAt(diag.Span{Pos: start, End: l.pos()}, diag.CodeUnterminatedString, "unterminated string literal")
+			return out.String()
+		case '\\':
+			l.readEscape(&out)
+		default:
+			out.WriteByte(l.ch)
 		}
 	}
-	return l.input[position:l.position]
+}
+
+var escapes = map[byte]byte{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'0':  0,
+	'\\': '\\',
+	'"':  '"',
+}
+
+// readEscape decodes the escape sequence starting at the current backslash into out,
+// leaving the lexer on its last char
+func (l *Lexer) readEscape(out *strings.Builder) {
+	start := l.pos()
+	l.readChar()
+
+	if decoded, ok := escapes[l.ch]; ok {
+		out.WriteByte(decoded)
+		return
+	}
+
+	switch l.ch {
+	case 'u':
+		l.readUnicodeEscape(start, out)
+	case 0:
+		// let readString report the missing closing quote
+	default:
+		l.errorAt(l.spanThrough(start), diag.CodeInvalidEscape, "unknown escape sequence \\%c", l.ch)
+	}
+}
+
+// readUnicodeEscape decodes a \u{...} escape of 1 to 6 hex digits. start is the position of the backslash
+func (l *Lexer) readUnicodeEscape(start token.Position, out *strings.Builder) {
+	if l.peekChar() != '{' {
+		l.errorAt(l.spanThrough(start), diag.CodeInvalidEscape, "expected { after \\u")
+		return
+	}
+	l.readChar()
+
+	digitsStart := l.readPosition
+	for isHexDigit(l.peekChar()) {
+		l.readChar()
+	}
+	digits := l.input[digitsStart:l.readPosition]
+
+	if l.peekChar() != '}' {
+		l.errorAt(l.spanThrough(start), diag.CodeInvalidEscape, "unterminated unicode escape")
+		return
+	}
+	l.readChar()
+
+	value, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || len(digits) > 6 || !utf8.ValidRune(rune(value)) {
+		l.errorAt(l.spanThrough(start), diag.CodeInvalidEscape, "invalid unicode escape \\u{%s}", digits)
+		return
+	}
+
+	out.WriteRune(rune(value))
+}
+
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
 }
 
 func isDigit(ch byte) bool {
@@ -12,7 +12,7 @@ func TestNextToken(t *testing.T) {
 		x + y;
 	};
 	let result = add(five, ten);
-	!-/*5;
+	!-/ *5;
 	5 < 10 > 5;
 
 	if (5 < 10) {
@@ -139,3 +139,241 @@ func TestNextToken(t *testing.T) {
 	}
 
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := "let x = 5;\n  x + \"ab\"\n"
+
+	tests := []struct {
+		expectedType token.TokenType
+		expectedPos  token.Position
+		expectedEnd  token.Position
+	}{
+		{token.LET, token.Position{Filename: "test.fa", Offset: 0, Line: 1, Column: 1}, token.Position{Filename: "test.fa", Offset: 3, Line: 1, Column: 4}},
+		{token.IDENT, token.Position{Filename: "test.fa", Offset: 4, Line: 1, Column: 5}, token.Position{Filename: "test.fa", Offset: 5, Line: 1, Column: 6}},
+		{token.ASSIGN, token.Position{Filename: "test.fa", Offset: 6, Line: 1, Column: 7}, token.Position{Filename: "test.fa", Offset: 7, Line: 1, Column: 8}},
+		{token.INT, token.Position{Filename: "test.fa", Offset: 8, Line: 1, Column: 9}, token.Position{Filename: "test.fa", Offset: 9, Line: 1, Column: 10}},
+		{token.SEMICOLON, token.Position{Filename: "test.fa", Offset: 9, Line: 1, Column: 10}, token.Position{Filename: "test.fa", Offset: 10, Line: 1, Column: 11}},
+		{token.IDENT, token.Position{Filename: "test.fa", Offset: 13, Line: 2, Column: 3}, token.Position{Filename: "test.fa", Offset: 14, Line: 2, Column: 4}},
+		{token.PLUS, token.Position{Filename: "test.fa", Offset: 15, Line: 2, Column: 5}, token.Position{Filename: "test.fa", Offset: 16, Line: 2, Column: 6}},
+		{token.STRING, token.Position{Filename: "test.fa", Offset: 17, Line: 2, Column: 7}, token.Position{Filename: "test.fa", Offset: 21, Line: 2, Column: 11}},
+		{token.EOF, token.Position{Filename: "test.fa", Offset: 22, Line: 3, Column: 1}, token.Position{Filename: "test.fa", Offset: 22, Line: 3, Column: 1}},
+		{token.EOF, token.Position{Filename: "test.fa", Offset: 22, Line: 3, Column: 1}, token.Position{Filename: "test.fa", Offset: 22, Line: 3, Column: 1}},
+	}
+
+	l := NewFile("test.fa", input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Pos != tt.expectedPos {
+			t.Errorf("tests[%d] - pos wrong. expected=%+v, got=%+v",
+				i, tt.expectedPos, tok.Pos)
+		}
+
+		if tok.End != tt.expectedEnd {
+			t.Errorf("tests[%d] - end wrong. expected=%+v, got=%+v",
+				i, tt.expectedEnd, tok.End)
+		}
+	}
+}
+
+func TestIllegalCharacterErrors(t *testing.T) {
+	l := New("let a = 1 @ 2;\n#")
+
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+	}
+
+	expected := []string{`1:11: illegal character "@"`, `2:1: illegal character "#"`}
+	errors := l.Errors()
+	if len(errors) != len(expected) {
+		t.Fatalf("wrong number of errors, expected=%d got=%d (%v)", len(expected), len(errors), errors)
+	}
+	for i, msg := range expected {
+		if errors[i].Error() != msg {
+			t.Errorf("errors[%d] wrong, expected=%q got=%q", i, msg, errors[i].Error())
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// leading comment
+let a = 10 / 2; // trailing comment
+/* block /* nested */ still a comment */ a
+/* unterminated`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.COMMENT, "// leading comment"},
+		{token.LET, "let"},
+		{token.IDENT, "a"},
+		{token.ASSIGN, "="},
+		{token.INT, "10"},
+		{token.SLASH, "/"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.COMMENT, "// trailing comment"},
+		{token.COMMENT, "/* block /* nested */ still a comment */"},
+		{token.IDENT, "a"},
+		{token.COMMENT, "/* unterminated"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	l.KeepComments()
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+
+	errors := l.Errors()
+	if len(errors) != 1 || errors[0].Error() != "4:1: unterminated block comment" {
+		t.Errorf("expected an unterminated comment error, got %v", errors)
+	}
+
+	// without KeepComments the comments are skipped entirely
+	l = New(input)
+	for _, tt := range tests {
+		if tt.expectedType == token.COMMENT {
+			continue
+		}
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tokentype wrong skipping comments. expected=%q, got=%q", tt.expectedType, tok.Type)
+		}
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	input := `5 3.14 1e-9 2.5E+3 7e 1.foo 10`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INT, "5"},
+		{token.FLOAT, "3.14"},
+		{token.FLOAT, "1e-9"},
+		{token.FLOAT, "2.5E+3"},
+		{token.INT, "7"},
+		{token.IDENT, "e"},
+		{token.INT, "1"},
+		{token.DOT, "."},
+		{token.IDENT, "foo"},
+		{token.INT, "10"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedLiteral string
+		expectedErrors  []string
+	}{
+		{`"a\nb"`, "a\nb", nil},
+		{`"tab\there"`, "tab\there", nil},
+		{`"say \"hi\""`, `say "hi"`, nil},
+		{`"back\\slash"`, `back\slash`, nil},
+		{`"\u{48}\u{e9}\u{1F600}"`, "Hé😀", nil},
+		{`"bad \q escape"`, "bad  escape", []string{`1:6: unknown escape sequence \q`}},
+		{`"\u{110000}"`, "", []string{`1:2: invalid unicode escape \u{110000}`}},
+		{`"\u41"`, "41", []string{`1:2: expected { after \u`}},
+		{"\"never closed\nlet x = 1;", "never closed\nlet x = 1;", []string{`1:1: unterminated string literal`}},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+
+		if tok.Type != token.STRING {
+			t.Fatalf("tokentype wrong for %q. expected=%q, got=%q", tt.input, token.STRING, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Errorf("literal wrong for %q. expected=%q, got=%q", tt.input, tt.expectedLiteral, tok.Literal)
+		}
+
+		errors := l.Errors()
+		if len(errors) != len(tt.expectedErrors) {
+			t.Errorf("wrong number of errors for %q, expected=%d got=%d (%v)", tt.input, len(tt.expectedErrors), len(errors), errors)
+			continue
+		}
+		for i, msg := range tt.expectedErrors {
+			if errors[i].Error() != msg {
+				t.Errorf("errors[%d] wrong for %q, expected=%q got=%q", i, tt.input, msg, errors[i].Error())
+			}
+		}
+	}
+}
+
+func TestOperators(t *testing.T) {
+	input := `x = 1; x += 2; x -= 3; x *= 4; x /= 5; x %= 6; a..b ...c
+	a && b || c <= d >= e % f & |`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "x"}, {token.ASSIGN, "="}, {token.INT, "1"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.PLUS_ASSIGN, "+="}, {token.INT, "2"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.MINUS_ASSIGN, "-="}, {token.INT, "3"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.ASTERISK_ASSIGN, "*="}, {token.INT, "4"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.SLASH_ASSIGN, "/="}, {token.INT, "5"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.PERCENT_ASSIGN, "%="}, {token.INT, "6"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "a"}, {token.RANGE, ".."}, {token.IDENT, "b"},
+		{token.ELLIPSIS, "..."}, {token.IDENT, "c"},
+		{token.IDENT, "a"}, {token.AND, "&&"}, {token.IDENT, "b"}, {token.OR, "||"},
+		{token.IDENT, "c"}, {token.LT_EQ, "<="}, {token.IDENT, "d"}, {token.GT_EQ, ">="},
+		{token.IDENT, "e"}, {token.PERCENT, "%"}, {token.IDENT, "f"},
+		{token.ILLEGAL, "&"}, {token.ILLEGAL, "|"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
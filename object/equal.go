@@ -0,0 +1,97 @@
+package object
+
+// Equal reports whether a and b are the same value. Strings, numbers and booleans
+// are compared by value, arrays element by element and hashes pair by pair, in any
+// order. Values of different types are never equal, so 1 and 1.0 differ here, as they
+// do as hash keys. Anything else, such as a function, is only equal to itself
+func Equal(a, b Object) bool {
+	return equal(a, b, nil)
+}
+
+// pair is two values being compared. Collections are compared with a stack of
+// pairs rather than by recursing, so deeply nested ones can't exhaust Go's stack,
+// and the pairs of collections already compared are recorded, so comparing
+// collections that contain themselves stops rather than going on forever
+type pair struct{ a, b Object }
+
+func equal(a, b Object, seen map[pair]bool) bool {
+	stack := []pair{{a, b}}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		a, b := p.a, p.b
+		if a == b {
+			continue
+		}
+		if a.Type() != b.Type() {
+			return false
+		}
+
+		switch a := a.(type) {
+		case *Array:
+			b := b.(*Array)
+			if len(a.Elements) != len(b.Elements) {
+				return false
+			}
+			if seen[p] {
+				continue
+			}
+			if seen == nil {
+				seen = make(map[pair]bool)
+			}
+			seen[p] = true
+
+			// pushed last to first, so elements are compared in order
+			for i := len(a.Elements) - 1; i >= 0; i-- {
+				stack = append(stack, pair{a.Elements[i], b.Elements[i]})
+			}
+		case *Hash:
+			b := b.(*Hash)
+			if a.Len() != b.Len() {
+				return false
+			}
+			if seen[p] {
+				continue
+			}
+			if seen == nil {
+				seen = make(map[pair]bool)
+			}
+			seen[p] = true
+
+			for i := len(a.pairs) - 1; i >= 0; i-- {
+				value, ok := b.Get(a.pairs[i].Key.(Hashable))
+				if !ok {
+					return false
+				}
+				stack = append(stack, pair{a.pairs[i].Value, value})
+			}
+		default:
+			if !equalValue(a, b) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// equalValue compares a and b, of the same type, when they aren't collections
+func equalValue(a, b Object) bool {
+	switch a := a.(type) {
+	case *Integer:
+		return a.Value == b.(*Integer).Value
+	case *BigInt:
+		return a.Value.Cmp(b.(*BigInt).Value) == 0
+	case *Float:
+		x, y := a.Value, b.(*Float).Value
+		return x == y || (x != x && y != y) // NaN equals itself, so it can be found as a key
+	case *Boolean:
+		return a.Value == b.(*Boolean).Value
+	case *String:
+		return a.Value == b.(*String).Value
+	case *Range:
+		return a.Start == b.(*Range).Start && a.End == b.(*Range).End
+	default:
+		return false
+	}
+}
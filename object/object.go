@@ -2,9 +2,16 @@ package object
 
 import (
 	"bytes"
+	"encoding/binary"
 	"farcical/ast"
+	"farcical/diag"
+	"farcical/token"
 	"fmt"
+	"hash"
 	"hash/fnv"
+	"math"
+	"math/big"
+	"strconv"
 	"strings"
 )
 
@@ -12,6 +19,8 @@ type ObjectType string
 
 const (
 	INTEGER_OBJ      = "INTEGER"
+	BIGINT_OBJ       = "BIGINT"
+	FLOAT_OBJ        = "FLOAT"
 	BOOLEAN_OBJ      = "BOOLEAN"
 	NULL_OBJ         = "NULL"
 	RETURN_VALUE_OBJ = "RETURN_VALUE"
@@ -21,14 +30,96 @@ const (
 	BUILTIN_OBJ      = "BUILTIN"
 	ARRAY_OBJ        = "ARRAY"
 	HASH_OBJ         = "HASH"
+	RANGE_OBJ        = "RANGE"
+	BREAK_OBJ        = "BREAK"
+	CONTINUE_OBJ     = "CONTINUE"
+	NAMESPACE_OBJ    = "NAMESPACE"
 )
 
 type Error struct {
 	Message string
+	Kind    string    // the error's type as scripts see it, empty for an ordinary runtime error
+	Value   Object    // the value passed to throw, nil for errors raised by the evaluator
+	Span    diag.Span // the node being evaluated when the error was raised
+	Stack   []Frame   // the function calls active when the error was raised, outermost first
+	Cause   error     // the Go error behind this one, e.g. context.Canceled when evaluation was stopped
+}
+
+// Frame is one function call on the evaluator's call stack
+type Frame struct {
+	Function string    // the name the function was bound to, or "<anonymous>"
+	CallSite diag.Span // the call expression that invoked it
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
-func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
+
+// ErrorType is the type of the error as scripts see it when they catch it
+func (e *Error) ErrorType() string {
+	if e.Kind == "" {
+		return "RuntimeError"
+	}
+	return e.Kind
+}
+
+// Inspect prints a Python-style traceback, most recent call last, when the
+// error was raised inside a function
+func (e *Error) Inspect() string {
+	if len(e.Stack) == 0 {
+		return "ERROR: " + e.Message
+	}
+
+	var out bytes.Buffer
+
+	out.WriteString("Traceback (most recent call last):\n")
+	for _, line := range e.Traceback() {
+		out.WriteString("  " + line + "\n")
+	}
+	out.WriteString("ERROR: " + e.Message)
+
+	return out.String()
+}
+
+// Traceback describes where each function on the stack was running, outermost
+// first, ending with where the error was raised
+func (e *Error) Traceback() []string {
+	lines := []string{}
+
+	// each frame is running at the call site of the frame above it, the innermost at the error itself
+	function := "<main>"
+	for _, frame := range e.Stack {
+		lines = append(lines, fmt.Sprintf("%s, in %s", describeLocation(frame.CallSite.Pos), function))
+		function = frame.Function
+	}
+	return append(lines, fmt.Sprintf("%s, in %s", describeLocation(e.Span.Pos), function))
+}
+
+func describeLocation(pos token.Position) string {
+	if pos.Filename != "" {
+		return fmt.Sprintf("File %q, line %d, column %d", pos.Filename, pos.Line, pos.Column)
+	}
+	return fmt.Sprintf("line %d, column %d", pos.Line, pos.Column)
+}
+
+// Diagnostic describes the error in the same form as lexer and parser errors,
+// with a note at each call site on the stack
+func (e *Error) Diagnostic() diag.Diagnostic {
+	d := diag.Diagnostic{
+		Severity: diag.Error,
+		Code:     diag.CodeRuntime,
+		Message:  e.Message,
+		Span:     e.Span,
+	}
+
+	for i := len(e.Stack) - 1; i >= 0; i-- {
+		frame := e.Stack[i]
+		d.Notes = append(d.Notes, diag.Note{
+			Span:    frame.CallSite,
+			Message: fmt.Sprintf("in call to %s", frame.Function),
+		})
+	}
+
+	return d
+}
 
 type Object interface {
 	Type() ObjectType
@@ -42,6 +133,38 @@ type Integer struct {
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 
+// BigInt is an integer too big for an Integer. Integer arithmetic that overflows
+// gives a BigInt, and BigInt arithmetic whose result fits gives an Integer again,
+// so the two never hold the same value
+type BigInt struct {
+	Value *big.Int
+}
+
+func (b *BigInt) Inspect() string  { return b.Value.String() }
+func (b *BigInt) Type() ObjectType { return BIGINT_OBJ }
+
+// NewInteger returns an Integer holding value if it fits in one, or else a BigInt
+func NewInteger(value *big.Int) Object {
+	if value.IsInt64() {
+		return &Integer{Value: value.Int64()}
+	}
+	return &BigInt{Value: value}
+}
+
+type Float struct {
+	Value float64
+}
+
+// Inspect always includes a decimal point or exponent so floats are distinguishable from integers
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") { // e, Inf, NaN
+		s += ".0"
+	}
+	return s
+}
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+
 type Boolean struct {
 	Value bool
 }
@@ -61,8 +184,22 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// Break and Continue propagate out of a loop body the way ReturnValue propagates out of a function
+type Break struct{}
+
+func (b *Break) Type() ObjectType { return BREAK_OBJ }
+func (b *Break) Inspect() string  { return "break" }
+
+type Continue struct{}
+
+func (c *Continue) Type() ObjectType { return CONTINUE_OBJ }
+func (c *Continue) Inspect() string  { return "continue" }
+
 type Function struct {
+	Name       string // set when the function is first bound with let, empty for anonymous functions
 	Parameters []*ast.Identifier
+	Defaults   []ast.Expression // evaluated in the call's environment when an argument is missing
+	Rest       *ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
 }
@@ -71,14 +208,9 @@ func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
 func (f *Function) Inspect() string {
 	var out bytes.Buffer
 
-	params := []string{}
-	for _, p := range f.Parameters {
-		params = append(params, p.String())
-	}
-
 	out.WriteString("fn")
 	out.WriteString("(")
-	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(ast.ParametersString(f.Parameters, f.Defaults, f.Rest))
 	out.WriteString(") {\n")
 	out.WriteString(f.Body.String())
 	out.WriteString("\n}")
@@ -93,7 +225,13 @@ type String struct {
 func (s *String) Type() ObjectType { return STRING_OBJ }
 func (s *String) Inspect() string  { return s.Value }
 
-type BuiltinFunction func(args ...Object) Object
+// Runtime is the interpreter running a builtin, through which the builtin can call
+// back into Farcical functions. Errors come back as *Error values, as from any call
+type Runtime interface {
+	Call(fn Object, args ...Object) Object
+}
+
+type BuiltinFunction func(rt Runtime, args ...Object) Object
 
 type Builtin struct {
 	Fn BuiltinFunction
@@ -102,26 +240,31 @@ type Builtin struct {
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
 func (b *Builtin) Inspect() string  { return "builtin function" }
 
+// Namespace groups related values under one name, e.g. the builtins str.upper and str.lower
+type Namespace struct {
+	Name    string
+	Members map[string]Object
+}
+
+func (n *Namespace) Type() ObjectType { return NAMESPACE_OBJ }
+func (n *Namespace) Inspect() string  { return "namespace " + n.Name }
+
 type Array struct {
 	Elements []Object
 }
 
 func (ao *Array) Type() ObjectType { return ARRAY_OBJ }
-func (ao *Array) Inspect() string {
-	var out bytes.Buffer
+func (ao *Array) Inspect() string  { return inspect(ao) }
 
-	elements := []string{}
-	for _, e := range ao.Elements {
-		elements = append(elements, e.Inspect())
-	}
-
-	out.WriteString("[")
-	out.WriteString(strings.Join(elements, ", "))
-	out.WriteString("]")
-
-	return out.String()
+// Range is the integers from Start up to but not including End
+type Range struct {
+	Start int64
+	End   int64
 }
 
+func (r *Range) Type() ObjectType { return RANGE_OBJ }
+func (r *Range) Inspect() string  { return fmt.Sprintf("%d..%d", r.Start, r.End) }
+
 type HashKey struct {
 	Type  ObjectType
 	Value uint64
@@ -141,37 +284,309 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+func (b *BigInt) HashKey() HashKey {
+	h := fnv.New64a()
+	h.Write([]byte{byte(b.Value.Sign() + 1)})
+	h.Write(b.Value.Bytes())
+	return HashKey{Type: b.Type(), Value: h.Sum64()}
+}
+
+func (f *Float) HashKey() HashKey {
+	value := f.Value
+	if value == 0 {
+		value = 0 // -0.0 and 0.0 are equal so must hash the same
+	}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(value)}
+}
+
 func (s *String) HashKey() HashKey {
 	h := fnv.New64a()
 	h.Write([]byte(s.Value))
 	return HashKey{Type: s.Type(), Value: h.Sum64()}
 }
 
+// HashKey of an array combines the HashKeys of its elements, so arrays with equal elements share one.
+// Nested arrays are hashed with a stack of its own rather than by recursing, so deep nesting can't
+// exhaust Go's, and an array met again inside itself stands in a fixed key rather than recursing forever
+func (ao *Array) HashKey() HashKey {
+	type level struct {
+		arr  *Array
+		next int
+		h    hash.Hash64
+	}
+	stack := []level{{arr: ao, h: fnv.New64a()}}
+	path := map[*Array]bool{ao: true}
+
+	var buf [8]byte
+	write := func(h hash.Hash64, key HashKey) {
+		h.Write([]byte(key.Type))
+		binary.LittleEndian.PutUint64(buf[:], key.Value)
+		h.Write(buf[:])
+	}
+
+	for {
+		top := &stack[len(stack)-1]
+		if top.next == len(top.arr.Elements) {
+			key := HashKey{Type: ARRAY_OBJ, Value: top.h.Sum64()}
+			delete(path, top.arr)
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return key
+			}
+			write(stack[len(stack)-1].h, key)
+			continue
+		}
+		el := top.arr.Elements[top.next]
+		top.next++
+
+		arr, ok := el.(*Array)
+		switch {
+		case !ok:
+			write(top.h, el.(Hashable).HashKey())
+		case path[arr]:
+			write(top.h, HashKey{Type: ARRAY_OBJ})
+		default:
+			path[arr] = true
+			stack = append(stack, level{arr: arr, h: fnv.New64a()})
+		}
+	}
+}
+
 type HashPair struct {
 	Key   Object
 	Value Object
 }
 
+// Hash maps keys to values, remembering the order keys were first set in so that
+// iterating over or printing a hash always gives the same result. Keys are found
+// by their HashKey and then compared with Equal, so keys whose HashKeys collide
+// are still kept apart
 type Hash struct {
-	Pairs map[HashKey]HashPair
+	pairs   []HashPair        // in the order their keys were first set
+	buckets map[HashKey][]int // the indices in pairs of the keys with each HashKey
 }
 
 func (h *Hash) Type() ObjectType { return HASH_OBJ }
-func (h *Hash) Inspect() string {
+func (h *Hash) Inspect() string  { return inspect(h) }
+
+// inspectStep is a piece of inspect's work: writing text, printing obj, or, with
+// leave set, noting that the collection obj has been printed
+type inspectStep struct {
+	text  string
+	obj   Object
+	leave bool
+}
+
+// inspect is Inspect for arrays and hashes, which index assignment can make contain
+// themselves. It keeps its own stack of steps rather than recursing, so deep nesting
+// can't exhaust Go's. path holds the collections being printed around the current
+// step; one met again is printed as [...] or {...} rather than recursing forever
+func inspect(obj Object) string {
 	var out bytes.Buffer
+	path := make(map[Object]bool)
+
+	stack := []inspectStep{{obj: obj}}
+	for len(stack) > 0 {
+		step := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		switch obj := step.obj.(type) {
+		case nil:
+			out.WriteString(step.text)
+		case *Array:
+			if step.leave {
+				delete(path, obj)
+				break
+			}
+			if path[obj] {
+				out.WriteString("[...]")
+				break
+			}
+			path[obj] = true
+
+			// pushed last to first, so they're printed in order
+			stack = append(stack, inspectStep{obj: obj, leave: true}, inspectStep{text: "]"})
+			for i := len(obj.Elements) - 1; i >= 0; i-- {
+				stack = append(stack, inspectStep{obj: obj.Elements[i]})
+				if i > 0 {
+					stack = append(stack, inspectStep{text: ", "})
+				}
+			}
+			out.WriteString("[")
+		case *Hash:
+			if step.leave {
+				delete(path, obj)
+				break
+			}
+			if path[obj] {
+				out.WriteString("{...}")
+				break
+			}
+			path[obj] = true
+
+			stack = append(stack, inspectStep{obj: obj, leave: true}, inspectStep{text: "}"})
+			for i := len(obj.pairs) - 1; i >= 0; i-- {
+				stack = append(stack, inspectStep{obj: obj.pairs[i].Value}, inspectStep{text: ": "}, inspectStep{obj: obj.pairs[i].Key})
+				if i > 0 {
+					stack = append(stack, inspectStep{text: ", "})
+				}
+			}
+			out.WriteString("{")
+		default:
+			out.WriteString(obj.Inspect())
+		}
+	}
 
-	pairs := []string{}
-	for _, pair := range h.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), pair.Value.Inspect()))
+	return out.String()
+}
+
+// find returns the index in pairs of key, or -1 if it isn't in the hash
+func (h *Hash) find(key Hashable, hashed HashKey) int {
+	for _, i := range h.buckets[hashed] {
+		if Equal(h.pairs[i].Key, key) {
+			return i
+		}
 	}
+	return -1
+}
 
-	out.WriteString("{")
-	out.WriteString(strings.Join(pairs, ", "))
-	out.WriteString("}")
+// Set stores value under key. A new key goes after the existing ones, while
+// replacing the value of an existing key leaves it where it was. Array keys
+// are copied, so changing the array afterwards doesn't change the hash
+func (h *Hash) Set(key Hashable, value Object) {
+	hashed := key.HashKey()
+	if i := h.find(key, hashed); i >= 0 {
+		h.pairs[i].Value = value
+		return
+	}
 
-	return out.String()
+	if h.buckets == nil {
+		h.buckets = make(map[HashKey][]int)
+	}
+	h.buckets[hashed] = append(h.buckets[hashed], len(h.pairs))
+	h.pairs = append(h.pairs, HashPair{Key: freezeKey(key), Value: value})
+}
+
+// Get returns the value stored under key
+func (h *Hash) Get(key Hashable) (Object, bool) {
+	if i := h.find(key, key.HashKey()); i >= 0 {
+		return h.pairs[i].Value, true
+	}
+	return nil, false
+}
+
+// Delete removes key and its value, reporting whether it was there
+func (h *Hash) Delete(key Hashable) bool {
+	i := h.find(key, key.HashKey())
+	if i < 0 {
+		return false
+	}
+
+	h.pairs = append(h.pairs[:i:i], h.pairs[i+1:]...)
+	h.buckets = make(map[HashKey][]int, len(h.pairs))
+	for j, pair := range h.pairs {
+		hashed := pair.Key.(Hashable).HashKey()
+		h.buckets[hashed] = append(h.buckets[hashed], j)
+	}
+	return true
+}
+
+// Len returns the number of pairs in the hash
+func (h *Hash) Len() int { return len(h.pairs) }
+
+// Ordered returns the pairs in the order their keys were first set. Array keys
+// are copies, like those Set stores, so the hash can't be changed through them
+func (h *Hash) Ordered() []HashPair {
+	pairs := make([]HashPair, len(h.pairs))
+	for i, pair := range h.pairs {
+		pairs[i] = HashPair{Key: freezeKey(pair.Key.(Hashable)), Value: pair.Value}
+	}
+	return pairs
 }
 
+// freezeKey copies an array key, all the way down, so the hash has the only reference to it.
+// The copy of each array is remembered, so an array appearing twice in a key, or inside
+// itself, is copied once, and nested arrays are copied from a stack rather than by recursing
+func freezeKey(key Hashable) Hashable {
+	arr, ok := key.(*Array)
+	if !ok {
+		return key
+	}
+
+	type level struct{ arr, copied *Array }
+	root := &Array{Elements: make([]Object, len(arr.Elements))}
+	copies := map[*Array]*Array{arr: root}
+	stack := []level{{arr, root}}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for i, el := range top.arr.Elements {
+			nested, ok := el.(*Array)
+			if !ok {
+				top.copied.Elements[i] = el
+				continue
+			}
+			copied, ok := copies[nested]
+			if !ok {
+				copied = &Array{Elements: make([]Object, len(nested.Elements))}
+				copies[nested] = copied
+				stack = append(stack, level{nested, copied})
+			}
+			top.copied.Elements[i] = copied
+		}
+	}
+	return root
+}
+
+// Hashable is implemented by the types that can be hash keys. Arrays implement it
+// but are only usable as keys when all their elements are, so check keys with AsHashable
 type Hashable interface {
+	Object
 	HashKey() HashKey
-}
\ No newline at end of file
+}
+
+// AsHashable returns obj as a Hashable if it can be used as a hash key, which an
+// array can be when every element can and it doesn't contain itself. The object
+// returned in place of false is the one that can't be a key, for reporting its type
+func AsHashable(obj Object) (Hashable, Object, bool) {
+	arr, ok := obj.(*Array)
+	if !ok {
+		if key, ok := obj.(Hashable); ok {
+			return key, nil, true
+		}
+		return nil, obj, false
+	}
+
+	// nested arrays are checked from a stack of the ones on the path down to the
+	// current element, rather than by recursing, so deep nesting can't exhaust Go's
+	type level struct {
+		arr  *Array
+		next int
+	}
+	stack := []level{{arr: arr}}
+	path := map[*Array]bool{arr: true}
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next == len(top.arr.Elements) {
+			delete(path, top.arr)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		el := top.arr.Elements[top.next]
+		top.next++
+
+		switch el := el.(type) {
+		case *Array:
+			if path[el] {
+				return nil, el, false
+			}
+			path[el] = true
+			stack = append(stack, level{arr: el})
+		case Hashable:
+		default:
+			return nil, el, false
+		}
+	}
+	return arr, nil, true
+}
@@ -1,6 +1,8 @@
 package object
 
 import (
+	"math"
+	"runtime/debug"
 	"testing"
 )
 
@@ -22,3 +24,183 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("strings with different content have same hash keys")
 	}
 }
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{3.14, "3.14"},
+		{3, "3.0"},
+		{-0.5, "-0.5"},
+		{1e-9, "1e-09"},
+		{1e21, "1e+21"},
+	}
+
+	for _, tt := range tests {
+		f := &Float{Value: tt.value}
+		if f.Inspect() != tt.expected {
+			t.Errorf("Inspect() wrong, expected=%q got=%q", tt.expected, f.Inspect())
+		}
+	}
+}
+
+// collidingKey hashes the same as every other collidingKey
+type collidingKey struct{ name string }
+
+func (c *collidingKey) Type() ObjectType { return "COLLIDING" }
+func (c *collidingKey) Inspect() string  { return c.name }
+func (c *collidingKey) HashKey() HashKey { return HashKey{Type: "COLLIDING", Value: 1} }
+
+func TestHashCollisions(t *testing.T) {
+	a, b, c := &collidingKey{"a"}, &collidingKey{"b"}, &collidingKey{"c"}
+	hash := &Hash{}
+	hash.Set(a, &Integer{Value: 1})
+	hash.Set(b, &Integer{Value: 2})
+	hash.Set(c, &Integer{Value: 3})
+	hash.Set(a, &Integer{Value: 4})
+
+	if hash.Len() != 3 {
+		t.Fatalf("colliding keys overwrote each other, got %s", hash.Inspect())
+	}
+	if !hash.Delete(b) || hash.Delete(b) {
+		t.Errorf("Delete(b) wrong")
+	}
+	for key, expected := range map[Hashable]int64{a: 4, c: 3} {
+		value, ok := hash.Get(key)
+		if !ok || value.(*Integer).Value != expected {
+			t.Errorf("Get(%s) = %v, want %d", key.Inspect(), value, expected)
+		}
+	}
+	if _, ok := hash.Get(b); ok {
+		t.Errorf("deleted key still found")
+	}
+	if hash.Inspect() != "{a: 4, c: 3}" {
+		t.Errorf("wrong order after delete, got %s", hash.Inspect())
+	}
+}
+
+func TestEqual(t *testing.T) {
+	nested := func() *Array {
+		return &Array{Elements: []Object{&Integer{Value: 1}, &Array{Elements: []Object{&String{Value: "x"}}}}}
+	}
+	hash := func(pairs ...Object) *Hash {
+		h := &Hash{}
+		for i := 0; i < len(pairs); i += 2 {
+			h.Set(pairs[i].(Hashable), pairs[i+1])
+		}
+		return h
+	}
+	one, two := &String{Value: "one"}, &String{Value: "two"}
+
+	tests := []struct {
+		a, b     Object
+		expected bool
+	}{
+		{&String{Value: "a"}, &String{Value: "a"}, true},
+		{&Integer{Value: 1}, &Float{Value: 1}, false},
+		{&Float{Value: 0}, &Float{Value: math.Copysign(0, -1)}, true},
+		{&Float{Value: math.NaN()}, &Float{Value: math.NaN()}, true},
+		{nested(), nested(), true},
+		{nested(), &Array{Elements: []Object{&Integer{Value: 1}}}, false},
+		{hash(one, &Integer{Value: 1}, two, nested()), hash(two, nested(), one, &Integer{Value: 1}), true},
+		{hash(one, &Integer{Value: 1}), hash(two, &Integer{Value: 1}), false},
+	}
+
+	for _, tt := range tests {
+		if Equal(tt.a, tt.b) != tt.expected {
+			t.Errorf("Equal(%s, %s) = %t, want %t", tt.a.Inspect(), tt.b.Inspect(), !tt.expected, tt.expected)
+		}
+	}
+
+	// arrays are equal when their elements are, wherever their HashKeys agree
+	if nested().HashKey() != nested().HashKey() {
+		t.Errorf("equal arrays have different hash keys")
+	}
+}
+
+func TestCyclicInspect(t *testing.T) {
+	arr := &Array{Elements: []Object{&Integer{Value: 1}}}
+	arr.Elements = append(arr.Elements, arr)
+	if arr.Inspect() != "[1, [...]]" {
+		t.Errorf("wrong Inspect of an array containing itself, got %s", arr.Inspect())
+	}
+
+	hash := &Hash{}
+	hash.Set(&String{Value: "self"}, hash)
+	hash.Set(&String{Value: "arr"}, &Array{Elements: []Object{hash, arr}})
+	if hash.Inspect() != "{self: {...}, arr: [{...}, [1, [...]]]}" {
+		t.Errorf("wrong Inspect of a hash containing itself, got %s", hash.Inspect())
+	}
+}
+
+func TestCyclicArrayKeys(t *testing.T) {
+	cyclic := &Array{Elements: []Object{&Integer{Value: 1}}}
+	cyclic.Elements = append(cyclic.Elements, &Array{Elements: []Object{cyclic}})
+
+	if _, bad, ok := AsHashable(cyclic); ok || bad != cyclic {
+		t.Errorf("an array containing itself was accepted as a key")
+	}
+	if cyclic.HashKey() != cyclic.HashKey() {
+		t.Errorf("hash key of an array containing itself isn't stable")
+	}
+
+	// an array that appears twice without containing itself is still a key, and is copied once
+	shared := &Array{Elements: []Object{&Integer{Value: 1}}}
+	key := &Array{Elements: []Object{shared, shared}}
+	if _, _, ok := AsHashable(key); !ok {
+		t.Fatalf("an array holding the same array twice was rejected")
+	}
+	frozen := freezeKey(key).(*Array)
+	if frozen.Elements[0] != frozen.Elements[1] || frozen.Elements[0] == shared {
+		t.Errorf("shared element not copied once")
+	}
+
+	// freezing doesn't recurse forever on an array that contains itself either
+	frozen = freezeKey(cyclic).(*Array)
+	if inner := frozen.Elements[1].(*Array); inner.Elements[0] != frozen {
+		t.Errorf("copy of an array containing itself doesn't contain itself")
+	}
+}
+
+func TestDeeplyNested(t *testing.T) {
+	// a small stack stands in for nesting deep enough to exhaust the usual one
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+
+	const depth = 100000
+	nest := func(innermost Object) *Array {
+		arr := &Array{Elements: []Object{innermost}}
+		for i := 1; i < depth; i++ {
+			arr = &Array{Elements: []Object{arr}}
+		}
+		return arr
+	}
+	a, b, c := nest(&Integer{Value: 1}), nest(&Integer{Value: 1}), nest(&Integer{Value: 2})
+
+	// none of these may recurse once per level
+	if !Equal(a, b) || Equal(a, c) {
+		t.Errorf("wrong equality of deeply nested arrays")
+	}
+	if s := a.Inspect(); len(s) != 2*depth+1 || s[depth] != '1' {
+		t.Errorf("wrong Inspect of a deeply nested array")
+	}
+	if a.HashKey() != b.HashKey() || a.HashKey() == c.HashKey() {
+		t.Errorf("wrong hash keys of deeply nested arrays")
+	}
+	if _, _, ok := AsHashable(a); !ok {
+		t.Fatalf("a deeply nested array was rejected as a key")
+	}
+
+	hash := &Hash{}
+	hash.Set(a, &String{Value: "found"})
+	hash.Set(&String{Value: "x"}, c)
+	if value, ok := hash.Get(b); !ok || value.Inspect() != "found" {
+		t.Errorf("deeply nested key not found")
+	}
+	other := &Hash{}
+	other.Set(&String{Value: "x"}, nest(&Integer{Value: 2}))
+	other.Set(b, &String{Value: "found"})
+	if !Equal(hash, other) {
+		t.Errorf("hashes with deeply nested keys and values not equal")
+	}
+}
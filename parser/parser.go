@@ -1,18 +1,26 @@
 package parser
 
 import (
+	"errors"
 	"farcical/ast"
+	"farcical/diag"
 	"farcical/lexer"
 	"farcical/token"
 	"fmt"
+	"math/big"
+	"sort"
 	"strconv"
 )
 
 const (
 	_ int = iota // gives the following constants incrementing numbers as values - "_" takes the 0, the others 1-7
 	LOWEST
-	EQUALS      // =
+	ASSIGN      // x = y, x += y
+	LOGICAL_OR  // ||
+	LOGICAL_AND // &&
+	EQUALS      // ==
 	LESSGREATER // > or <
+	RANGE       // 0..10
 	SUM         // +
 	PRODUCT     // *
 	PREFIX      // -X or !X
@@ -21,16 +29,29 @@ const (
 )
 
 var precedences = map[token.TokenType]int{
-	token.LPAREN:   CALL,
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LBRACKET: INDEX,
+	token.ASSIGN:          ASSIGN,
+	token.PLUS_ASSIGN:     ASSIGN,
+	token.MINUS_ASSIGN:    ASSIGN,
+	token.ASTERISK_ASSIGN: ASSIGN,
+	token.SLASH_ASSIGN:    ASSIGN,
+	token.PERCENT_ASSIGN:  ASSIGN,
+	token.OR:              LOGICAL_OR,
+	token.AND:             LOGICAL_AND,
+	token.LPAREN:          CALL,
+	token.EQ:              EQUALS,
+	token.NOT_EQ:          EQUALS,
+	token.LT:              LESSGREATER,
+	token.GT:              LESSGREATER,
+	token.LT_EQ:           LESSGREATER,
+	token.GT_EQ:           LESSGREATER,
+	token.RANGE:           RANGE,
+	token.PLUS:            SUM,
+	token.MINUS:           SUM,
+	token.SLASH:           PRODUCT,
+	token.ASTERISK:        PRODUCT,
+	token.PERCENT:         PRODUCT,
+	token.LBRACKET:        INDEX,
+	token.DOT:             INDEX,
 }
 
 type Parser struct {
@@ -38,7 +59,19 @@ type Parser struct {
 
 	curToken  token.Token
 	peekToken token.Token
-	errors    []string
+	errors    []diag.Diagnostic
+
+	// panicking is set by the first syntax error in a statement and cleared once the
+	// parser has resynchronized at a statement boundary. While it is set further errors
+	// are suppressed, since they are almost always knock-on effects of the first one
+	panicking bool
+
+	// failed is set by any syntax error in the statement being parsed, including an
+	// illegal token the lexer has already reported, so the statement can be dropped
+	failed bool
+
+	loopDepth  int // number of loops enclosing the current token, within the current function
+	blockDepth int // number of blocks enclosing the current token, zero at the top level
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
@@ -50,11 +83,12 @@ type (
 )
 
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l, errors: []string{}}
+	p := &Parser{l: l, errors: []diag.Diagnostic{}}
 
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
@@ -75,8 +109,21 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
+	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.OR, p.parseInfixExpression)
+	p.registerInfix(token.RANGE, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.DOT, p.parseMemberExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PLUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.MINUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.ASTERISK_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.SLASH_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PERCENT_ASSIGN, p.parseAssignExpression)
 
 	// Read 2 tokens so curToken and peekToken are both set
 	p.nextToken()
@@ -85,13 +132,82 @@ func New(l *lexer.Lexer) *Parser {
 	return p
 }
 
-func (p *Parser) Errors() []string {
-	return p.errors
+// Errors returns the lexical and syntax errors found in the input, in source order
+func (p *Parser) Errors() []diag.Diagnostic {
+	errors := append([]diag.Diagnostic{}, p.l.Errors()...)
+	errors = append(errors, p.errors...)
+
+	sort.SliceStable(errors, func(i, j int) bool {
+		return errors[i].Span.Pos.Offset < errors[j].Span.Pos.Offset
+	})
+
+	return errors
+}
+
+// report records a syntax error and puts the parser into panic mode
+func (p *Parser) report(d diag.Diagnostic) {
+	p.failed = true
+	if p.panicking {
+		return
+	}
+	p.panicking = true
+
+	d.Severity = diag.Error
+	p.errors = append(p.errors, d)
+}
+
+func (p *Parser) errorAt(tok token.Token, code string, format string, a ...interface{}) {
+	p.report(diag.Diagnostic{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+		Span:    diag.TokenSpan(tok),
+	})
 }
 
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("Expected next token to be %s, got %s instead", t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.errorAt(p.peekToken, diag.CodeUnexpectedToken, "expected %s, found %s", describeType(t), describeToken(p.peekToken))
+}
+
+// unclosedError reports a missing closing delimiter, pointing back at the one it should match
+func (p *Parser) unclosedError(found token.Token, closing token.TokenType, open token.Token) {
+	p.report(diag.Diagnostic{
+		Code:    diag.CodeUnexpectedToken,
+		Message: fmt.Sprintf("expected %s, found %s", describeType(closing), describeToken(found)),
+		Span:    diag.TokenSpan(found),
+		Notes:   []diag.Note{{Span: diag.TokenSpan(open), Message: "unclosed delimiter"}},
+		Fix:     fmt.Sprintf("insert %s", describeType(closing)),
+	})
+}
+
+// describeType names a token type the way it should appear in an error message
+func describeType(t token.TokenType) string {
+	switch t {
+	case token.IDENT:
+		return "identifier"
+	case token.INT:
+		return "integer"
+	case token.FLOAT:
+		return "float"
+	case token.STRING:
+		return "string"
+	case token.EOF:
+		return "end of file"
+	case token.ILLEGAL:
+		return "illegal character"
+	}
+	if literal, ok := token.KeywordLiteral(t); ok {
+		return fmt.Sprintf("%q", literal)
+	}
+	return fmt.Sprintf("%q", string(t))
+}
+
+// describeToken names an actual token, including its literal where that helps
+func describeToken(tok token.Token) string {
+	switch tok.Type {
+	case token.IDENT, token.INT, token.FLOAT, token.STRING, token.ILLEGAL:
+		return fmt.Sprintf("%s %q", describeType(tok.Type), tok.Literal)
+	}
+	return describeType(tok.Type)
 }
 
 func (p *Parser) peekPrecedence() int {
@@ -120,8 +236,8 @@ func (p *Parser) ParseProgram() *ast.Program {
 	program.Statements = []ast.Statement{}
 
 	for p.curToken.Type != token.EOF {
-		stmt := p.parseStatement()
-		if stmt != nil {
+		stmt, ok, _ := p.parseStatementRecovering()
+		if ok {
 			program.Statements = append(program.Statements, stmt)
 		}
 		p.nextToken()
@@ -129,12 +245,82 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return program
 }
 
+// parseStatementRecovering parses a statement and, if it hit a syntax error, skips
+// ahead to the next statement boundary so parsing can carry on from there.
+// ok is false if the statement contained any syntax error and should be dropped.
+// atBlockEnd is true if recovery stopped on the "}" closing the enclosing block.
+func (p *Parser) parseStatementRecovering() (stmt ast.Statement, ok bool, atBlockEnd bool) {
+	outerFailed := p.failed
+	p.failed = false
+
+	stmt = p.parseStatement()
+
+	failed := p.failed || p.panicking
+	if p.panicking {
+		atBlockEnd = p.synchronize()
+		p.panicking = false
+	}
+
+	// an error in a nested statement fails the statements around it too
+	p.failed = outerFailed || failed
+	return stmt, !failed, atBlockEnd
+}
+
+// synchronize discards tokens until the current token ends a statement: a ";", the
+// token before a "let", "return" or "}", or the "}" closing the enclosing block.
+// Braces opened while skipping are matched so a half-parsed function body is skipped whole.
+// It reports whether it stopped on the enclosing block's "}".
+func (p *Parser) synchronize() bool {
+	depth := 0
+
+	for {
+		switch p.curToken.Type {
+		case token.EOF:
+			return false
+		case token.SEMICOLON:
+			if depth == 0 {
+				return false
+			}
+		case token.LBRACE:
+			depth++
+		case token.RBRACE:
+			if depth == 0 {
+				return true
+			}
+			depth--
+		}
+
+		if depth == 0 {
+			switch p.peekToken.Type {
+			case token.LET, token.RETURN, token.RBRACE, token.EOF:
+				return false
+			}
+		}
+
+		p.nextToken()
+	}
+}
+
 func (p *Parser) parseStatement() ast.Statement {
 	switch p.curToken.Type {
 	case token.LET:
 		return p.parseLetStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.WHILE:
+		return p.parseWhileStatement()
+	case token.FOR:
+		return p.parseForStatement()
+	case token.BREAK, token.CONTINUE:
+		return p.parseLoopControlStatement()
+	case token.TRY:
+		return p.parseTryStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
+	case token.IMPORT:
+		return p.parseImportStatement()
+	case token.EXPORT:
+		return p.parseExportStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -154,6 +340,7 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 }
 
 func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
+	open := p.curToken
 	list := []ast.Expression{}
 
 	if p.peekTokenIs(end) {
@@ -170,16 +357,21 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 		list = append(list, p.parseExpression(LOWEST))
 	}
 
-	if !p.expectPeek(end) {
+	if !p.expectClosing(end, open) {
 		return nil
 	}
 
 	return list
 }
 
-func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+func (p *Parser) noPrefixParseFnError(tok token.Token) {
+	if tok.Type == token.ILLEGAL {
+		// the lexer has already reported it
+		p.failed = true
+		p.panicking = true
+		return
+	}
+	p.errorAt(tok, diag.CodeExpectedExpr, "expected expression, found %s", describeToken(tok))
 }
 
 func (p *Parser) parsePrefixExpression() ast.Expression {
@@ -223,13 +415,45 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
+func (p *Parser) parseAssignExpression(target ast.Expression) ast.Expression {
+	expression := &ast.AssignExpression{
+		Token:    p.curToken,
+		Operator: p.curToken.Literal,
+		Target:   target,
+	}
+
+	switch target.(type) {
+	case *ast.Identifier, *ast.IndexExpression:
+	case nil:
+		return nil // the error has already been reported
+	default:
+		if p.failed {
+			return nil // a target that failed to parse, e.g. the "!" of "! ) = 1", was reported already
+		}
+		p.report(diag.Diagnostic{
+			Code:    diag.CodeInvalidAssignment,
+			Message: fmt.Sprintf("cannot assign to %s", target.String()),
+			Span:    diag.Span{Pos: target.Pos(), End: target.End()},
+		})
+		return nil
+	}
+
+	p.nextToken()
+
+	// one lower than our own precedence makes assignment right associative: a = b = c is a = (b = c)
+	expression.Value = p.parseExpression(ASSIGN - 1)
+
+	return expression
+}
+
 func (p *Parser) parseGroupedExpression() ast.Expression {
 	// defer untrace(trace("parseGroupedExpression"))
+	open := p.curToken
 	p.nextToken()
 
 	exp := p.parseExpression(LOWEST)
 
-	if !p.expectPeek(token.RPAREN) {
+	if !p.expectClosing(token.RPAREN, open) {
 		return nil
 	}
 
@@ -243,11 +467,12 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	if !p.expectPeek(token.LPAREN) {
 		return nil
 	}
+	open := p.curToken
 
 	p.nextToken()
 	expression.Condition = p.parseExpression(LOWEST)
 
-	if !p.expectPeek(token.RPAREN) {
+	if !p.expectClosing(token.RPAREN, open) {
 		return nil
 	}
 
@@ -275,15 +500,27 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
 
+	p.blockDepth++
+	defer func() { p.blockDepth-- }()
+
 	p.nextToken()
 
 	for !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
-		stmt := p.parseStatement()
-		if stmt != nil {
+		stmt, ok, atBlockEnd := p.parseStatementRecovering()
+		if ok {
 			block.Statements = append(block.Statements, stmt)
 		}
+		if atBlockEnd {
+			break
+		}
 		p.nextToken()
 	}
+
+	if !p.curTokenIs(token.RBRACE) {
+		p.unclosedError(p.curToken, token.RBRACE, block.Token)
+	}
+	block.Rbrace = p.curToken
+
 	return block
 }
 
@@ -295,54 +532,87 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
-	lit.Parameters = p.parseFunctionParameters()
+	if !p.parseFunctionParameters(lit) {
+		return nil
+	}
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
 	}
 
+	// break and continue can't reach loops outside the function
+	loopDepth := p.loopDepth
+	p.loopDepth = 0
 	lit.Body = p.parseBlockStatement()
+	p.loopDepth = loopDepth
 
 	return lit
 }
 
-func (p *Parser) parseFunctionParameters() []*ast.Identifier {
+// parseFunctionParameters fills in the parameters of lit: plain names, then names
+// with defaults like `b = 10`, then optionally a final `...rest`
+func (p *Parser) parseFunctionParameters(lit *ast.FunctionLiteral) bool {
 	// defer untrace(trace("parseFunctionParameters"))
-	identifiers := []*ast.Identifier{}
+	open := p.curToken
+	lit.Parameters = []*ast.Identifier{}
 
 	if p.peekTokenIs(token.RPAREN) {
 		p.nextToken()
-		return identifiers
+		return true
 	}
 
-	p.nextToken()
-
-	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-	identifiers = append(identifiers, ident)
+	hasDefaults := false
+	for {
+		if p.peekTokenIs(token.ELLIPSIS) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return false
+			}
+			lit.Rest = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			break // nothing can follow the rest parameter
+		}
 
-	for p.peekTokenIs(token.COMMA) {
-		p.nextToken()
-		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return false
+		}
 		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-		identifiers = append(identifiers, ident)
-	}
 
-	if !p.expectPeek(token.RPAREN) {
-		return nil
+		var value ast.Expression
+		if p.peekTokenIs(token.ASSIGN) {
+			p.nextToken()
+			p.nextToken()
+			if value = p.parseExpression(ASSIGN); value == nil {
+				return false
+			}
+			hasDefaults = true
+		} else if hasDefaults {
+			p.errorAt(ident.Token, diag.CodeInvalidParameter, "parameter %s needs a default value, as an earlier parameter has one", ident.Value)
+			return false
+		}
+
+		lit.Parameters = append(lit.Parameters, ident)
+		lit.Defaults = append(lit.Defaults, value)
+
+		if !p.peekTokenIs(token.COMMA) {
+			break
+		}
+		p.nextToken()
 	}
 
-	return identifiers
+	return p.expectClosing(token.RPAREN, open)
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	// defer untrace(trace("parseCallExpression"))
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
 	exp.Arguments = p.parseCallArguments()
+	exp.Rparen = p.curToken
 	return exp
 }
 
 func (p *Parser) parseCallArguments() []ast.Expression {
 	// defer untrace(trace("parseCallArguments"))
+	open := p.curToken
 	args := []ast.Expression{}
 
 	if p.peekTokenIs(token.RPAREN) {
@@ -359,7 +629,7 @@ func (p *Parser) parseCallArguments() []ast.Expression {
 		args = append(args, p.parseExpression(LOWEST))
 	}
 
-	if !p.expectPeek(token.RPAREN) {
+	if !p.expectClosing(token.RPAREN, open) {
 		return nil
 	}
 
@@ -370,7 +640,7 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 	// defer untrace(trace("parseExpression"))
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
-		p.noPrefixParseFnError(p.curToken.Type)
+		p.noPrefixParseFnError(p.curToken)
 		return nil
 	}
 	leftExp := prefix()
@@ -408,6 +678,239 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
+func (p *Parser) parseTryStatement() *ast.TryStatement {
+	stmt := &ast.TryStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Block = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+
+		if p.peekTokenIs(token.LPAREN) {
+			p.nextToken()
+			open := p.curToken
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			stmt.Param = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			if !p.expectClosing(token.RPAREN, open) {
+				return nil
+			}
+		}
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		stmt.Catch = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		stmt.Finally = p.parseBlockStatement()
+	}
+
+	if stmt.Catch == nil && stmt.Finally == nil {
+		p.errorAt(p.peekToken, diag.CodeUnexpectedToken, "expected catch or finally, found %s", describeToken(p.peekToken))
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseImportStatement() *ast.ImportStatement {
+	stmt := &ast.ImportStatement{Token: p.curToken}
+
+	if p.blockDepth > 0 {
+		p.errorAt(p.curToken, diag.CodeMisplacedStatement, "import outside of the top level")
+		return nil
+	}
+
+	if p.peekTokenIs(token.LBRACE) {
+		p.nextToken()
+		open := p.curToken
+		for {
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			stmt.Names = append(stmt.Names, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+			if !p.peekTokenIs(token.COMMA) {
+				break
+			}
+			p.nextToken()
+		}
+		if !p.expectClosing(token.RBRACE, open) || !p.expectWord("from") {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+	stmt.Path = &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
+
+	if stmt.Names == nil && p.peekWordIs("as") {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		stmt.Alias = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseExportStatement() *ast.ExportStatement {
+	stmt := &ast.ExportStatement{Token: p.curToken}
+
+	if p.blockDepth > 0 {
+		p.errorAt(p.curToken, diag.CodeMisplacedStatement, "export outside of the top level")
+		return nil
+	}
+
+	if !p.expectPeek(token.LET) {
+		return nil
+	}
+	if stmt.Statement = p.parseLetStatement(); stmt.Statement == nil {
+		return nil
+	}
+
+	return stmt
+}
+
+// peekWordIs reports whether the next token is the identifier word. Words like
+// "as" and "from" only mean something inside an import, so they aren't keywords
+func (p *Parser) peekWordIs(word string) bool {
+	return p.peekTokenIs(token.IDENT) && p.peekToken.Literal == word
+}
+
+func (p *Parser) expectWord(word string) bool {
+	if p.peekWordIs(word) {
+		p.nextToken()
+		return true
+	}
+	p.errorAt(p.peekToken, diag.CodeUnexpectedToken, "expected %q, found %s", word, describeToken(p.peekToken))
+	return false
+}
+
+func (p *Parser) parseWhileStatement() *ast.WhileStatement {
+	stmt := &ast.WhileStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	open := p.curToken
+
+	p.nextToken()
+	stmt.Condition = p.parseExpression(LOWEST)
+
+	if !p.expectClosing(token.RPAREN, open) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Body = p.parseLoopBody()
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseForStatement() *ast.ForStatement {
+	stmt := &ast.ForStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	open := p.curToken
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	stmt.Variable = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+
+	p.nextToken()
+	stmt.Iterable = p.parseExpression(LOWEST)
+
+	if !p.expectClosing(token.RPAREN, open) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Body = p.parseLoopBody()
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseLoopBody() *ast.BlockStatement {
+	p.loopDepth++
+	body := p.parseBlockStatement()
+	p.loopDepth--
+
+	return body
+}
+
+// parseLoopControlStatement parses break and continue, which are only allowed inside a loop
+func (p *Parser) parseLoopControlStatement() ast.Statement {
+	var stmt ast.Statement
+	if p.curTokenIs(token.BREAK) {
+		stmt = &ast.BreakStatement{Token: p.curToken}
+	} else {
+		stmt = &ast.ContinueStatement{Token: p.curToken}
+	}
+
+	if p.loopDepth == 0 {
+		p.errorAt(p.curToken, diag.CodeMisplacedStatement, "%s outside of a loop", p.curToken.Literal)
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseLetStatement() *ast.LetStatement {
 	// defer untrace(trace("parseLetStatement"))
 	stmt := &ast.LetStatement{Token: p.curToken}
@@ -438,9 +941,29 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64) // 0 means infer the base from the string
+	if errors.Is(err, strconv.ErrRange) {
+		// too big for an int64, so it becomes a BigInt
+		if n, ok := new(big.Int).SetString(p.curToken.Literal, 0); ok {
+			lit.Big = n
+			return lit
+		}
+	}
+	if err != nil {
+		p.errorAt(p.curToken, diag.CodeInvalidLiteral, "could not parse %q as integer", p.curToken.Literal)
+		return nil
+	}
+
+	lit.Value = value
+
+	return lit
+}
+
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
 	if err != nil {
-		msg := fmt.Sprintf("could not format %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.errorAt(p.curToken, diag.CodeInvalidLiteral, "could not parse %q as float", p.curToken.Literal)
 		return nil
 	}
 
@@ -457,6 +980,7 @@ func (p *Parser) parseArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
 
 	array.Elements = p.parseExpressionList(token.RBRACKET)
+	array.Rbracket = p.curToken
 
 	return array
 }
@@ -467,9 +991,21 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	p.nextToken()
 	exp.Index = p.parseExpression(LOWEST)
 
-	if !p.expectPeek(token.RBRACKET) {
+	if !p.expectClosing(token.RBRACKET, exp.Token) {
 		return nil
 	}
+	exp.Rbracket = p.curToken
+
+	return exp
+}
+
+func (p *Parser) parseMemberExpression(left ast.Expression) ast.Expression {
+	exp := &ast.MemberExpression{Token: p.curToken, Object: left}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	exp.Property = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 
 	return exp
 }
@@ -490,15 +1026,17 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 		value := p.parseExpression(LOWEST)
 
 		hash.Pairs[key] = value
+		hash.Keys = append(hash.Keys, key)
 
 		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
 			return nil
 		}
 	}
 
-	if !p.expectPeek(token.RBRACE) {
+	if !p.expectClosing(token.RBRACE, hash.Token) {
 		return nil
 	}
+	hash.Rbrace = p.curToken
 
 	return hash
 }
@@ -516,6 +1054,16 @@ func (p *Parser) peekTokenIs(t token.TokenType) bool {
 	return p.peekToken.Type == t
 }
 
+// expectClosing is expectPeek for a closing delimiter, open being the token it closes
+func (p *Parser) expectClosing(t token.TokenType, open token.Token) bool {
+	if p.peekTokenIs(t) {
+		p.nextToken()
+		return true
+	}
+	p.unclosedError(p.peekToken, t, open)
+	return false
+}
+
 func (p *Parser) expectPeek(t token.TokenType) bool {
 	if p.peekTokenIs(t) {
 		p.nextToken()
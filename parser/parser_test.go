@@ -5,6 +5,7 @@ import (
 	"farcical/lexer"
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -163,6 +164,60 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestBigIntegerLiteralExpression(t *testing.T) {
+	input := "123456789012345678901234567890;"
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	literal, ok := stmt.Expression.(*ast.IntegerLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.IntegerLiteral. got=%T", stmt.Expression)
+	}
+	if literal.Big == nil || literal.Big.String() != "123456789012345678901234567890" {
+		t.Errorf("literal.Big wrong, got=%v", literal.Big)
+	}
+	if literal.String() != "123456789012345678901234567890" {
+		t.Errorf("literal.String() wrong, got=%q", literal.String())
+	}
+}
+
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14;", 3.14},
+		{"1e-9;", 1e-9},
+		{"2.5E+3;", 2500},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program has not enough statements, got=%d", len(program.Statements))
+		}
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement, got=%T", program.Statements[0])
+		}
+
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %g, got=%g", tt.expected, literal.Value)
+		}
+	}
+}
+
 func TestBooleanExpression(t *testing.T) {
 	input := "true;"
 
@@ -347,6 +402,38 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"3 + 4 * 5 == 3 * 1 + 4 * 5",
 			"((3 + (4 * 5)) == ((3 * 1) + (4 * 5)))",
 		},
+		{
+			"0..n + 1",
+			"(0 .. (n + 1))",
+		},
+		{
+			"a || b && c",
+			"(a || (b && c))",
+		},
+		{
+			"a && b || c && d",
+			"((a && b) || (c && d))",
+		},
+		{
+			"a < b && c >= d || !e",
+			"(((a < b) && (c >= d)) || (!e))",
+		},
+		{
+			"a == b && c <= d",
+			"((a == b) && (c <= d))",
+		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
+		{
+			"x = a || b",
+			"x = (a || b)",
+		},
+		{
+			"a < 0..2",
+			"(a < (0 .. 2))",
+		},
 		{
 			"true",
 			"true",
@@ -395,6 +482,10 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		{
+			"-str.upper(a.b)[0]",
+			"(-(str.upper(a.b)[0]))",
+		},
 	}
 
 	for _, tt := range tests {
@@ -513,6 +604,258 @@ func TestIfElseExpression(t *testing.T) {
 	}
 }
 
+func TestWhileStatement(t *testing.T) {
+	input := `while (x < 10) { x; break; }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statements, got %d", len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement, got=%T", program.Statements[0])
+	}
+	if !testInfixExpression(t, stmt.Condition, "x", "<", 10) {
+		return
+	}
+	if len(stmt.Body.Statements) != 2 {
+		t.Fatalf("body is not 2 statements, got=%d", len(stmt.Body.Statements))
+	}
+	if _, ok := stmt.Body.Statements[1].(*ast.BreakStatement); !ok {
+		t.Fatalf("body.Statements[1] is not ast.BreakStatement, got=%T", stmt.Body.Statements[1])
+	}
+}
+
+func TestForStatement(t *testing.T) {
+	input := `for (item in 0..n) { continue; }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.ForStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ForStatement, got=%T", program.Statements[0])
+	}
+	if !testIdentifier(t, stmt.Variable, "item") {
+		return
+	}
+	if !testInfixExpression(t, stmt.Iterable, 0, "..", "n") {
+		return
+	}
+	if _, ok := stmt.Body.Statements[0].(*ast.ContinueStatement); !ok {
+		t.Fatalf("body.Statements[0] is not ast.ContinueStatement, got=%T", stmt.Body.Statements[0])
+	}
+}
+
+func TestLoopTrailingSemicolon(t *testing.T) {
+	tests := []struct {
+		input      string
+		statements int
+	}{
+		{"let x = 0; while (x < 3) { x += 1 }; x", 3},
+		{"for (i in 0..2) { i };", 1},
+		{"while (true) { break; }; for (i in xs) { };", 2},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != tt.statements {
+			t.Errorf("%q: expected %d statements, got %d", tt.input, tt.statements, len(program.Statements))
+		}
+	}
+}
+
+func TestTryStatement(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { a } catch (e) { b }", "try a catch (e) b"},
+		{"try { a } catch { b }", "try a catch b"},
+		{"try { a } finally { c }", "try a finally c"},
+		{"try { a } catch (e) { b } finally { c }", "try a catch (e) b finally c"},
+		{"try { a } catch (e) { b };", "try a catch (e) b"},
+		{"try { a } finally { c }; d", "try a finally cd"},
+		{"throw 1 + 2;", "throw (1 + 2);"},
+		{`throw {"message": "no"}`, `throw {message:no};`},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if actual := program.String(); actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	p := New(lexer.New("try { 1 } catch (err) { 2 } finally { 3 }"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	stmt, ok := program.Statements[0].(*ast.TryStatement)
+	if !ok {
+		t.Fatalf("stmt is not *ast.TryStatement, got=%T", program.Statements[0])
+	}
+	testIdentifier(t, stmt.Param, "err")
+	if len(stmt.Block.Statements) != 1 || len(stmt.Catch.Statements) != 1 || len(stmt.Finally.Statements) != 1 {
+		t.Errorf("wrong blocks: %s", stmt)
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { 1 } 2", `1:11: expected catch or finally, found integer "2"`},
+		{"try { 1 } catch (1) { }", `1:18: expected identifier, found integer "1"`},
+		{"throw;", `1:6: expected expression, found ";"`},
+	}
+
+	for _, tt := range errorTests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("%q: expected an error", tt.input)
+			continue
+		}
+		if errors[0].Error() != tt.expected {
+			t.Errorf("%q: wrong error, expected=%q got=%q", tt.input, tt.expected, errors[0].Error())
+		}
+	}
+}
+
+func TestImportAndExportStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`import "lib/math.fa" as math`, `import "lib/math.fa" as math;`},
+		{`import "setup"`, `import "setup";`},
+		{`import { square, pi } from "math";`, `import { square, pi } from "math";`},
+		{`export let x = 1;`, `export let x = 1;`},
+		{`let from = 1; let as = 2;`, `let from = 1;let as = 2;`},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if actual := program.String(); actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`import { a } "x"`, `1:14: expected "from", found string "x"`},
+		{`import { } from "x"`, `1:10: expected identifier, found "}"`},
+		{`import x`, `1:8: expected string, found identifier "x"`},
+		{`import "x" as "y"`, `1:15: expected identifier, found string "y"`},
+		{`export 1`, `1:8: expected "let", found integer "1"`},
+		{`if (true) { import "x" as x }`, `1:13: import outside of the top level`},
+		{`let f = function() { export let y = 1; }`, `1:22: export outside of the top level`},
+	}
+
+	for _, tt := range errorTests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("%q: expected an error", tt.input)
+			continue
+		}
+		if errors[0].Error() != tt.expected {
+			t.Errorf("%q: wrong error, expected=%q got=%q", tt.input, tt.expected, errors[0].Error())
+		}
+	}
+}
+
+func TestLoopControlOutsideLoop(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"break;", "1:1: break outside of a loop"},
+		{"if (x) { continue; }", "1:10: continue outside of a loop"},
+		{"while (x) { let f = function() { break; }; }", "1:34: break outside of a loop"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) != 1 || errors[0].Error() != tt.expected {
+			t.Errorf("wrong errors for %q, expected %q got %v", tt.input, tt.expected, errors)
+		}
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5;", "x = 5"},
+		{"x += y * 2;", "x += (y * 2)"},
+		{"a = b = c;", "a = b = c"},
+		{"arr[0] -= 1;", "(arr[0]) -= 1"},
+		{`h["k"] %= 3;`, "(h[k]) %= 3"},
+		{"x *= 2; y /= 2", "x *= 2y /= 2"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	l := lexer.New("a = b = c;")
+	p := New(l)
+	program := p.ParseProgram()
+	outer := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.AssignExpression)
+	if _, ok := outer.Value.(*ast.AssignExpression); !ok {
+		t.Errorf("assignment is not right associative, value is %T", outer.Value)
+	}
+}
+
+func TestInvalidAssignmentTarget(t *testing.T) {
+	l := lexer.New("f(x) = 5; 1 + 2 += 3;")
+	p := New(l)
+	p.ParseProgram()
+
+	expected := []string{"1:1: cannot assign to f(x)", "1:11: cannot assign to (1 + 2)"}
+	errors := p.Errors()
+	if len(errors) != len(expected) {
+		t.Fatalf("wrong number of errors, expected=%d got=%d (%v)", len(expected), len(errors), errors)
+	}
+	for i, msg := range expected {
+		if errors[i].Error() != msg {
+			t.Errorf("errors[%d] wrong, expected=%q got=%q", i, msg, errors[i].Error())
+		}
+	}
+}
+
 func TestFunctionLiteralParsing(t *testing.T) {
 	input := `function(x, y) { x + y }`
 
@@ -583,6 +926,65 @@ func TestFunctionParameterParsing(t *testing.T) {
 	}
 }
 
+func TestFunctionDefaultAndRestParameters(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"function(a, b = 10) { a }", "function(a, b = 10)a"},
+		{"function(a = 1 + 2, b = a) { a }", "function(a = (1 + 2), b = a)a"},
+		{"function(first, ...rest) { rest }", "function(first, ...rest)rest"},
+		{"function(...all) { all }", "function(...all)all"},
+		{"function(a, b = [1], ...c) { c }", "function(a, b = [1], ...c)c"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if actual := program.String(); actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	p := New(lexer.New("function(a, b = 1, ...c) { c }"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	function := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral)
+	if len(function.Parameters) != 2 || len(function.Defaults) != 2 {
+		t.Fatalf("wrong parameters, got %d parameters and %d defaults", len(function.Parameters), len(function.Defaults))
+	}
+	if function.Defaults[0] != nil {
+		t.Errorf("a has a default: %s", function.Defaults[0])
+	}
+	testLiteralExpression(t, function.Defaults[1], 1)
+	testIdentifier(t, function.Rest, "c")
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"function(a = 1, b) { a }", "1:17: parameter b needs a default value, as an earlier parameter has one"},
+		{"function(...rest, a) { a }", `1:17: expected ")", found ","`},
+		{"function(...) { 1 }", `1:13: expected identifier, found ")"`},
+		{"function(a = ) { a }", `1:14: expected expression, found ")"`},
+	}
+
+	for _, tt := range errorTests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("%q: expected an error", tt.input)
+			continue
+		}
+		if errors[0].Error() != tt.expected {
+			t.Errorf("%q: wrong error, expected=%q got=%q", tt.input, tt.expected, errors[0].Error())
+		}
+	}
+}
+
 func TestCallExpressionParsing(t *testing.T) {
 	input := "add(1, 2 * 3, 4 + 5);"
 
@@ -682,6 +1084,34 @@ func TestParsingIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestParsingMemberExpressions(t *testing.T) {
+	input := "str.upper"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	member, ok := stmt.Expression.(*ast.MemberExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.MemberExpression, got=%T", stmt.Expression)
+	}
+	if !testIdentifier(t, member.Object, "str") {
+		return
+	}
+	if !testIdentifier(t, member.Property, "upper") {
+		return
+	}
+
+	p = New(lexer.New("str.1"))
+	p.ParseProgram()
+	errors := p.Errors()
+	if len(errors) != 1 || errors[0].Error() != `1:5: expected identifier, found integer "1"` {
+		t.Errorf("wrong errors for a member that isn't a name: %v", errors)
+	}
+}
+
 func TestParsingHashLiteralsStringKeys(t *testing.T) {
 	input := `{"one": 1, "two": 2, "three": 3}`
 
@@ -711,6 +1141,11 @@ func TestParsingHashLiteralsStringKeys(t *testing.T) {
 		expectedValue := expected[literal.String()]
 		testIntegerLiteral(t, value, expectedValue)
 	}
+
+	// keys keep the order they were written in
+	if hash.String() != `{one:1, two:2, three:3}` {
+		t.Errorf("hash.String() wrong, got=%q", hash.String())
+	}
 }
 
 func TestParsingEmptyHashLiteral(t *testing.T) {
@@ -856,3 +1291,173 @@ func checkParserErrors(t *testing.T, p *Parser) {
 	}
 	t.FailNow()
 }
+
+func TestNodePositions(t *testing.T) {
+	input := `let add = function(a, b) {
+  a + b
+};
+add(1, [2, 3][0])`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements, got %d", len(program.Statements))
+	}
+
+	let := program.Statements[0].(*ast.LetStatement)
+	fn := let.Value.(*ast.FunctionLiteral)
+	body := fn.Body.Statements[0].(*ast.ExpressionStatement)
+	call := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.CallExpression)
+	index := call.Arguments[1]
+
+	tests := []struct {
+		node      ast.Node
+		startLine int
+		startCol  int
+		endLine   int
+		endCol    int
+	}{
+		{let, 1, 1, 3, 2},
+		{fn, 1, 11, 3, 2},
+		{body.Expression, 2, 3, 2, 8},
+		{call, 4, 1, 4, 18},
+		{index, 4, 8, 4, 17},
+		{program, 1, 1, 4, 18},
+	}
+
+	for i, tt := range tests {
+		pos, end := tt.node.Pos(), tt.node.End()
+		if pos.Line != tt.startLine || pos.Column != tt.startCol {
+			t.Errorf("tests[%d] - %q starts at %d:%d, want %d:%d", i, tt.node.String(), pos.Line, pos.Column, tt.startLine, tt.startCol)
+		}
+		if end.Line != tt.endLine || end.Column != tt.endCol {
+			t.Errorf("tests[%d] - %q ends at %d:%d, want %d:%d", i, tt.node.String(), end.Line, end.Column, tt.endLine, tt.endCol)
+		}
+	}
+}
+
+func TestInvalidAssignmentTargetMissingOperand(t *testing.T) {
+	inputs := []string{"! ) = 1", "! catch += 1", "! && += 1", "1 + ) = 2"}
+
+	for _, input := range inputs {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Errorf("%q: expected an error", input)
+			continue
+		}
+		for _, err := range errors {
+			if strings.Contains(err.Error(), "cannot assign") {
+				t.Errorf("%q: reported the half-parsed target too: %s", input, err)
+			}
+		}
+	}
+}
+
+func TestIllegalTokenDropsStatement(t *testing.T) {
+	inputs := []string{"let x = #;", "return #;", "#;", "throw #", "x = #;", "let y = 1; let x = 1 + #; y"}
+
+	for _, input := range inputs {
+		p := New(lexer.New(input))
+		program := p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("%q: expected an error", input)
+		}
+
+		for _, stmt := range program.Statements {
+			var missing bool
+			switch stmt := stmt.(type) {
+			case *ast.LetStatement:
+				missing = stmt.Value == nil
+			case *ast.ReturnStatement:
+				missing = stmt.ReturnValue == nil
+			case *ast.ExpressionStatement:
+				missing = stmt.Expression == nil
+			}
+			if missing {
+				t.Errorf("%q: statement with a missing expression kept: %T", input, stmt)
+			}
+		}
+	}
+}
+
+func TestParserErrorRecovery(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedProgram  string
+		expectedMessages []string
+	}{
+		{
+			"let x 5; let y = 2; let = 3; z;",
+			"let y = 2;z",
+			[]string{
+				`1:7: expected "=", found integer "5"`,
+				`1:25: expected identifier, found "="`,
+			},
+		},
+		{
+			"let f = function(x { x }; let y = 2;",
+			"let y = 2;",
+			[]string{`1:20: expected ")", found "{"`},
+		},
+		{
+			"if (x) { 1 + } let y = 2;",
+			"let y = 2;",
+			[]string{`1:14: expected expression, found "}"`},
+		},
+		{
+			"let f = function() { let = 1; 2 }; f; let z = (1 + ;",
+			"f",
+			[]string{
+				`1:26: expected identifier, found "="`,
+				`1:52: expected expression, found ";"`,
+			},
+		},
+		{
+			"add(1, 2",
+			"",
+			[]string{`1:9: expected ")", found end of file`},
+		},
+		{
+			"let x = 1;\nlet y = 2 # 3;\nx",
+			"let x = 1;let y = 2;x",
+			[]string{`2:11: illegal character "#"`},
+		},
+		{
+			"let x = #;\nlet y = 2;",
+			"let y = 2;",
+			[]string{`1:9: illegal character "#"`},
+		},
+		{
+			"let f = function() { return #; }; f",
+			"f",
+			[]string{`1:29: illegal character "#"`},
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		if program.String() != tt.expectedProgram {
+			t.Errorf("program wrong for %q, expected=%q got=%q", tt.input, tt.expectedProgram, program.String())
+		}
+
+		errors := p.Errors()
+		if len(errors) != len(tt.expectedMessages) {
+			t.Errorf("wrong number of errors for %q, expected=%d got=%d (%q)", tt.input, len(tt.expectedMessages), len(errors), errors)
+			continue
+		}
+		for i, msg := range tt.expectedMessages {
+			if errors[i].Error() != msg {
+				t.Errorf("wrong error for %q, expected=%q got=%q", tt.input, msg, errors[i].Error())
+			}
+		}
+	}
+}
@@ -2,38 +2,77 @@ package repl
 
 import (
 	"bufio"
+	"farcical/ast"
+	"farcical/compiler"
+	"farcical/diag"
 	"farcical/evaluator"
 	"farcical/lexer"
 	"farcical/object"
 	"farcical/parser"
+	"farcical/vm"
 	"fmt"
 	"io"
+	"strings"
 )
 
 const PROMPT = ">>> "
 
+// Start runs a session that evaluates each line with the tree-walking evaluator
 func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
+	reader := bufio.NewReader(in)
+	ev := newEvaluator(reader, out)
+	run(reader, out, func(program *ast.Program, env *object.Environment) object.Object {
+		return ev.Eval(program, env)
+	})
+}
+
+// StartVM runs a session that compiles each line and runs it on the virtual machine
+func StartVM(in io.Reader, out io.Writer) {
+	reader := bufio.NewReader(in)
+	ev := newEvaluator(reader, out)
+	machine := vm.New(ev)
+	ev.RunModule = machine.RunModule
+	run(reader, out, func(program *ast.Program, env *object.Environment) object.Object {
+		main, err := compiler.Compile(program)
+		if err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		return machine.Run(main, env)
+	})
+}
+
+// newEvaluator returns an evaluator whose scripts read and write the session's own
+// input and output. Input shares the session's reader, so a line a script reads
+// with input() isn't also taken as code
+func newEvaluator(in *bufio.Reader, out io.Writer) *evaluator.Evaluator {
+	ev := evaluator.New()
+	ev.Stdin = in
+	ev.Stdout = out
+	ev.Stderr = out
+	return ev
+}
+
+func run(in *bufio.Reader, out io.Writer, eval func(*ast.Program, *object.Environment) object.Object) {
 	env := object.NewEnvironment()
 
 	for {
 		fmt.Fprintf(out, PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
 			return
 		}
+		line = strings.TrimRight(line, "\r\n")
 
-		line := scanner.Text()
 		l := lexer.New(line)
 		p := parser.New(l)
 
 		program := p.ParseProgram()
 		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+			printParserErrors(out, line, p.Errors())
 			continue
 		}
 
-		evaluated := evaluator.Eval(program, env)
+		evaluated := eval(program, env)
 		if evaluated != nil {
 			io.WriteString(out, evaluated.Inspect())
 			io.WriteString(out, "\n")
@@ -41,8 +80,6 @@ func Start(in io.Reader, out io.Writer) {
 	}
 }
 
-func printParserErrors(out io.Writer, errors []string) {
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
-	}
+func printParserErrors(out io.Writer, src string, errors []diag.Diagnostic) {
+	diag.RenderAll(out, src, errors)
 }
@@ -0,0 +1,22 @@
+package repl
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestInput(t *testing.T) {
+	session := "let name = input(\"name? \")\nAda\n\"hi \" + name\n"
+
+	for _, start := range []func(io.Reader, io.Writer){Start, StartVM} {
+		var out strings.Builder
+		start(strings.NewReader(session), &out)
+
+		// the second line is read by input() rather than run as code
+		expected := PROMPT + "name? " + PROMPT + "hi Ada\n" + PROMPT
+		if out.String() != expected {
+			t.Errorf("wrong session output, expected=%q got=%q", expected, out.String())
+		}
+	}
+}
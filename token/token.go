@@ -1,10 +1,40 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
 type Token struct {
 	Type    TokenType
 	Literal string
+	Pos     Position // position of the first character of the token
+	End     Position // position immediately after the last character of the token
+}
+
+// Position is a location in a source file. Line and Column start at 1,
+// Offset starts at 0. Columns are counted in bytes.
+type Position struct {
+	Filename string
+	Offset   int
+	Line     int
+	Column   int
+}
+
+// IsValid reports whether the position has been set - the zero Position is not valid
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+// String renders the position as "file:line:column", or "line:column" when there is no file name
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.Filename != "" {
+			return p.Filename
+		}
+		return "-"
+	}
+	if p.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
 var keywords = map[string]TokenType{
@@ -15,6 +45,17 @@ var keywords = map[string]TokenType{
 	"if":       IF,
 	"else":     ELSE,
 	"return":   RETURN,
+	"while":    WHILE,
+	"for":      FOR,
+	"in":       IN,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"try":      TRY,
+	"catch":    CATCH,
+	"finally":  FINALLY,
+	"throw":    THROW,
+	"import":   IMPORT,
+	"export":   EXPORT,
 }
 
 func LookupIdent(ident string) TokenType {
@@ -24,13 +65,25 @@ func LookupIdent(ident string) TokenType {
 	return IDENT
 }
 
+// KeywordLiteral returns the source spelling of a keyword token type
+func KeywordLiteral(t TokenType) (string, bool) {
+	for literal, tokenType := range keywords {
+		if tokenType == t {
+			return literal, true
+		}
+	}
+	return "", false
+}
+
 const (
 	ILLEGAL = "ILLEGAL"
 	EOF     = "EOF"
+	COMMENT = "COMMENT" // only produced when the lexer is asked to keep comments
 
 	// Identifiers + literals
 	IDENT = "IDENT" // add, foobar, x, y...
 	INT   = "INT"
+	FLOAT = "FLOAT" // 3.14, 1e-9
 
 	//Operators
 	ASSIGN   = "="
@@ -39,16 +92,32 @@ const (
 	BANG     = "!"
 	ASTERISK = "*"
 	SLASH    = "/"
+	PERCENT  = "%"
 
 	LT     = "<"
 	GT     = ">"
 	EQ     = "=="
 	NOT_EQ = "!="
+	LT_EQ  = "<="
+	GT_EQ  = ">="
+
+	AND = "&&"
+	OR  = "||"
+
+	RANGE    = ".."  // 0..10
+	ELLIPSIS = "..." // function(first, ...rest)
+
+	PLUS_ASSIGN     = "+="
+	MINUS_ASSIGN    = "-="
+	ASTERISK_ASSIGN = "*="
+	SLASH_ASSIGN    = "/="
+	PERCENT_ASSIGN  = "%="
 
 	// Delimiters
 	COMMA     = ","
 	SEMICOLON = ";"
 	COLON     = ":"
+	DOT       = "."
 
 	LPAREN   = "("
 	RPAREN   = ")"
@@ -65,6 +134,17 @@ const (
 	IF       = "IF"
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
+	WHILE    = "WHILE"
+	FOR      = "FOR"
+	IN       = "IN"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	FINALLY  = "FINALLY"
+	THROW    = "THROW"
+	IMPORT   = "IMPORT"
+	EXPORT   = "EXPORT"
 
 	STRING = "STRING"
 )
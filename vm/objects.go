@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"farcical/compiler"
+	"farcical/object"
+	"unicode/utf8"
+)
+
+const (
+	CELL_OBJ     = "CELL"
+	ITERATOR_OBJ = "ITERATOR"
+)
+
+// Closure is a compiled function together with the variables it captured from the
+// functions around it. Scripts see it as a FUNCTION, just like the evaluator's functions
+type Closure struct {
+	Fn      *compiler.CompiledFunction
+	Free    []*Cell
+	Globals *object.Environment // the globals of the program or module that made it
+	Name    string              // set when the function is first bound with let, empty for anonymous functions
+}
+
+func (c *Closure) Type() object.ObjectType { return object.FUNCTION_OBJ }
+func (c *Closure) Inspect() string {
+	lit := c.Fn.Literal
+	fn := &object.Function{Parameters: lit.Parameters, Defaults: lit.Defaults, Rest: lit.Rest, Body: lit.Body}
+	return fn.Inspect()
+}
+
+// name is how stack traces and error messages refer to the function
+func (c *Closure) name() string {
+	if c.Name == "" {
+		return "<anonymous>"
+	}
+	return c.Name
+}
+
+// Cell holds a variable that closures capture, so that they and the function
+// declaring it share one variable rather than each having a copy
+type Cell struct {
+	Value object.Object // nil until the variable is set
+}
+
+func (c *Cell) Type() object.ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string         { return "cell" }
+
+// iterator steps through the values a for loop visits
+type iterator struct {
+	next func() (object.Object, bool)
+}
+
+func (it *iterator) Type() object.ObjectType { return ITERATOR_OBJ }
+func (it *iterator) Inspect() string         { return "iterator" }
+
+// newIterator returns an iterator over the elements of an array, the keys of a hash, the
+// characters of a string or the integers in a range, visiting them as the evaluator does
+func newIterator(iterable object.Object) (*iterator, bool) {
+	switch iterable := iterable.(type) {
+	case *object.Array:
+		i := 0
+		return &iterator{func() (object.Object, bool) {
+			if i >= len(iterable.Elements) {
+				return nil, false
+			}
+			i++
+			return iterable.Elements[i-1], true
+		}}, true
+
+	case *object.Hash:
+		pairs := iterable.Ordered()
+		i := 0
+		return &iterator{func() (object.Object, bool) {
+			if i >= len(pairs) {
+				return nil, false
+			}
+			i++
+			return pairs[i-1].Key, true
+		}}, true
+
+	case *object.String:
+		s := iterable.Value
+		i := 0
+		return &iterator{func() (object.Object, bool) {
+			if i >= len(s) {
+				return nil, false
+			}
+			ch, size := utf8.DecodeRuneInString(s[i:])
+			i += size
+			return &object.String{Value: string(ch)}, true
+		}}, true
+
+	case *object.Range:
+		i := iterable.Start
+		return &iterator{func() (object.Object, bool) {
+			if i >= iterable.End {
+				return nil, false
+			}
+			i++
+			return integer(i - 1), true
+		}}, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,904 @@
+// Package vm runs the bytecode the compiler package produces on a stack machine.
+// It shares the evaluator's builtins, limits, modules and the semantics of every
+// operation, so a program gives the same results and errors on either
+package vm
+
+import (
+	"context"
+	"farcical/ast"
+	"farcical/compiler"
+	"farcical/diag"
+	"farcical/evaluator"
+	"farcical/object"
+	"fmt"
+	"math"
+)
+
+const initialStackSize = 1024
+
+// VM runs compiled code. Builtins, limits, I/O and modules come from its host Evaluator
+type VM struct {
+	host *evaluator.Evaluator
+
+	stack    []object.Object
+	sp       int // the next free slot of stack
+	frames   []frame
+	handlers []handler // the try statements able to catch an error, innermost last
+	depth    int       // frames that are function calls, for Limits.MaxDepth
+	steps    int       // instructions run since the outermost Run or Call began
+	running  int       // how many Runs and Calls are active, to spot the outermost one
+	ctx      context.Context
+	done     <-chan struct{} // ctx.Done(), nil if the run can't be cancelled
+	exports  *[]string       // collects the names exported by the module being run
+}
+
+// frame is a call of a closure, or the top level of a program
+type frame struct {
+	cl       *Closure
+	ip       int  // the next instruction, or while an error is raised, the one raising it
+	bp       int  // the stack index of the first local slot
+	ret      int  // what sp goes back to when the frame returns
+	args     int  // how many arguments were passed
+	function bool // a function call rather than the top level of a program
+	name     string
+	callSite diag.Span
+}
+
+// handler is where an error raised inside a try block goes
+type handler struct {
+	frame int // the frame the try statement is in
+	sp    int // the stack height when the try began
+	ip    int // the code that handles the error
+}
+
+// New returns a VM running code with host's builtins and settings
+func New(host *evaluator.Evaluator) *VM {
+	return &VM{host: host, stack: make([]object.Object, initialStackSize)}
+}
+
+// Run runs the top level of a compiled program with env as its globals. The result
+// is the value of the last statement, or the error that stopped the program
+func (vm *VM) Run(main *compiler.CompiledFunction, env *object.Environment) object.Object {
+	vm.begin()
+	defer vm.end()
+
+	base := len(vm.frames)
+	vm.ensureStack(vm.sp + main.NumLocals)
+	vm.clearSlots(vm.sp, vm.sp+main.NumLocals)
+	vm.frames = append(vm.frames, frame{cl: &Closure{Fn: main, Globals: env}, bp: vm.sp, ret: vm.sp})
+	vm.sp += main.NumLocals
+
+	return vm.run(base)
+}
+
+// RunContext is Run that gives up once ctx is done, like evaluator.EvalContext
+func (vm *VM) RunContext(ctx context.Context, main *compiler.CompiledFunction, env *object.Environment) object.Object {
+	defer vm.setContext(ctx)()
+	return vm.Run(main, env)
+}
+
+// RunModule compiles and runs the program of an imported module, returning the names
+// it exported. Setting it as the host's RunModule compiles modules imported by compiled code
+func (vm *VM) RunModule(program *ast.Program, env *object.Environment) ([]string, object.Object) {
+	main, err := compiler.Compile(program)
+	if err != nil {
+		return nil, &object.Error{Message: err.Error()}
+	}
+
+	prevExports := vm.exports
+	names := []string{}
+	vm.exports = &names
+	defer func() { vm.exports = prevExports }()
+
+	return names, vm.Run(main, env)
+}
+
+// Call calls a function or builtin with args, for builtins taking functions and Go code
+// calling into Farcical. It makes the VM an object.Runtime
+func (vm *VM) Call(fn object.Object, args ...object.Object) (result object.Object) {
+	vm.begin()
+	defer vm.end()
+
+	// a builtin called straight from Go isn't inside any run to recover its panics
+	defer func() {
+		if r := recover(); r != nil {
+			result = internalError(r)
+		}
+	}()
+
+	if err := vm.checkContext(); err != nil {
+		return err
+	}
+
+	switch fn := fn.(type) {
+	case *Closure:
+		base := len(vm.frames)
+		vm.push(fn)
+		for _, arg := range args {
+			vm.push(arg)
+		}
+		if err := vm.callClosure(fn, len(args), diag.Span{}); err != nil {
+			vm.sp -= len(args) + 1
+			return err
+		}
+		return vm.run(base)
+	case *object.Builtin:
+		return fn.Fn(vm, args...)
+	case *object.Function:
+		return vm.host.Call(fn, args...)
+	default:
+		return newError("not a function: %s", fn.Type())
+	}
+}
+
+// CallContext is Call that gives up once ctx is done
+func (vm *VM) CallContext(ctx context.Context, fn object.Object, args ...object.Object) object.Object {
+	defer vm.setContext(ctx)()
+	return vm.Call(fn, args...)
+}
+
+// setContext makes ctx the context of the runs to come, returning a function restoring the previous one
+func (vm *VM) setContext(ctx context.Context) func() {
+	prevCtx, prevDone := vm.ctx, vm.done
+	vm.ctx, vm.done = ctx, ctx.Done()
+	return func() { vm.ctx, vm.done = prevCtx, prevDone }
+}
+
+// begin and end bracket a Run or Call; each started from Go gets the whole step budget
+func (vm *VM) begin() {
+	if vm.running == 0 {
+		vm.steps = 0
+	}
+	vm.running++
+}
+
+func (vm *VM) end() {
+	vm.running--
+}
+
+// checkContext returns an error if the context of the current run is done
+func (vm *VM) checkContext() *object.Error {
+	if vm.done == nil {
+		return nil
+	}
+	select {
+	case <-vm.done:
+		return evaluator.StoppedError(vm.ctx.Err())
+	default:
+		return nil
+	}
+}
+
+// run runs until the frame at base returns, giving its result, or an error escapes it
+func (vm *VM) run(base int) object.Object {
+	for {
+		result, err := vm.execute(base)
+		if err == nil {
+			return result
+		}
+		if !vm.raise(err, base) {
+			return err
+		}
+	}
+}
+
+// raise sends err to the innermost try statement that can catch it, reporting whether
+// there was one. Otherwise it unwinds the frames down to base and the error escapes the run
+func (vm *VM) raise(err *object.Error, base int) bool {
+	// the instruction raising an error is where it happened
+	if !err.Span.Pos.IsValid() {
+		f := &vm.frames[len(vm.frames)-1]
+		err.Span = f.cl.Fn.Span(f.ip)
+		err.Stack = vm.stackTrace()
+	}
+
+	if n := len(vm.handlers); n > 0 && vm.handlers[n-1].frame >= base && evaluator.IsCatchable(err) {
+		h := vm.handlers[n-1]
+		vm.handlers = vm.handlers[:n-1]
+		vm.popFrames(h.frame + 1)
+		vm.sp = h.sp
+		vm.push(err)
+		vm.frames[h.frame].ip = h.ip
+		return true
+	}
+
+	for n := len(vm.handlers); n > 0 && vm.handlers[n-1].frame >= base; n-- {
+		vm.handlers = vm.handlers[:n-1]
+	}
+	vm.sp = vm.frames[base].ret
+	vm.popFrames(base)
+	return false
+}
+
+// popFrames drops the frames above n
+func (vm *VM) popFrames(n int) {
+	for len(vm.frames) > n {
+		if vm.frames[len(vm.frames)-1].function {
+			vm.depth--
+		}
+		vm.frames = vm.frames[:len(vm.frames)-1]
+	}
+}
+
+// stackTrace returns the active function calls, outermost first
+func (vm *VM) stackTrace() []object.Frame {
+	var stack []object.Frame
+	for _, f := range vm.frames {
+		if f.function {
+			stack = append(stack, object.Frame{Function: f.name, CallSite: f.callSite})
+		}
+	}
+	return stack
+}
+
+// callClosure starts a call of cl, whose arguments are on top of the stack above cl
+// itself, by pushing its frame. Missing arguments are left unset for the function's
+// own code to fill in with defaults, and extra ones are collected by its rest parameter
+func (vm *VM) callClosure(cl *Closure, argc int, callSite diag.Span) *object.Error {
+	fn := cl.Fn
+	if max := vm.host.Limits.MaxDepth; max > 0 && vm.depth >= max {
+		return evaluator.LimitExceeded("MaxDepth", max)
+	}
+	name := cl.name()
+	if err := evaluator.CheckArity(name, argc, fn.Required, fn.NumParams, fn.Rest); err != nil {
+		return err
+	}
+
+	bp := vm.sp - argc
+	if fn.Rest {
+		rest := []object.Object{}
+		if argc > fn.NumParams {
+			rest = append(rest, vm.stack[bp+fn.NumParams:vm.sp]...)
+		}
+		vm.sp = bp + fn.NumParams
+		vm.push(&object.Array{Elements: rest})
+	}
+
+	vm.ensureStack(bp + fn.NumLocals)
+	vm.clearSlots(vm.sp, bp+fn.NumLocals)
+	vm.sp = bp + fn.NumLocals
+
+	vm.frames = append(vm.frames, frame{
+		cl:       cl,
+		bp:       bp,
+		ret:      bp - 1,
+		args:     argc,
+		function: true,
+		name:     name,
+		callSite: callSite,
+	})
+	vm.depth++
+	return nil
+}
+
+// execute runs instructions until the frame at base returns or an error is raised.
+// The frame raising an error is left pointing at the instruction that raised it
+func (vm *VM) execute(base int) (result object.Object, failure *object.Error) {
+	f := &vm.frames[len(vm.frames)-1]
+	fn := f.cl.Fn
+	ins := fn.Instructions
+	ip := f.ip
+	pc := ip // the instruction being run
+
+	defer func() {
+		if r := recover(); r != nil {
+			vm.frames[len(vm.frames)-1].ip = pc
+			failure = internalError(r)
+		}
+	}()
+
+	maxSteps := vm.host.Limits.MaxSteps
+
+	// fail leaves the current frame at the instruction raising err
+	fail := func(err *object.Error) (object.Object, *object.Error) {
+		vm.frames[len(vm.frames)-1].ip = pc
+		return nil, err
+	}
+
+	for {
+		pc = ip
+		vm.steps++
+		if maxSteps > 0 && vm.steps > maxSteps {
+			return fail(evaluator.LimitExceeded("MaxSteps", maxSteps))
+		}
+
+		op := compiler.Opcode(ins[ip])
+		ip++
+
+		switch op {
+		case compiler.OpConstant:
+			vm.push(fn.Constants[compiler.ReadUint16(ins[ip:])])
+			ip += 2
+
+		case compiler.OpNull:
+			vm.push(evaluator.NULL)
+		case compiler.OpNil:
+			vm.push(nil)
+		case compiler.OpTrue:
+			vm.push(evaluator.TRUE)
+		case compiler.OpFalse:
+			vm.push(evaluator.FALSE)
+
+		case compiler.OpPop:
+			vm.sp--
+
+		case compiler.OpDup2:
+			vm.push(vm.stack[vm.sp-2])
+			vm.push(vm.stack[vm.sp-2])
+
+		case compiler.OpAdd, compiler.OpSub, compiler.OpMul, compiler.OpDiv, compiler.OpMod,
+			compiler.OpEqual, compiler.OpNotEqual, compiler.OpLess, compiler.OpGreater,
+			compiler.OpLessEqual, compiler.OpGreaterEqual, compiler.OpRange:
+			right := vm.stack[vm.sp-1]
+			left := vm.stack[vm.sp-2]
+			vm.sp -= 2
+
+			result := vm.binaryOperation(op, left, right)
+			if err, ok := result.(*object.Error); ok {
+				return fail(err)
+			}
+			vm.push(result)
+
+		case compiler.OpMinus:
+			operand := vm.stack[vm.sp-1]
+			if i, ok := operand.(*object.Integer); ok && i.Value != math.MinInt64 {
+				vm.stack[vm.sp-1] = integer(-i.Value)
+				break
+			}
+			result := evaluator.Prefix("-", operand)
+			if err, ok := result.(*object.Error); ok {
+				return fail(err)
+			}
+			vm.stack[vm.sp-1] = result
+
+		case compiler.OpBang:
+			vm.stack[vm.sp-1] = evaluator.Prefix("!", vm.stack[vm.sp-1])
+
+		case compiler.OpJump:
+			ip = int(compiler.ReadUint32(ins[ip:]))
+
+		case compiler.OpJumpIfFalse:
+			vm.sp--
+			if evaluator.IsTruthy(vm.stack[vm.sp]) {
+				ip += 4
+			} else {
+				ip = int(compiler.ReadUint32(ins[ip:]))
+			}
+
+		case compiler.OpAnd, compiler.OpOr:
+			if evaluator.IsTruthy(vm.stack[vm.sp-1]) == (op == compiler.OpOr) {
+				ip = int(compiler.ReadUint32(ins[ip:]))
+			} else {
+				vm.sp--
+				ip += 4
+			}
+
+		case compiler.OpGetGlobal:
+			name := fn.Constants[compiler.ReadUint16(ins[ip:])].(*object.String).Value
+			ip += 2
+			val, ok := vm.host.Lookup(name, f.cl.Globals)
+			if !ok {
+				return fail(newError("identifier not found: " + name))
+			}
+			vm.push(val)
+
+		case compiler.OpDefineGlobal:
+			name := fn.Constants[compiler.ReadUint16(ins[ip:])].(*object.String).Value
+			ip += 2
+			vm.sp--
+			f.cl.Globals.Set(name, vm.stack[vm.sp])
+
+		case compiler.OpGetLocal, compiler.OpGetCell, compiler.OpGetFree:
+			index := int(compiler.ReadUint16(ins[ip:]))
+			var val object.Object
+			switch op {
+			case compiler.OpGetLocal:
+				val = vm.stack[f.bp+index]
+			case compiler.OpGetCell:
+				val = vm.stack[f.bp+index].(*Cell).Value
+			default:
+				val = f.cl.Free[index].Value
+			}
+			if val == nil {
+				var err *object.Error
+				if val, err = vm.resolve(f, fn.Chains[compiler.ReadUint16(ins[ip+2:])]); err != nil {
+					return fail(err)
+				}
+			}
+			ip += 4
+			vm.push(val)
+
+		case compiler.OpSetLocal:
+			vm.sp--
+			vm.stack[f.bp+int(compiler.ReadUint16(ins[ip:]))] = vm.stack[vm.sp]
+			ip += 2
+
+		case compiler.OpSetCell:
+			vm.sp--
+			vm.stack[f.bp+int(compiler.ReadUint16(ins[ip:]))].(*Cell).Value = vm.stack[vm.sp]
+			ip += 2
+
+		case compiler.OpAssign, compiler.OpAssignLocal, compiler.OpAssignCell:
+			val := vm.stack[vm.sp-1]
+			assigned := false
+			switch op {
+			case compiler.OpAssignLocal:
+				slot := f.bp + int(compiler.ReadUint16(ins[ip:]))
+				if vm.stack[slot] != nil {
+					vm.stack[slot] = val
+					assigned = true
+				}
+				ip += 2
+			case compiler.OpAssignCell:
+				cell := vm.stack[f.bp+int(compiler.ReadUint16(ins[ip:]))].(*Cell)
+				if cell.Value != nil {
+					cell.Value = val
+					assigned = true
+				}
+				ip += 2
+			}
+			if !assigned {
+				if err := vm.assign(f, fn.Chains[compiler.ReadUint16(ins[ip:])], val); err != nil {
+					return fail(err)
+				}
+			}
+			ip += 2
+			if err := vm.host.CheckSize(val); err != nil {
+				return fail(err)
+			}
+
+		case compiler.OpNameFunction:
+			if cl, ok := vm.stack[vm.sp-1].(*Closure); ok && cl.Name == "" {
+				cl.Name = fn.Constants[compiler.ReadUint16(ins[ip:])].(*object.String).Value
+			}
+			ip += 2
+
+		case compiler.OpEnterScope:
+			layout := fn.Scopes[compiler.ReadUint16(ins[ip:])]
+			ip += 2
+			for _, slot := range layout.Clear {
+				vm.stack[f.bp+slot] = nil
+			}
+			for _, slot := range layout.Cells {
+				vm.stack[f.bp+slot] = &Cell{Value: vm.stack[f.bp+slot]}
+			}
+
+		case compiler.OpLoadCell:
+			vm.push(vm.stack[f.bp+int(compiler.ReadUint16(ins[ip:]))])
+			ip += 2
+
+		case compiler.OpLoadFree:
+			vm.push(f.cl.Free[compiler.ReadUint16(ins[ip:])])
+			ip += 2
+
+		case compiler.OpClosure:
+			compiled := fn.Constants[compiler.ReadUint16(ins[ip:])].(*compiler.CompiledFunction)
+			count := int(compiler.ReadUint16(ins[ip+2:]))
+			ip += 4
+
+			free := make([]*Cell, count)
+			for i := range free {
+				free[i] = vm.stack[vm.sp-count+i].(*Cell)
+			}
+			vm.sp -= count
+			vm.push(&Closure{Fn: compiled, Free: free, Globals: f.cl.Globals})
+
+		case compiler.OpArray:
+			count := int(compiler.ReadUint32(ins[ip:]))
+			ip += 4
+
+			elements := make([]object.Object, count)
+			copy(elements, vm.stack[vm.sp-count:vm.sp])
+			vm.sp -= count
+			array := &object.Array{Elements: elements}
+			if err := vm.host.CheckSize(array); err != nil {
+				return fail(err)
+			}
+			vm.push(array)
+
+		case compiler.OpHash:
+			count := int(compiler.ReadUint32(ins[ip:]))
+			ip += 4
+
+			hash := &object.Hash{}
+			for i := vm.sp - 2*count; i < vm.sp; i += 2 {
+				key, _ := evaluator.HashKey(vm.stack[i]) // OpHashKey has checked it
+				hash.Set(key, vm.stack[i+1])
+			}
+			vm.sp -= 2 * count
+			if err := vm.host.CheckSize(hash); err != nil {
+				return fail(err)
+			}
+			vm.push(hash)
+
+		case compiler.OpHashKey:
+			if _, err := evaluator.HashKey(vm.stack[vm.sp-1]); err != nil {
+				return fail(err)
+			}
+
+		case compiler.OpIndex:
+			index := vm.stack[vm.sp-1]
+			left := vm.stack[vm.sp-2]
+			vm.sp -= 2
+			result := evaluator.Index(left, index)
+			if err, ok := result.(*object.Error); ok {
+				return fail(err)
+			}
+			vm.push(result)
+
+		case compiler.OpSetIndex:
+			val := vm.stack[vm.sp-1]
+			index := vm.stack[vm.sp-2]
+			left := vm.stack[vm.sp-3]
+			vm.sp -= 3
+			result := evaluator.SetIndex(left, index, val)
+			if err, ok := result.(*object.Error); ok {
+				return fail(err)
+			}
+			if err := vm.host.CheckSize(left); err != nil {
+				return fail(err) // assigning a new key can grow a hash past its limit
+			}
+			if err := vm.host.CheckSize(result); err != nil {
+				return fail(err)
+			}
+			vm.push(result)
+
+		case compiler.OpMember:
+			name := fn.Constants[compiler.ReadUint16(ins[ip:])].(*object.String).Value
+			ip += 2
+			result := evaluator.Member(vm.stack[vm.sp-1], name)
+			if err, ok := result.(*object.Error); ok {
+				return fail(err)
+			}
+			vm.stack[vm.sp-1] = result
+
+		case compiler.OpCall:
+			argc := int(compiler.ReadUint16(ins[ip:]))
+			ip += 2
+			f.ip = ip
+
+			if err := vm.checkContext(); err != nil {
+				return fail(err)
+			}
+
+			callee := vm.stack[vm.sp-1-argc]
+			if cl, ok := callee.(*Closure); ok {
+				if err := vm.callClosure(cl, argc, fn.Span(pc)); err != nil {
+					return fail(err)
+				}
+			} else {
+				result := vm.callOther(callee, argc)
+				if err, ok := result.(*object.Error); ok {
+					return fail(err)
+				}
+				if err := vm.host.CheckSize(result); err != nil {
+					return fail(err)
+				}
+				vm.push(result)
+			}
+
+			// a call may have pushed a frame, or a builtin calling back into
+			// Farcical may have moved the frames while it ran
+			f = &vm.frames[len(vm.frames)-1]
+			fn = f.cl.Fn
+			ins = fn.Instructions
+			ip = f.ip
+
+		case compiler.OpReturnValue:
+			val := vm.stack[vm.sp-1]
+			returning := vm.frames[len(vm.frames)-1]
+			vm.popFrames(len(vm.frames) - 1)
+			vm.sp = returning.ret
+			if len(vm.frames) == base {
+				return val, nil
+			}
+
+			f = &vm.frames[len(vm.frames)-1]
+			fn = f.cl.Fn
+			ins = fn.Instructions
+			ip = f.ip
+			pc = ip - 3 // the OpCall, where the result of the call is checked
+			if err := vm.host.CheckSize(val); err != nil {
+				return fail(err)
+			}
+			vm.push(val)
+
+		case compiler.OpArgGiven:
+			if int(compiler.ReadUint16(ins[ip:])) < f.args {
+				ip = int(compiler.ReadUint32(ins[ip+2:]))
+			} else {
+				ip += 6
+			}
+
+		case compiler.OpCheckContext:
+			if err := vm.checkContext(); err != nil {
+				return fail(err)
+			}
+
+		case compiler.OpIterInit:
+			slot := f.bp + int(compiler.ReadUint16(ins[ip:]))
+			ip += 2
+			vm.sp--
+			iterable := vm.stack[vm.sp]
+			it, ok := newIterator(iterable)
+			if !ok {
+				return fail(newError("cannot iterate over %s", iterable.Type()))
+			}
+			vm.stack[slot] = it
+
+		case compiler.OpIterNext:
+			it := vm.stack[f.bp+int(compiler.ReadUint16(ins[ip:]))].(*iterator)
+			val, ok := it.next()
+			if !ok {
+				ip = int(compiler.ReadUint32(ins[ip+2:]))
+				break
+			}
+			if err := vm.checkContext(); err != nil {
+				return fail(err)
+			}
+			ip += 6
+			vm.push(val)
+
+		case compiler.OpSetupTry:
+			vm.handlers = append(vm.handlers, handler{
+				frame: len(vm.frames) - 1,
+				sp:    vm.sp,
+				ip:    int(compiler.ReadUint32(ins[ip:])),
+			})
+			ip += 4
+
+		case compiler.OpPopTry:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+		case compiler.OpCatch:
+			vm.stack[vm.sp-1] = evaluator.ErrorToHash(vm.stack[vm.sp-1].(*object.Error))
+
+		case compiler.OpRethrow:
+			vm.sp--
+			return fail(vm.stack[vm.sp].(*object.Error))
+
+		case compiler.OpThrow:
+			vm.sp--
+			return fail(evaluator.Throw(vm.stack[vm.sp]))
+
+		case compiler.OpImport:
+			path := fn.Constants[compiler.ReadUint16(ins[ip:])].(*object.String).Value
+			ip += 2
+			f.ip = ip
+
+			exports := vm.host.Import(path, fn.Span(pc).Pos.Filename)
+			if err, ok := exports.(*object.Error); ok {
+				return fail(err)
+			}
+			f = &vm.frames[len(vm.frames)-1] // the module ran on top of this frame
+			vm.push(exports)
+
+		case compiler.OpImportAlias:
+			name := fn.Constants[compiler.ReadUint16(ins[ip:])].(*object.String).Value
+			ip += 2
+			ns := vm.stack[vm.sp-1].(*object.Namespace)
+			f.cl.Globals.Set(name, &object.Namespace{Name: name, Members: ns.Members})
+
+		case compiler.OpImportName:
+			name := fn.Constants[compiler.ReadUint16(ins[ip:])].(*object.String).Value
+			path := fn.Constants[compiler.ReadUint16(ins[ip+2:])].(*object.String).Value
+			ip += 4
+			val, ok := vm.stack[vm.sp-1].(*object.Namespace).Members[name]
+			if !ok {
+				return fail(newError("module %q has no export %s", path, name))
+			}
+			f.cl.Globals.Set(name, val)
+
+		case compiler.OpExport:
+			if vm.exports != nil {
+				name := fn.Constants[compiler.ReadUint16(ins[ip:])].(*object.String).Value
+				*vm.exports = append(*vm.exports, name)
+			}
+			ip += 2
+
+		default:
+			return fail(newError("unknown opcode %d", op))
+		}
+	}
+}
+
+// callOther calls anything but a closure with the arguments on top of the stack, popping them and it
+func (vm *VM) callOther(callee object.Object, argc int) object.Object {
+	args := make([]object.Object, argc)
+	copy(args, vm.stack[vm.sp-argc:vm.sp])
+	vm.sp -= argc + 1
+
+	switch callee := callee.(type) {
+	case *object.Builtin:
+		return callee.Fn(vm, args...)
+	case *object.Function:
+		return vm.host.Call(callee, args...)
+	default:
+		return newError("not a function: %s", callee.Type())
+	}
+}
+
+// resolve reads the first variable of a chain that has been set
+func (vm *VM) resolve(f *frame, chain []compiler.Location) (object.Object, *object.Error) {
+	for _, loc := range chain {
+		var val object.Object
+		switch loc.Kind {
+		case compiler.Local:
+			val = vm.stack[f.bp+loc.Index]
+		case compiler.Cell:
+			val = vm.stack[f.bp+loc.Index].(*Cell).Value
+		case compiler.Free:
+			val = f.cl.Free[loc.Index].Value
+		case compiler.Global:
+			name := f.cl.Fn.Constants[loc.Index].(*object.String).Value
+			if val, ok := vm.host.Lookup(name, f.cl.Globals); ok {
+				return val, nil
+			}
+			return nil, newError("identifier not found: " + name)
+		}
+		if val != nil {
+			return val, nil
+		}
+	}
+	return nil, newError("identifier not found")
+}
+
+// assign sets the first variable of a chain that has been set, as env.Assign does
+func (vm *VM) assign(f *frame, chain []compiler.Location, val object.Object) *object.Error {
+	for _, loc := range chain {
+		switch loc.Kind {
+		case compiler.Local:
+			if vm.stack[f.bp+loc.Index] != nil {
+				vm.stack[f.bp+loc.Index] = val
+				return nil
+			}
+		case compiler.Cell, compiler.Free:
+			var cell *Cell
+			if loc.Kind == compiler.Cell {
+				cell = vm.stack[f.bp+loc.Index].(*Cell)
+			} else {
+				cell = f.cl.Free[loc.Index]
+			}
+			if cell.Value != nil {
+				cell.Value = val
+				return nil
+			}
+		case compiler.Global:
+			name := f.cl.Fn.Constants[loc.Index].(*object.String).Value
+			if f.cl.Globals.Assign(name, val) {
+				return nil
+			}
+			return newError("assignment to undeclared variable: %s", name)
+		}
+	}
+	return newError("assignment to undeclared variable")
+}
+
+// binaryOperation applies a binary operator, doing the arithmetic and comparisons of
+// integers that fit in an int64 itself and leaving everything else to the evaluator
+func (vm *VM) binaryOperation(op compiler.Opcode, left, right object.Object) object.Object {
+	if l, ok := left.(*object.Integer); ok {
+		if r, ok := right.(*object.Integer); ok {
+			if result := integerOperation(op, l.Value, r.Value); result != nil {
+				return result
+			}
+		}
+	}
+
+	result := evaluator.Infix(operators[op], left, right)
+	if err := vm.host.CheckSize(result); err != nil {
+		return err
+	}
+	return result
+}
+
+// operators gives the operator of each binary opcode
+var operators = func() (operators [256]string) {
+	for op, operator := range compiler.Operators {
+		operators[op] = operator
+	}
+	return
+}()
+
+// integerOperation is the fast path of binaryOperation. It returns nil when the
+// evaluator has to take over: on overflow, division by zero and for ranges
+func integerOperation(op compiler.Opcode, l, r int64) object.Object {
+	switch op {
+	case compiler.OpAdd:
+		if sum := l + r; (sum > l) == (r > 0) {
+			return integer(sum)
+		}
+	case compiler.OpSub:
+		if diff := l - r; (diff < l) == (r > 0) {
+			return integer(diff)
+		}
+	case compiler.OpMul:
+		if l == 0 || r == 0 {
+			return integer(0)
+		}
+		if product := l * r; product/r == l && !(l == -1 && r == math.MinInt64) && !(r == -1 && l == math.MinInt64) {
+			return integer(product)
+		}
+	case compiler.OpDiv:
+		if r != 0 && !(l == math.MinInt64 && r == -1) {
+			return integer(l / r)
+		}
+	case compiler.OpMod:
+		if r != 0 {
+			return integer(l % r)
+		}
+	case compiler.OpEqual:
+		return boolean(l == r)
+	case compiler.OpNotEqual:
+		return boolean(l != r)
+	case compiler.OpLess:
+		return boolean(l < r)
+	case compiler.OpGreater:
+		return boolean(l > r)
+	case compiler.OpLessEqual:
+		return boolean(l <= r)
+	case compiler.OpGreaterEqual:
+		return boolean(l >= r)
+	}
+	return nil
+}
+
+func boolean(b bool) *object.Boolean {
+	if b {
+		return evaluator.TRUE
+	}
+	return evaluator.FALSE
+}
+
+// smallIntegers are shared rather than allocated afresh every time, as most
+// integers a script makes, such as loop counters, are small
+var smallIntegers = func() (ints [1280]object.Integer) {
+	for i := range ints {
+		ints[i].Value = int64(i) - 256
+	}
+	return
+}()
+
+func integer(n int64) *object.Integer {
+	if n >= -256 && n < 1024 {
+		return &smallIntegers[n+256]
+	}
+	return &object.Integer{Value: n}
+}
+
+func (vm *VM) push(obj object.Object) {
+	if vm.sp == len(vm.stack) {
+		vm.ensureStack(vm.sp + 1)
+	}
+	vm.stack[vm.sp] = obj
+	vm.sp++
+}
+
+// ensureStack grows the stack to at least size slots
+func (vm *VM) ensureStack(size int) {
+	if size <= len(vm.stack) {
+		return
+	}
+	grown := make([]object.Object, 2*size)
+	copy(grown, vm.stack[:vm.sp])
+	vm.stack = grown
+}
+
+func (vm *VM) clearSlots(from, to int) {
+	for i := from; i < to; i++ {
+		vm.stack[i] = nil
+	}
+}
+
+// internalError turns a Go panic into an error, so a bug fails one script instead of crashing the host
+func internalError(r interface{}) *object.Error {
+	err := &object.Error{Message: fmt.Sprintf("internal error: %v", r), Kind: "InternalError"}
+	if cause, ok := r.(error); ok {
+		err.Cause = cause
+	}
+	return err
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
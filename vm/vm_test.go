@@ -0,0 +1,407 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"farcical/compiler"
+	"farcical/evaluator"
+	"farcical/lexer"
+	"farcical/object"
+	"farcical/parser"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAgainstEvaluator runs every program in the evaluator's tests on both engines
+// and checks that they agree on the result, or on the error and where it happened
+func TestAgainstEvaluator(t *testing.T) {
+	inputs := evaluatorTestInputs(t)
+	if len(inputs) < 500 {
+		t.Fatalf("found only %d programs in the evaluator's tests", len(inputs))
+	}
+	inputs = append(inputs, controlFlow...)
+
+	for i, input := range inputs {
+		p := parser.New(lexer.New(input))
+		program := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			// most string literals in the evaluator's tests are expected values rather than programs
+			if i >= len(inputs)-len(controlFlow) {
+				t.Errorf("%q: parse errors: %v", input, p.Errors())
+			}
+			continue
+		}
+
+		want := run(t, input, func(e *evaluator.Evaluator, ctx context.Context, env *object.Environment) object.Object {
+			return e.EvalContext(ctx, program, env)
+		})
+		got := run(t, input, func(e *evaluator.Evaluator, ctx context.Context, env *object.Environment) object.Object {
+			main, err := compiler.Compile(program)
+			if err != nil {
+				t.Fatalf("%q: compile error: %s", input, err)
+			}
+			vm := New(e)
+			e.RunModule = vm.RunModule
+			return vm.RunContext(ctx, main, env)
+		})
+
+		compareResults(t, input, got, want)
+	}
+}
+
+// controlFlow covers corners of the compiler's control flow the evaluator's tests don't reach
+var controlFlow = []string{
+	"let r = []; for (i in 0..5) { try { if (i == 3) { break } r = push(r, i) } finally { r = push(r, -i) } } r",
+	"let r = []; for (i in 0..4) { try { if (i % 2 == 0) { continue } r = push(r, i) } finally { r = push(r, 10) } } r",
+	"let f = function() { try { return 1 } finally { return 2 } }; f()",
+	"let f = function() { for (i in 0..3) { try { return i } finally { if (i == 0) { continue } } } }; f()",
+	"let f = function() { try { throw 1 } catch (e) { throw e[\"value\"] + 1 } finally { 0 } }; try { f() } catch (e) { e[\"value\"] }",
+	"let f = function() { try { 1 + true } catch (e) { 1 + false } finally { 2 } }; f()",
+	"let f = function() { try { 1 + true } finally { 2 } }; f()",
+	"try { try { throw 1 } finally { 2 } } catch (e) { e[\"value\"] * 10 }",
+	"let n = 0; while (n < 10) { try { n += 1; if (n == 5) { break } } catch (e) { 0 } } n",
+	"let x = 1; let f = function() { let y = x; let x = 2; [y, x] }; f()",
+	"let f = function() { let g = function() { x }; let x = 5; g() }; f()",
+	"let x = 1; let f = function() { x = 2; let x = 3; x = 4; x }; [f(), x]",
+	"let f = function(a, b = a * 2, ...rest) { [a, b, rest] }; [f(1), f(1, 5), f(1, 5, 6, 7)]",
+	"let f = function(a, a) { a }; f(1, 2)",
+	"let make = function() { let fs = []; for (i in 0..3) { let j = i * 10; fs = push(fs, function() { i + j }) } fs }; map(make(), function(f) { f() })",
+	"let counter = function() { let n = 0; function() { n += 1; n } }; let c = counter(); c(); c(); c()",
+	"let outer = function(a) { function(b) { function(c) { a = a + b + c; a } } }; let f = outer(1)(2); f(3) + f(3)",
+	"let f = function() { let h = {}; h[\"a\"] = 1; h[\"a\"] += 2; h }; f()",
+	"let a = [1, 2, 3]; a[1] *= 10; a",
+	"let s = \"\"; for (c in \"héllo\") { s = c + s } s",
+	"let h = {\"b\": 1, \"a\": 2}; let ks = []; for (k in h) { ks = push(ks, k); h[\"c\" + k] = 0 } ks",
+	"let a = [1]; let n = 0; for (x in a) { if (n < 3) { a = push(a, x) } n += 1 } n",
+	"for (i in 0..3) { i }",
+	"let f = function() { for (i in 0..3) { } }; f()",
+	"let f = function() { if (true) { let z = 1 } z }; f()",
+	"let f = function() { try { throw 1 } catch (e) { let inner = e } inner }; f()",
+	"let f = function() { try { 1 } catch (e) { 2 } }; f()",
+	"if (1) { } else { 2 }",
+	"let f = function(n) { if (n == 0) { return \"done\" } f(n - 1) }; f(100)",
+	"let f = function() { g() }; let g = function() { h() }; let h = function() { [][0] + 1 }; f()",
+	"let f = function(x) { x.y }; f(1)",
+	"1 && 2 || 3",
+	"false || [][0] && 1",
+	"let x = 5; x += \"a\"",
+	"y = 1",
+	"let f = function() { q = 1 }; f()",
+	"-9223372036854775807 - 1 - 1",
+	"let x = -(-9223372036854775807 - 1); x",
+	"9223372036854775807 * 2 / 2",
+	"(-9223372036854775807 - 1) / -1",
+	"5 % 0",
+	"5 / 0",
+	"let f = function() { 1 }; f(1, 2)",
+	"let f = function(a, b = 1) { a }; f()",
+	"let x = 0; let f = function() { x += 1; x }; f() + f() + f()",
+	"try { throw {\"code\": 7} } catch (e) { e[\"value\"][\"code\"] }",
+	"let e = 1; try { throw 2 } catch (e) { 0 } e",
+	"let f = function() { try { return 1 } finally { 2 } }; f()",
+	"let f = function() { while (true) { try { break } finally { return 3 } } }; f()",
+}
+
+// evaluatorTestInputs returns every string literal in the evaluator's tests
+func evaluatorTestInputs(t *testing.T) []string {
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, "../evaluator/evaluator_test.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	var inputs []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		lit, ok := n.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		s, err := strconv.Unquote(lit.Value)
+		if err == nil && !seen[s] {
+			seen[s] = true
+			inputs = append(inputs, s)
+		}
+		return true
+	})
+	return inputs
+}
+
+// modules are the ones the evaluator's tests import
+var modules = map[string]string{
+	"lib/math.fa":     `import { double } from "util"; export let square = function(x) { x * x }; export let quad = function(x) { double(double(x)) }; let hidden = 1;`,
+	"lib/util.fa":     `export let double = function(x) { x * 2 }; tick();`,
+	"vendor/greet.fa": `export let greet = function(name) { "hi " + name };`,
+	"broken.fa":       `export let f = function() { 1 + true };`,
+	"syntax.fa":       `let = 1;`,
+	"a.fa":            `import "b.fa" as b; export let x = 1;`,
+	"b.fa":            `import "a.fa" as a; export let y = 2;`,
+}
+
+// run runs input with a fresh evaluator configured for testing, bounding how long it may take
+func run(t *testing.T, input string, engine func(*evaluator.Evaluator, context.Context, *object.Environment) object.Object) object.Object {
+	e := evaluator.New()
+	e.Stdout = io.Discard
+	e.Stderr = io.Discard
+	e.Stdin = strings.NewReader("")
+	e.Limits = evaluator.Limits{
+		MaxSteps:        2000000,
+		MaxDepth:        evaluator.DefaultMaxDepth,
+		MaxStringLength: 1 << 16,
+		MaxArrayLength:  1 << 12,
+		MaxHashSize:     1 << 12,
+		MaxIntegerBits:  1 << 16,
+	}
+	e.RegisterBuiltin("tick", func(rt object.Runtime, args ...object.Object) object.Object {
+		return evaluator.NULL
+	})
+	e.RegisterBuiltin("explode", func(rt object.Runtime, args ...object.Object) object.Object {
+		var arr []object.Object
+		return arr[len(args)]
+	})
+	e.SearchPath = []string{"vendor"}
+	e.ReadModule = func(path string) ([]byte, error) {
+		src, ok := modules[filepath.ToSlash(path)]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		return []byte(src), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return engine(e, ctx, object.NewEnvironment())
+}
+
+func compareResults(t *testing.T, input string, got, want object.Object) {
+	t.Helper()
+
+	wantErr, wantIsErr := want.(*object.Error)
+	gotErr, gotIsErr := got.(*object.Error)
+	if wantIsErr || gotIsErr {
+		if !wantIsErr || !gotIsErr {
+			t.Errorf("%q: got %s, want %s", input, inspect(got), inspect(want))
+			return
+		}
+		// the engines count steps differently, so they give up at different places
+		var limit *evaluator.LimitError
+		if errors.As(wantErr.Cause, &limit) || errors.As(gotErr.Cause, &limit) {
+			return
+		}
+		if gotErr.Message != wantErr.Message || gotErr.ErrorType() != wantErr.ErrorType() {
+			t.Errorf("%q: got error %q (%s), want %q (%s)", input, gotErr.Message, gotErr.ErrorType(), wantErr.Message, wantErr.ErrorType())
+		} else if gotErr.Span != wantErr.Span {
+			t.Errorf("%q: error %q at %s, want %s", input, gotErr.Message, gotErr.Span, wantErr.Span)
+		} else if !sameStack(gotErr.Stack, wantErr.Stack) {
+			t.Errorf("%q: error %q has stack %+v, want %+v", input, gotErr.Message, gotErr.Stack, wantErr.Stack)
+		}
+		return
+	}
+
+	if inspect(got) != inspect(want) {
+		t.Errorf("%q: got %s, want %s", input, inspect(got), inspect(want))
+	}
+}
+
+func sameStack(a, b []object.Frame) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// inspect describes a value for comparison. Unlike Inspect it copes with the Go nil
+// that value-less statements give, which can end up inside arrays and hashes
+func inspect(obj object.Object) string {
+	return describe(obj, map[object.Object]bool{})
+}
+
+// describe is inspect keeping the arrays and hashes around obj, for ones that contain themselves
+func describe(obj object.Object, path map[object.Object]bool) string {
+	switch obj := obj.(type) {
+	case nil:
+		return "nil"
+	case *object.Array:
+		if path[obj] {
+			return "[...]"
+		}
+		path[obj] = true
+		defer delete(path, obj)
+
+		elements := make([]string, len(obj.Elements))
+		for i, el := range obj.Elements {
+			elements[i] = describe(el, path)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *object.Hash:
+		if path[obj] {
+			return "{...}"
+		}
+		path[obj] = true
+		defer delete(path, obj)
+
+		pairs := []string{}
+		for _, pair := range obj.Ordered() {
+			pairs = append(pairs, describe(pair.Key, path)+": "+describe(pair.Value, path))
+		}
+		return "{" + strings.Join(pairs, ", ") + "}"
+	}
+	return string(obj.Type()) + " " + obj.Inspect()
+}
+
+func TestRunContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	tests := []struct {
+		ctx   context.Context
+		input string
+		cause error
+	}{
+		{cancelled, "while (true) { }", context.Canceled},
+		{cancelled, "for (i in 0..1000000000) { }", context.Canceled},
+		{cancelled, "let f = function() { 1 }; f()", context.Canceled},
+		{cancelled, "try { while (true) { } } catch (e) { 1 } finally { 2 }", context.Canceled},
+		{expired, "while (true) { }", context.DeadlineExceeded},
+		{expired, "let f = function(n) { if (n > 0) { f(n - 1) } }; while (true) { f(100) }", context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		e := evaluator.New()
+		evaluated := New(e).RunContext(tt.ctx, compile(t, tt.input), object.NewEnvironment())
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%q: expected an error, got %T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Cause != tt.cause {
+			t.Errorf("%q: wrong cause, expected=%v got=%v", tt.input, tt.cause, errObj.Cause)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		limits evaluator.Limits
+		input  string
+		limit  string
+	}{
+		{evaluator.Limits{MaxSteps: 100}, "while (true) { }", "MaxSteps"},
+		{evaluator.Limits{MaxDepth: 50}, "let f = function(n) { f(n + 1) }; f(0)", "MaxDepth"},
+		{evaluator.Limits{MaxStringLength: 10}, `let s = "ab"; while (true) { s += s }`, "MaxStringLength"},
+		{evaluator.Limits{MaxArrayLength: 3}, "let a = []; while (true) { a = push(a, 1) }", "MaxArrayLength"},
+		{evaluator.Limits{MaxHashSize: 2}, "let h = {}; for (i in 0..10) { h[i] = i }", "MaxHashSize"},
+		{evaluator.Limits{MaxIntegerBits: 100}, "let n = 2; while (true) { n = n * n }", "MaxIntegerBits"},
+	}
+
+	for _, tt := range tests {
+		e := evaluator.New()
+		e.Limits = tt.limits
+		evaluated := New(e).Run(compile(t, tt.input), object.NewEnvironment())
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%q: expected an error, got %T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		limitErr, ok := errObj.Cause.(*evaluator.LimitError)
+		if !ok || limitErr.Limit != tt.limit {
+			t.Errorf("%q: expected %s to be exceeded, got %q", tt.input, tt.limit, errObj.Message)
+		}
+	}
+
+	// the step budget is per run rather than per VM
+	e := evaluator.New()
+	e.Limits = evaluator.Limits{MaxSteps: 200}
+	vm := New(e)
+	for i := 0; i < 3; i++ {
+		evaluated := vm.Run(compile(t, "let x = 0; while (x < 5) { x += 1 } x"), object.NewEnvironment())
+		if n, ok := evaluated.(*object.Integer); !ok || n.Value != 5 {
+			t.Fatalf("run %d: expected 5, got %T (%+v)", i, evaluated, evaluated)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	e := evaluator.New()
+	vm := New(e)
+	env := object.NewEnvironment()
+	vm.Run(compile(t, `let count = 0; let add = function(a, b = 10) { count += 1; a + b }; let fail = function() { 1 + true }`), env)
+
+	add, _ := env.Get("add")
+	if result := vm.Call(add, &object.Integer{Value: 1}); result.Inspect() != "11" {
+		t.Errorf("add(1) = %s, want 11", result.Inspect())
+	}
+	if result := vm.Call(add, &object.Integer{Value: 1}, &object.Integer{Value: 2}); result.Inspect() != "3" {
+		t.Errorf("add(1, 2) = %s, want 3", result.Inspect())
+	}
+	if count, _ := env.Get("count"); count.Inspect() != "2" {
+		t.Errorf("count = %s, want 2", count.Inspect())
+	}
+
+	fail, _ := env.Get("fail")
+	errObj, ok := vm.Call(fail).(*object.Error)
+	if !ok || errObj.Message != "type mismatch: INTEGER + BOOLEAN" {
+		t.Fatalf("expected a type mismatch, got %+v", errObj)
+	}
+	if len(errObj.Stack) != 1 || errObj.Stack[0].Function != "fail" {
+		t.Errorf("wrong stack, got=%+v", errObj.Stack)
+	}
+	if errObj, ok := vm.Call(add).(*object.Error); !ok || errObj.Message != "wrong number of arguments to add, got=0, want=1 or 2" {
+		t.Errorf("expected an arity error, got %+v", errObj)
+	}
+
+	// nothing is left behind on the VM's stacks
+	if vm.sp != 0 || len(vm.frames) != 0 || len(vm.handlers) != 0 || vm.depth != 0 {
+		t.Errorf("VM not unwound: sp=%d frames=%d handlers=%d depth=%d", vm.sp, len(vm.frames), len(vm.handlers), vm.depth)
+	}
+}
+
+func compile(t *testing.T, input string) *compiler.CompiledFunction {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("%q: parse errors: %v", input, p.Errors())
+	}
+	main, err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("%q: compile error: %s", input, err)
+	}
+	return main
+}
+
+const fib = `let fib = function(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(22)`
+
+func BenchmarkEvaluator(b *testing.B) {
+	program := parser.New(lexer.New(fib)).ParseProgram()
+	for i := 0; i < b.N; i++ {
+		evaluator.New().Eval(program, object.NewEnvironment())
+	}
+}
+
+func BenchmarkVM(b *testing.B) {
+	main, err := compiler.Compile(parser.New(lexer.New(fib)).ParseProgram())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		New(evaluator.New()).Run(main, object.NewEnvironment())
+	}
+}